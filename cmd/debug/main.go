@@ -20,37 +20,52 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer func() {
+		if err := systemStorage.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
 
 	dataStorage, err := systemStorage.NewLayer("data")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	systemStructure, err := structure.New(dataStorage)
+	bufferPool, err := storage.NewBufferPool(4096, 1024)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := bufferPool.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	systemStructure, err := structure.New(dataStorage, structure.WithBufferPool(bufferPool))
 	if err != nil {
 		log.Fatal(err)
 	}
-	db1, err := systemStructure.Create(ctx, "db1")
+	db1, err := systemStructure.CreateIfNotExists(ctx, "db1")
 	if err != nil {
 		log.Fatal(err)
 	}
-	if _, err = db1.Create(ctx, "sch1"); err != nil {
+	if _, err = db1.CreateIfNotExists(ctx, "sch1"); err != nil {
 		log.Fatal(err)
 	}
-	if _, err = db1.Create(ctx, "sch2"); err != nil {
+	if _, err = db1.CreateIfNotExists(ctx, "sch2"); err != nil {
 		log.Fatal(err)
 	}
-	if _, err = db1.Create(ctx, "sch3"); err != nil {
+	if _, err = db1.CreateIfNotExists(ctx, "sch3"); err != nil {
 		log.Fatal(err)
 	}
-	db2, err := systemStructure.Create(ctx, "db2")
+	db2, err := systemStructure.CreateIfNotExists(ctx, "db2")
 	if err != nil {
 		log.Fatal(err)
 	}
-	if _, err = db2.Create(ctx, "sch1"); err != nil {
+	if _, err = db2.CreateIfNotExists(ctx, "sch1"); err != nil {
 		log.Fatal(err)
 	}
-	if _, err = db2.Create(ctx, "sch2"); err != nil {
+	if _, err = db2.CreateIfNotExists(ctx, "sch2"); err != nil {
 		log.Fatal(err)
 	}
 
@@ -12,6 +12,7 @@ import (
 func main() {
 	p, err := parser.NewSqlParser(tokenizer.NewSqlTokenizer(), []parser.StatementParser{
 		sql.NewSelectParser(),
+		sql.NewVacuumParser(),
 	})
 	if err != nil {
 		log.Fatal(err)
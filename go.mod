@@ -3,12 +3,12 @@ module ktdb
 go 1.22.0
 
 require (
+	github.com/bzick/tokenizer v1.4.0
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.8.4
 )
 
 require (
-	github.com/bzick/tokenizer v1.4.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
@@ -36,8 +36,8 @@ func (i *IntProcessor) Load(size int64, payload []byte) (column.Column, error) {
 	return res, nil
 }
 
-// Int is a structure that is to represent column type Int, the size of the payload is based on the system architecture.
-// Supported architectures of int size 16, 32, 64 bit size
+// Int is a structure that is to represent column type Int, the size of the payload is the size of the column.
+// Supported column sizes are 2, 4 and 8 bytes, the payload is laid out the same on every architecture.
 type Int int64
 
 func (i Int) Type() column.Type {
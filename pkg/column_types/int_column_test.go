@@ -20,9 +20,6 @@ func TestInt_Marshal(t *testing.T) {
 		} // 16, 32, 64 bit into bytes
 		for testName, architecture := range architectures {
 			t.Run(testName, func(t *testing.T) {
-				if architecture > sys.IntByteSize {
-					t.Skip(fmt.Sprintf("unsupported architecture int size of %d bytes", architecture))
-				}
 				myInt := column_types.Int(5)
 				expected := make([]byte, architecture)
 				if architecture == 2 {
@@ -43,7 +40,7 @@ func TestInt_Marshal(t *testing.T) {
 	})
 	t.Run("fail - unsupported size", func(t *testing.T) {
 		myInt := column_types.Int(5)
-		givenSize := sys.IntByteSize - 1
+		givenSize := sys.Int64ByteSize - 1
 		res, err := myInt.Bytes(givenSize)
 		assert.EqualError(t, err, fmt.Sprintf("(int[size=%d]) unsupported size", givenSize))
 		assert.Nil(t, res)
@@ -59,9 +56,6 @@ func TestIntProcessor_Load(t *testing.T) {
 		} // 16, 32, 64 bit into bytes
 		for testName, architecture := range architectures {
 			t.Run(testName, func(t *testing.T) {
-				if architecture > sys.IntByteSize {
-					t.Skip(fmt.Sprintf("unsupported architecture int size of %d bytes", architecture))
-				}
 				expected := column_types.Int(5)
 				given := make([]byte, architecture)
 				if architecture == 2 {
@@ -82,16 +76,16 @@ func TestIntProcessor_Load(t *testing.T) {
 	})
 
 	t.Run("fail - bad payload", func(t *testing.T) {
-		given := make([]byte, sys.IntByteSize-1) // Subtract 1 from sys.IntByteSize to ensure given bytes are not enough to produce an int
+		given := make([]byte, sys.Int64ByteSize-1) // Subtract 1 from sys.Int64ByteSize to ensure given bytes are not enough to produce an int
 
-		res, err := new(column_types.IntProcessor).Load(sys.IntByteSize, given)
-		assert.EqualError(t, err, fmt.Sprintf("(int[size=%d]) payload byte size [size=%d] exceeds allocated size", sys.IntByteSize, sys.IntByteSize-1))
+		res, err := new(column_types.IntProcessor).Load(sys.Int64ByteSize, given)
+		assert.EqualError(t, err, fmt.Sprintf("(int[size=%d]) payload byte size [size=%d] exceeds allocated size", sys.Int64ByteSize, sys.Int64ByteSize-1))
 		assert.Nil(t, res)
 	})
 
 	t.Run("fail - unsupported size", func(t *testing.T) {
-		givenSize := sys.IntByteSize - 1
-		given := make([]byte, givenSize) // Subtract 1 from sys.IntByteSize to ensure given bytes are not enough to produce an int
+		givenSize := sys.Int64ByteSize - 1
+		given := make([]byte, givenSize) // Subtract 1 from sys.Int64ByteSize to ensure given bytes are not enough to produce an int
 		res, err := new(column_types.IntProcessor).Load(givenSize, given)
 		assert.EqualError(t, err, fmt.Sprintf("(int[size=%d]) unsupported size", givenSize))
 		assert.Nil(t, res)
@@ -0,0 +1,139 @@
+package row
+
+import (
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/grid/column"
+	"ktdb/pkg/sys"
+)
+
+// MaxVersions is the maximum number of versions a history can hold, the versions are tagged with two bytes.
+const MaxVersions = 1 << 16
+
+// History holds the versions of a row schema, every version appends columns to the previous one. The rows written
+// with an older version are upgraded to the latest one on read, without rewriting them.
+type History struct {
+	versions []*Schema
+}
+
+func NewHistory(schema *Schema) *History {
+	return &History{versions: []*Schema{schema}}
+}
+
+// Latest returns the schema of the latest version.
+func (h *History) Latest() *Schema {
+	return h.versions[len(h.versions)-1]
+}
+
+// Version returns the latest version.
+func (h *History) Version() int {
+	return len(h.versions) - 1
+}
+
+func (h *History) Schema(version int) (*Schema, error) {
+	if version < 0 || version >= len(h.versions) {
+		return nil, errors.Errorf("(row=[version=%d]) unknown version", version)
+	}
+	return h.versions[version], nil
+}
+
+// Evolve returns the history with the schema as its latest version. The schema replaces the latest version if it
+// has the same columns, it is added as a new version if it appends columns to them. The schema must not change the
+// layout of the existing columns and the appended columns must be nullable or have a default.
+func (h *History) Evolve(schema *Schema) (*History, error) {
+	latest := h.Latest()
+	if len(schema.columnSchemas) < len(latest.columnSchemas) {
+		return nil, errors.New("columns cannot be removed")
+	}
+	for i, colSchema := range latest.columnSchemas {
+		evolved := schema.columnSchemas[i]
+		if evolved.Type != colSchema.Type || evolved.Size != colSchema.Size || evolved.Nullable != colSchema.Nullable {
+			return nil, errors.Errorf("(row=[column_position=%d]) layout cannot be changed", i)
+		}
+	}
+	for i, colSchema := range schema.columnSchemas[len(latest.columnSchemas):] {
+		if !colSchema.Nullable && len(colSchema.Default) == 0 {
+			return nil, errors.Errorf("(row=[column_position=%d]) is not nullable and has no default", len(latest.columnSchemas)+i)
+		}
+	}
+
+	versions := make([]*Schema, len(h.versions), len(h.versions)+1)
+	copy(versions, h.versions)
+	if len(schema.columnSchemas) == len(latest.columnSchemas) {
+		versions[len(versions)-1] = schema
+	} else {
+		if len(versions) == MaxVersions {
+			return nil, errors.Errorf("exceeds the maximum of versions [versions=%d]", MaxVersions)
+		}
+		versions = append(versions, schema)
+	}
+	return &History{versions: versions}, nil
+}
+
+// Upgrade returns the row of the version in the layout of the latest version, the appended columns get their default
+// or null.
+func (h *History) Upgrade(version int, row Row) (Row, error) {
+	schema, err := h.Schema(version)
+	if err != nil {
+		return nil, err
+	}
+	if rowSize := int64(len(row)); rowSize != schema.rowSize {
+		return nil, errors.Errorf("expected row of size [bytes=%d], got [bytes=%d]", schema.rowSize, rowSize)
+	}
+	if version == h.Version() {
+		return row, nil
+	}
+
+	latest := h.Latest()
+	res := make(Row, schema.rowSize, latest.rowSize)
+	copy(res, row)
+	for _, colSchema := range latest.columnSchemas[len(schema.columnSchemas):] {
+		if len(colSchema.Default) > 0 {
+			res = append(res, colSchema.Default...)
+		} else {
+			res = append(res, make([]byte, colSchema.PayloadSize())...)
+		}
+	}
+	return res, nil
+}
+
+// Columns returns the columns of the row of the version in the layout of the latest version.
+func (h *History) Columns(processor column.Processor, version int, row Row) ([]column.Column, error) {
+	upgraded, err := h.Upgrade(version, row)
+	if err != nil {
+		return nil, err
+	}
+	return h.Latest().Columns(processor, upgraded)
+}
+
+func (h *History) Bytes() ([]byte, error) {
+	versionBytes := make([][]byte, len(h.versions))
+	for i, schema := range h.versions {
+		schemaBytes, err := schema.Bytes()
+		if err != nil {
+			return nil, errors.Wrapf(err, "(row=[version=%d]) could not get bytes of the schema", i)
+		}
+		versionBytes[i] = sys.New(schemaBytes)
+	}
+	return sys.ConcatSlices(versionBytes...), nil
+}
+
+func (h *History) Load(payload []byte) error {
+	versionPayloads, err := sys.ReadAll(payload)
+	if err != nil {
+		return errors.Wrap(err, "deserialization failed")
+	}
+	if len(versionPayloads) == 0 || len(versionPayloads) > MaxVersions {
+		return errors.New("corrupted payload")
+	}
+
+	h.versions = make([]*Schema, len(versionPayloads))
+	for i, versionPayload := range versionPayloads {
+		schema := &Schema{}
+		if err := schema.Load(versionPayload); err != nil {
+			return errors.Wrapf(err, "(row=[version=%d]) loading schema", i)
+		}
+		h.versions[i] = schema
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/pkg/errors"
 
 	"ktdb/pkg/engine/grid/column"
+	"ktdb/pkg/engine/identifier"
 )
 
 type Processor interface {
@@ -26,9 +27,17 @@ type processor struct {
 }
 
 func (p *processor) Prepare(schema *Schema, columns map[string]column.Column) ([]column.Column, error) {
+	folded := make(map[string]column.Column, len(columns))
+	for name, col := range columns {
+		if _, found := folded[identifier.Fold(name)]; found {
+			return nil, errors.Errorf("(row=[column_name=%s]) is given more than once", identifier.Fold(name))
+		}
+		folded[identifier.Fold(name)] = col
+	}
+
 	res := make([]column.Column, len(schema.columnSchemas))
 	for i, colSchema := range schema.columnSchemas {
-		col, found := columns[colSchema.Name]
+		col, found := folded[colSchema.Name]
 		if found == false && colSchema.Default != nil {
 			var err error
 			col, err = colSchema.Column(p.columnProcessor, colSchema.Default)
@@ -46,22 +55,35 @@ func (p *processor) Prepare(schema *Schema, columns map[string]column.Column) ([
 	return res, nil
 }
 
+// New returns the row schema of the given columns, the column names are normalized in the returned schema.
 func (p *processor) New(columnSchemas []*column.Schema) (*Schema, error) {
 	rowSize := int64(0)
 	cols := make(map[string]struct{})
+	normalized := make([]*column.Schema, len(columnSchemas))
 	for i, colSchema := range columnSchemas {
 		if colSchema == nil {
 			return nil, errors.Errorf("(row=[column_position=%d]) is not defined", i)
 		}
-		if _, found := cols[colSchema.Name]; found {
-			return nil, errors.Errorf("(row=[column_position=%d, column_name=%s]) already exists", i, colSchema.Name)
+		name, err := identifier.Normalize(identifier.KindColumn, colSchema.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "(row=[column_position=%d]) invalid column name", i)
+		}
+		if _, found := cols[name]; found {
+			return nil, errors.Errorf("(row=[column_position=%d, column_name=%s]) already exists", i, name)
+		}
+		cols[name] = struct{}{}
+		normalized[i] = &column.Schema{
+			Type:     colSchema.Type,
+			Name:     name,
+			Default:  colSchema.Default,
+			Size:     colSchema.Size,
+			Nullable: colSchema.Nullable,
 		}
-		cols[colSchema.Name] = struct{}{}
 		rowSize += colSchema.PayloadSize()
 	}
 
 	return &Schema{
 		rowSize:       rowSize,
-		columnSchemas: columnSchemas,
+		columnSchemas: normalized,
 	}, nil
 }
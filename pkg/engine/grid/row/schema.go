@@ -4,6 +4,7 @@ import (
 	"github.com/pkg/errors"
 
 	"ktdb/pkg/engine/grid/column"
+	"ktdb/pkg/engine/identifier"
 	"ktdb/pkg/sys"
 )
 
@@ -42,11 +43,18 @@ func (s *Schema) Load(payload []byte) error {
 		return errors.Wrap(err, "loading row size failed")
 	}
 
+	cols := make(map[string]struct{}, totalColumnPayloads)
 	for i := range totalColumnPayloads {
 		colSchema := &column.Schema{}
 		if err := colSchema.Load(columnPayloads[i+1]); err != nil {
 			return errors.Errorf("(row=[column_position=%d]) loading column schema", i)
 		}
+		// Schemas stored before the names were normalized may hold names that are not folded
+		colSchema.Name = identifier.Fold(colSchema.Name)
+		if _, found := cols[colSchema.Name]; found {
+			return errors.Errorf("(row=[column_position=%d, column_name=%s]) already exists", i, colSchema.Name)
+		}
+		cols[colSchema.Name] = struct{}{}
 		s.columnSchemas[i] = colSchema
 	}
 
@@ -94,6 +102,16 @@ func (s *Schema) Columns(processor column.Processor, row Row) ([]column.Column,
 	return res, nil
 }
 
+// ColumnSchemas returns copies of the column schemas in the order of the columns of the rows.
+func (s *Schema) ColumnSchemas() []*column.Schema {
+	res := make([]*column.Schema, len(s.columnSchemas))
+	for i, colSchema := range s.columnSchemas {
+		copied := *colSchema
+		res[i] = &copied
+	}
+	return res
+}
+
 func (s *Schema) ByteSize() int64 {
 	return s.rowSize
 }
@@ -0,0 +1,86 @@
+package identifier
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaxLength is the maximum length of an identifier in bytes.
+const MaxLength = 63
+
+type Kind string
+
+const (
+	KindDatabase Kind = "database"
+	KindSchema   Kind = "schema"
+	KindTable    Kind = "table"
+	KindColumn   Kind = "column"
+)
+
+// ErrInvalid is matched by every *Error through errors.Is.
+var ErrInvalid = errors.New("invalid identifier")
+
+// reserved holds the names that cannot be used as identifiers, either because they are SQL keywords or because
+// they are reserved by the file systems the databases are stored on.
+var reserved = map[string]struct{}{
+	"select": {}, "from": {}, "where": {}, "and": {}, "or": {}, "not": {}, "null": {}, "as": {},
+	"create": {}, "drop": {}, "alter": {}, "insert": {}, "update": {}, "delete": {}, "table": {}, "vacuum": {},
+	"con": {}, "prn": {}, "aux": {}, "nul": {},
+	"com1": {}, "com2": {}, "com3": {}, "com4": {}, "com5": {}, "com6": {}, "com7": {}, "com8": {}, "com9": {},
+	"lpt1": {}, "lpt2": {}, "lpt3": {}, "lpt4": {}, "lpt5": {}, "lpt6": {}, "lpt7": {}, "lpt8": {}, "lpt9": {},
+}
+
+// Error describes why a name is not a valid identifier.
+type Error struct {
+	Kind   Kind
+	Name   string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("(%s=[name=%q]) %s, %s", e.Kind, e.Name, ErrInvalid, e.Reason)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+// Fold returns the case folded form of the name, identifiers are case-insensitive and always stored folded.
+func Fold(name string) string {
+	return strings.ToLower(name)
+}
+
+// Normalize validates the name and returns its folded form.
+func Normalize(kind Kind, name string) (string, error) {
+	folded := Fold(name)
+	if err := validate(kind, folded); err != nil {
+		err.Name = name
+		return "", err
+	}
+	return folded, nil
+}
+
+// validate checks that the folded name starts with a letter or an underscore, is followed only by letters, digits
+// and underscores of the ASCII range and is not reserved.
+func validate(kind Kind, name string) *Error {
+	if name == "" {
+		return &Error{Kind: kind, Reason: "cannot be empty"}
+	}
+	if len(name) > MaxLength {
+		return &Error{Kind: kind, Reason: fmt.Sprintf("exceeds maximum length [length=%d, max_length=%d]", len(name), MaxLength)}
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c == '_':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return &Error{Kind: kind, Reason: fmt.Sprintf("unsupported character %q at [position=%d]", c, i)}
+		}
+	}
+	if _, found := reserved[name]; found {
+		return &Error{Kind: kind, Reason: "is a reserved name"}
+	}
+	return nil
+}
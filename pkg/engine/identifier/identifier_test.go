@@ -0,0 +1,44 @@
+package identifier_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"ktdb/pkg/engine/identifier"
+)
+
+func TestNormalize(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		for given, expected := range map[string]string{
+			"users":       "users",
+			"Users":       "users",
+			"_tmp":        "_tmp",
+			"user_roles2": "user_roles2",
+		} {
+			res, err := identifier.Normalize(identifier.KindTable, given)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, res)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		for given, expectedErr := range map[string]string{
+			"":                      `(table=[name=""]) invalid identifier, cannot be empty`,
+			"../../etc":             `(table=[name="../../etc"]) invalid identifier, unsupported character '.' at [position=0]`,
+			"a/b":                   `(table=[name="a/b"]) invalid identifier, unsupported character '/' at [position=1]`,
+			"1users":                `(table=[name="1users"]) invalid identifier, unsupported character '1' at [position=0]`,
+			"usérs":                 `(table=[name="usérs"]) invalid identifier, unsupported character 'é' at [position=2]`,
+			"Select":                `(table=[name="Select"]) invalid identifier, is a reserved name`,
+			"NUL":                   `(table=[name="NUL"]) invalid identifier, is a reserved name`,
+			"Vacuum":                `(table=[name="Vacuum"]) invalid identifier, is a reserved name`,
+			strings.Repeat("a", 64): `(table=[name="` + strings.Repeat("a", 64) + `"]) invalid identifier, exceeds maximum length [length=64, max_length=63]`,
+		} {
+			res, err := identifier.Normalize(identifier.KindTable, given)
+			assert.EqualError(t, err, expectedErr)
+			assert.ErrorIs(t, err, identifier.ErrInvalid)
+			assert.Empty(t, res)
+		}
+	})
+}
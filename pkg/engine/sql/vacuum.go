@@ -0,0 +1,51 @@
+package sql
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/parser"
+	"ktdb/pkg/engine/parser/tokenizer"
+)
+
+func NewVacuumParser() parser.StatementParser {
+	return &vacuumParser{}
+}
+
+// vacuumStatement compacts the table, or all tables if it has none. Like the other statements it is only parsed,
+// running it is left to the caller, which compacts the tables with structure.Table.Vacuum.
+type vacuumStatement struct {
+	Table *parser.Table
+}
+
+func (s *vacuumStatement) Json() (string, error) {
+	res, err := json.Marshal(s)
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate json for statement")
+	}
+	return string(res), nil
+}
+
+type vacuumParser struct {
+}
+
+func (s *vacuumParser) Is(tokens tokenizer.Tokens) bool {
+	return tokens.PopIf(tokenizer.CondGroup(tokenizer.IsType(tokenizer.TokenKeyword), tokenizer.Is("VACUUM", false))) != nil
+}
+
+func (s *vacuumParser) Parse(tokens tokenizer.Tokens) (parser.Statement, error) {
+	stmt := &vacuumStatement{}
+	if tokens.HasNext() {
+		var err error
+		stmt.Table, err = parseTable(tokens)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse query table")
+		}
+
+		if tokens.HasNext() {
+			return nil, errors.Errorf("unexpected symbol (%s)", tokens.Next().Value)
+		}
+	}
+	return stmt, nil
+}
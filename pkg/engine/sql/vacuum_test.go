@@ -0,0 +1,72 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"ktdb/pkg/engine/parser"
+	"ktdb/pkg/engine/parser/tokenizer"
+)
+
+func TestVacuumParser(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		t.Run("is vacuum", func(t *testing.T) {
+			tokens := &tokensMock{}
+			tokens.On("PopIf", mock.Anything).Once().Return(&tokenizer.Token{Value: "VACUUM"})
+
+			assert.True(t, NewVacuumParser().Is(tokens))
+		})
+		t.Run("is not vacuum", func(t *testing.T) {
+			tokens := &tokensMock{}
+			var ret *tokenizer.Token
+			tokens.On("PopIf", mock.Anything).Once().Return(ret)
+
+			assert.False(t, NewVacuumParser().Is(tokens))
+		})
+		t.Run("with table", func(t *testing.T) {
+			tokens := &tokensMock{}
+			tokens.On("HasNext").Once().Return(true)
+			tokens.On("PopIf", mock.Anything).Once().Return(&tokenizer.Token{Value: "users"})
+			tokens.On("HasNext").Once().Return(false)
+
+			res, err := NewVacuumParser().Parse(tokens)
+			assert.NoError(t, err)
+			assert.Equal(t, &vacuumStatement{Table: &parser.Table{Name: "users"}}, res)
+		})
+		t.Run("with no table", func(t *testing.T) {
+			tokens := &tokensMock{}
+			tokens.On("HasNext").Once().Return(false)
+
+			res, err := NewVacuumParser().Parse(tokens)
+			assert.NoError(t, err)
+			assert.Equal(t, &vacuumStatement{}, res)
+		})
+	})
+	t.Run("fail", func(t *testing.T) {
+		t.Run("invalid table name", func(t *testing.T) {
+			tokens := &tokensMock{}
+			tokens.On("HasNext").Once().Return(true)
+			var ret *tokenizer.Token
+			tokens.On("PopIf", mock.Anything).Once().Return(ret)
+			tokens.On("HasNext").Once().Return(true)
+			tokens.On("Next").Once().Return(&tokenizer.Token{Value: ","})
+
+			res, err := NewVacuumParser().Parse(tokens)
+			assert.EqualError(t, err, "could not parse query table: invalid table name (,)")
+			assert.Nil(t, res)
+		})
+		t.Run("unexpected symbol after table", func(t *testing.T) {
+			tokens := &tokensMock{}
+			tokens.On("HasNext").Once().Return(true)
+			tokens.On("PopIf", mock.Anything).Once().Return(&tokenizer.Token{Value: "users"})
+			tokens.On("HasNext").Once().Return(true)
+			tokens.On("Next").Once().Return(&tokenizer.Token{Value: "orders"})
+
+			res, err := NewVacuumParser().Parse(tokens)
+			assert.EqualError(t, err, "unexpected symbol (orders)")
+			assert.Nil(t, res)
+		})
+	})
+}
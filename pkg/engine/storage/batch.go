@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Batch collects writes to a single file that are applied together by Writer.WriteBatch, in the order they were added.
+type Batch struct {
+	writes []batchWrite
+}
+
+type batchWrite struct {
+	// offset is ignored for appends
+	offset int64
+	append bool
+	data   []byte
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Offset adds a write of the data at the given offset of the file.
+func (b *Batch) Offset(offset int64, data []byte) *Batch {
+	b.writes = append(b.writes, batchWrite{offset: offset, data: data})
+	return b
+}
+
+// Append adds a write of the data at the end of the file, as it is after all writes added before.
+func (b *Batch) Append(data []byte) *Batch {
+	b.writes = append(b.writes, batchWrite{append: true, data: data})
+	return b
+}
+
+func (b *Batch) Len() int {
+	return len(b.writes)
+}
+
+// Size returns the number of bytes written by the batch.
+func (b *Batch) Size() int64 {
+	size := int64(0)
+	for _, write := range b.writes {
+		size += int64(len(write.data))
+	}
+	return size
+}
+
+// resolve returns the writes of the batch at their offsets in a file of the given size, consecutive writes that
+// continue where the previous one ended are coalesced into a single write.
+func (b *Batch) resolve(size int64) ([]batchWrite, error) {
+	res := make([]batchWrite, 0, len(b.writes))
+	for i, write := range b.writes {
+		offset := write.offset
+		if write.append {
+			offset = size
+		}
+		if offset < 0 {
+			return nil, errors.Errorf("invalid batch write offset [index=%d, offset=%d]", i, offset)
+		}
+		size = max(size, offset+int64(len(write.data)))
+
+		if last := len(res) - 1; last >= 0 && res[last].offset+int64(len(res[last].data)) == offset {
+			res[last].data = append(res[last].data, write.data...)
+			continue
+		}
+		res = append(res, batchWrite{offset: offset, data: append([]byte{}, write.data...)})
+	}
+	return res, nil
+}
+
+// apply returns a copy of the data with the writes of the batch applied to it.
+func (b *Batch) apply(data []byte) ([]byte, error) {
+	writes, err := b.resolve(int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	res := append([]byte{}, data...)
+	for _, write := range writes {
+		if end := write.offset + int64(len(write.data)); end > int64(len(res)) {
+			res = append(res, make([]byte, end-int64(len(res)))...)
+		}
+		copy(res[write.offset:], write.data)
+	}
+	return res, nil
+}
+
+// writeBatch applies the batch through the single writes of the storage, or by atomically replacing the whole file
+// if the writes are requested to be atomic.
+func writeBatch(s Storage, filename string, batch *Batch, opts []WriteOption) error {
+	if newWriteOptions(opts).atomic {
+		current, err := s.ReadAll(filename)
+		if err != nil {
+			return errors.Wrap(err, "could not read file")
+		}
+		data, err := batch.apply(current)
+		if err != nil {
+			return err
+		}
+		return s.CreateOrOverride(filename, data)
+	}
+
+	info, err := s.Info(filename)
+	if err != nil {
+		return errors.Wrap(err, "could not read file info")
+	}
+	writes, err := batch.resolve(info.Size())
+	if err != nil {
+		return err
+	}
+	for i, write := range writes {
+		writeOpts := opts
+		if i != len(writes)-1 {
+			writeOpts = nil // syncing once after the last write is enough
+		}
+		if err := s.Offset(filename, write.offset, write.data, writeOpts...); err != nil {
+			return errors.Wrapf(err, "could not write at offset [offset=%d]", write.offset)
+		}
+	}
+	return nil
+}
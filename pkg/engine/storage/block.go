@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// blockCodec transforms fixed-size blocks of plain data into their stored form and back.
+// The stored form of a block is always exactly overhead bytes larger than the plain block. The stored files start
+// with a header of headerSize bytes written when the file is created, it is passed to encode and decode. The last
+// block of a file is encoded as final, it is encoded again once the file grows past it.
+type blockCodec interface {
+	overhead() int64
+	headerSize() int64
+	newHeader() ([]byte, error)
+	// checkHeader returns an error if the header is not valid, it is reported as a corruption of the file.
+	checkHeader(header []byte) error
+	encode(header []byte, index int64, final bool, plain []byte) ([]byte, error)
+	// decode returns an error if the stored block is not valid, it is reported as a corruption of the block.
+	decode(header []byte, index int64, final bool, stored []byte) ([]byte, error)
+}
+
+// newBlockStorage returns a Storage that splits the files of the given storage into independently stored blocks of
+// blockSize plain bytes, the blocks are transformed by the codec while preserving random access to the files.
+func newBlockStorage(storage Storage, blockSize int64, codec blockCodec) (Storage, error) {
+	if blockSize < 1 {
+		return nil, errors.Errorf("invalid block size [size=%d]", blockSize)
+	}
+	return &blockStorage{
+		storage:   storage,
+		blockSize: blockSize,
+		codec:     codec,
+	}, nil
+}
+
+type blockStorage struct {
+	storage   Storage
+	blockSize int64
+	codec     blockCodec
+}
+
+func (b *blockStorage) NewLayer(path string) (Storage, error) {
+	layer, err := b.storage.NewLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockStorage(layer, b.blockSize, b.codec)
+}
+
+func (b *blockStorage) RemoveLayer(path string) error {
+	return b.storage.RemoveLayer(path)
+}
+
+func (b *blockStorage) Path() string {
+	return b.storage.Path()
+}
+
+func (b *blockStorage) isReadOnly() bool {
+	return IsReadOnly(b.storage)
+}
+
+func (b *blockStorage) Close() error {
+	return b.storage.Close()
+}
+
+func (b *blockStorage) Lock(mode LockMode) (FileLock, error) {
+	return b.storage.Lock(mode)
+}
+
+func (b *blockStorage) Info(filename string) (os.FileInfo, error) {
+	info, err := b.storage.Info(filename)
+	if err != nil {
+		return nil, err
+	}
+	size, err := b.plainSize(filename, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return &sizedFileInfo{FileInfo: info, size: size}, nil
+}
+
+func (b *blockStorage) Exists(name string) (bool, error) {
+	return b.storage.Exists(name)
+}
+
+func (b *blockStorage) ReadAll(filename string) ([]byte, error) {
+	stored, err := b.storage.ReadAll(filename)
+	if err != nil {
+		return nil, err
+	}
+	size, err := b.plainSize(filename, int64(len(stored)))
+	if err != nil {
+		return nil, err
+	}
+	header := stored[:b.codec.headerSize()]
+	if err := b.checkHeader(filename, header); err != nil {
+		return nil, err
+	}
+	return b.decode(filename, header, 0, b.lastBlock(size), stored[b.codec.headerSize():])
+}
+
+func (b *blockStorage) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	size, err := b.size(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file size", b.errorDescriptor(filename))
+	}
+	header, err := b.header(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file header", b.errorDescriptor(filename))
+	}
+
+	res := make([][]byte, len(partials))
+	for i, partial := range partials {
+		if partial.OffsetFrom < 0 || partial.OffsetTo > size {
+			return nil, errors.Wrapf(io.EOF, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", b.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+		res[i], err = b.read(filename, header, size, partial.OffsetFrom, partial.OffsetTo)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", b.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+	}
+	return res, nil
+}
+
+func (b *blockStorage) ReadAfter(filename string, offset int64) ([]byte, error) {
+	size, err := b.size(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file size", b.errorDescriptor(filename))
+	}
+	header, err := b.header(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file header", b.errorDescriptor(filename))
+	}
+
+	res, err := b.read(filename, header, size, min(offset, size), size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file data from offset [offset=%d]", b.errorDescriptor(filename), offset)
+	}
+	return res, nil
+}
+
+func (b *blockStorage) ReadBefore(filename string, offset int64) ([]byte, error) {
+	size, err := b.size(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file size", b.errorDescriptor(filename))
+	}
+	if offset > 0 && size == 0 {
+		return nil, errors.Wrapf(io.EOF, "%s could not read data to offset [offset=%d]", b.errorDescriptor(filename), offset)
+	}
+	header, err := b.header(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file header", b.errorDescriptor(filename))
+	}
+
+	data, err := b.read(filename, header, size, 0, min(offset, size))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read data to offset [offset=%d]", b.errorDescriptor(filename), offset)
+	}
+	res := make([]byte, offset)
+	copy(res, data)
+	return res, nil
+}
+
+func (b *blockStorage) List(filters ...FileFilter) ([]string, error) {
+	return b.storage.List(filters...)
+}
+
+func (b *blockStorage) CreateOrOverride(filename string, data []byte) error {
+	header, err := b.codec.newHeader()
+	if err != nil {
+		return errors.Wrapf(err, "%s could not create file header", b.errorDescriptor(filename))
+	}
+	stored, err := b.encode(header, 0, b.lastBlock(int64(len(data))), data)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not encode file", b.errorDescriptor(filename))
+	}
+	return b.storage.CreateOrOverride(filename, append(header, stored...))
+}
+
+func (b *blockStorage) Append(filename string, data []byte, opts ...WriteOption) error {
+	size, err := b.size(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file size", b.errorDescriptor(filename))
+	}
+	header, err := b.header(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file header", b.errorDescriptor(filename))
+	}
+	return b.write(filename, header, size, size, data, opts)
+}
+
+func (b *blockStorage) Offset(filename string, offset int64, data []byte, opts ...WriteOption) error {
+	if offset < 0 {
+		return errors.Errorf("%s could not write to file at offset [offset=%d]", b.errorDescriptor(filename), offset)
+	}
+	size, err := b.size(filename)
+	var corruption *CorruptionError
+	if errors.As(err, &corruption) && newWriteOptions(opts).overwrite {
+		size, err = b.tornSize(filename)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file size", b.errorDescriptor(filename))
+	}
+	header, err := b.header(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file header", b.errorDescriptor(filename))
+	}
+	return b.write(filename, header, size, offset, data, opts)
+}
+
+func (b *blockStorage) Replace(filename string, partial *Partial, data []byte) error {
+	current, err := b.ReadAll(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file", b.errorDescriptor(filename))
+	}
+	return b.CreateOrOverride(filename, replacePartial(current, partial, data))
+}
+
+func (b *blockStorage) WriteBatch(filename string, batch *Batch, opts ...WriteOption) error {
+	if err := writeBatch(b, filename, batch, opts); err != nil {
+		return errors.Wrapf(err, "%s could not write batch", b.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (b *blockStorage) Delete(filename string) error {
+	return b.storage.Delete(filename)
+}
+
+func (b *blockStorage) Rename(from string, to string) error {
+	return b.storage.Rename(from, to)
+}
+
+func (b *blockStorage) Sync(filename string) error {
+	return b.storage.Sync(filename)
+}
+
+// read returns the plain data between the offsets, decoding only the blocks that hold it.
+func (b *blockStorage) read(filename string, header []byte, size int64, from int64, to int64) ([]byte, error) {
+	if from >= to {
+		return []byte{}, nil
+	}
+
+	firstBlock, lastBlock := from/b.blockSize, (to-1)/b.blockSize
+	plain, err := b.readBlocks(filename, header, size, firstBlock, lastBlock)
+	if err != nil {
+		return nil, err
+	}
+	start := from - firstBlock*b.blockSize
+	return plain[start : start+to-from], nil
+}
+
+// write writes the data at offset by re-encoding every block it touches, the gap between the end of the file and
+// the offset is filled with zeros. With WithOverwrite the blocks are not read, so that torn blocks can be replaced.
+func (b *blockStorage) write(filename string, header []byte, size int64, offset int64, data []byte, opts []WriteOption) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	end := offset + int64(len(data))
+	firstBlock, lastBlock := min(offset, size)/b.blockSize, (end-1)/b.blockSize
+	if end > size && size > 0 {
+		// The previous last block is no longer the last one, it is encoded again
+		firstBlock = min(firstBlock, b.lastBlock(size))
+	}
+	blocksStart := firstBlock * b.blockSize
+
+	plain := make([]byte, min(max(size, end), (lastBlock+1)*b.blockSize)-blocksStart)
+	readTo := min(lastBlock, b.lastBlock(size))
+	if newWriteOptions(opts).overwrite {
+		readTo = min(readTo, offset/b.blockSize-1) // Only the blocks before the data
+	}
+	if blocksStart < size && readTo >= firstBlock {
+		existing, err := b.readBlocks(filename, header, size, firstBlock, readTo)
+		if err != nil {
+			return errors.Wrapf(err, "%s could not read blocks", b.errorDescriptor(filename))
+		}
+		copy(plain, existing)
+	}
+	copy(plain[offset-blocksStart:], data)
+
+	stored, err := b.encode(header, firstBlock, b.lastBlock(max(size, end)), plain)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not encode blocks", b.errorDescriptor(filename))
+	}
+	if err := b.storage.Offset(filename, b.storedOffset(firstBlock), stored, opts...); err != nil {
+		return errors.Wrapf(err, "%s could not write blocks", b.errorDescriptor(filename))
+	}
+	return nil
+}
+
+// readBlocks returns the plain data of the blocks between the given indexes inclusive.
+func (b *blockStorage) readBlocks(filename string, header []byte, size int64, firstBlock int64, lastBlock int64) ([]byte, error) {
+	storedSize := b.storedSize(size)
+	stored, err := b.storage.ReadPartials(filename, []*Partial{{
+		OffsetFrom: b.storedOffset(firstBlock),
+		OffsetTo:   min(b.storedOffset(lastBlock+1), storedSize),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return b.decode(filename, header, firstBlock, b.lastBlock(size), stored[0])
+}
+
+// header returns the verified header of the file, it is empty for codecs without a header.
+func (b *blockStorage) header(filename string) ([]byte, error) {
+	if b.codec.headerSize() == 0 {
+		return nil, nil
+	}
+	stored, err := b.storage.ReadPartials(filename, []*Partial{{OffsetFrom: 0, OffsetTo: b.codec.headerSize()}})
+	if err != nil {
+		return nil, err
+	}
+	if err := b.checkHeader(filename, stored[0]); err != nil {
+		return nil, err
+	}
+	return stored[0], nil
+}
+
+func (b *blockStorage) checkHeader(filename string, header []byte) error {
+	if err := b.codec.checkHeader(header); err != nil {
+		return &CorruptionError{
+			Path:     b.storage.Path(),
+			Filename: filename,
+			Err:      err,
+		}
+	}
+	return nil
+}
+
+// encode encodes the plain data into consecutive blocks starting from the block with the given index, the block with
+// the index of the last block of the file is encoded as final.
+func (b *blockStorage) encode(header []byte, firstBlock int64, lastBlock int64, plain []byte) ([]byte, error) {
+	blocks := (int64(len(plain)) + b.blockSize - 1) / b.blockSize
+	res := make([]byte, 0, int64(len(plain))+blocks*b.codec.overhead())
+	for i := int64(0); i < blocks; i++ {
+		block := plain[i*b.blockSize : min((i+1)*b.blockSize, int64(len(plain)))]
+		stored, err := b.codec.encode(header, firstBlock+i, firstBlock+i == lastBlock, block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not encode block [index=%d]", firstBlock+i)
+		}
+		res = append(res, stored...)
+	}
+	return res, nil
+}
+
+// decode decodes consecutive stored blocks starting from the block with the given index, the block with the index of
+// the last block of the file must be encoded as final.
+func (b *blockStorage) decode(filename string, header []byte, firstBlock int64, lastBlock int64, stored []byte) ([]byte, error) {
+	storedBlockSize := b.storedBlockSize()
+	blocks := (int64(len(stored)) + storedBlockSize - 1) / storedBlockSize
+	res := make([]byte, 0, int64(len(stored))-blocks*b.codec.overhead())
+	for i := int64(0); i < blocks; i++ {
+		block := stored[i*storedBlockSize : min((i+1)*storedBlockSize, int64(len(stored)))]
+		plain, err := b.codec.decode(header, firstBlock+i, firstBlock+i == lastBlock, block)
+		if err != nil {
+			return nil, &CorruptionError{
+				Path:     b.storage.Path(),
+				Filename: filename,
+				Offset:   (firstBlock + i) * b.blockSize,
+				Err:      err,
+			}
+		}
+		res = append(res, plain...)
+	}
+	return res, nil
+}
+
+func (b *blockStorage) size(filename string) (int64, error) {
+	info, err := b.storage.Info(filename)
+	if err != nil {
+		return 0, err
+	}
+	return b.plainSize(filename, info.Size())
+}
+
+// plainSize returns the size of the plain data of a file with the given stored size.
+func (b *blockStorage) plainSize(filename string, storedSize int64) (int64, error) {
+	if storedSize < b.codec.headerSize() {
+		return 0, &CorruptionError{
+			Path:     b.storage.Path(),
+			Filename: filename,
+			Err:      errors.Errorf("truncated header [size=%d]", storedSize),
+		}
+	}
+	storedSize -= b.codec.headerSize()
+	blocks, rest := storedSize/b.storedBlockSize(), storedSize%b.storedBlockSize()
+	if rest != 0 && rest <= b.codec.overhead() {
+		return 0, &CorruptionError{
+			Path:     b.storage.Path(),
+			Filename: filename,
+			Offset:   blocks * b.blockSize,
+			Err:      errors.Errorf("truncated block [size=%d]", rest),
+		}
+	}
+	if rest != 0 {
+		rest -= b.codec.overhead()
+	}
+	return blocks*b.blockSize + rest, nil
+}
+
+// tornSize returns the plain size of a file whose last block was torn too short to hold the overhead of a block, the
+// block is counted with a single byte so that overwriting it replaces all of its stored bytes.
+func (b *blockStorage) tornSize(filename string) (int64, error) {
+	info, err := b.storage.Info(filename)
+	if err != nil {
+		return 0, err
+	}
+	storedSize := max(info.Size()-b.codec.headerSize(), 0)
+	blocks, rest := storedSize/b.storedBlockSize(), storedSize%b.storedBlockSize()
+	return blocks*b.blockSize + min(rest, 1), nil
+}
+
+// storedSize returns the stored size of a file with the given plain size.
+func (b *blockStorage) storedSize(size int64) int64 {
+	blocks, rest := size/b.blockSize, size%b.blockSize
+	if rest != 0 {
+		rest += b.codec.overhead()
+	}
+	return b.codec.headerSize() + blocks*b.storedBlockSize() + rest
+}
+
+// lastBlock returns the index of the last block of a file with the given plain size, it is -1 for an empty file.
+func (b *blockStorage) lastBlock(size int64) int64 {
+	if size == 0 {
+		return -1
+	}
+	return (size - 1) / b.blockSize
+}
+
+// storedOffset returns the offset of the stored block with the given index.
+func (b *blockStorage) storedOffset(index int64) int64 {
+	return b.codec.headerSize() + index*b.storedBlockSize()
+}
+
+func (b *blockStorage) storedBlockSize() int64 {
+	return b.blockSize + b.codec.overhead()
+}
+
+func (b *blockStorage) errorDescriptor(filename string) string {
+	return fmt.Sprintf("(file=[filename=%s, path=%s])", filename, b.storage.Path())
+}
+
+// sizedFileInfo reports a size different from the size of the underlying file.
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *sizedFileInfo) Size() int64 {
+	return i.size
+}
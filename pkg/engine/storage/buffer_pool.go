@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BufferPool is a fixed-size cache of file pages shared by all buffered storages created on top of it.
+// Pages are evicted in least recently used order, dirty pages are written back to their storage on eviction or flush.
+type BufferPool struct {
+	mu       sync.Mutex
+	pageSize int64
+	capacity int
+	pages    map[pageKey]*list.Element
+	// lru holds the cached pages, the most recently used page is at the front
+	lru *list.List
+	// sizes holds the known sizes of the files with cached pages
+	sizes map[fileKey]int64
+	stats BufferPoolStats
+}
+
+type BufferPoolStats struct {
+	Hits       int64
+	Misses     int64
+	Evictions  int64
+	WriteBacks int64
+}
+
+type fileKey struct {
+	path     string
+	filename string
+}
+
+type pageKey struct {
+	fileKey
+	index int64
+}
+
+type page struct {
+	key pageKey
+	// owner is the storage the page is read from and written back into
+	owner Storage
+	data  []byte
+	dirty bool
+}
+
+func NewBufferPool(pageSize int64, capacity int) (*BufferPool, error) {
+	if pageSize < 1 {
+		return nil, errors.Errorf("invalid page size [size=%d]", pageSize)
+	}
+	if capacity < 1 {
+		return nil, errors.Errorf("invalid capacity [capacity=%d]", capacity)
+	}
+
+	return &BufferPool{
+		pageSize: pageSize,
+		capacity: capacity,
+		pages:    make(map[pageKey]*list.Element, capacity),
+		lru:      list.New(),
+		sizes:    make(map[fileKey]int64),
+	}, nil
+}
+
+func (p *BufferPool) PageSize() int64 {
+	return p.pageSize
+}
+
+func (p *BufferPool) Stats() BufferPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+// Flush writes all dirty pages back to their storages.
+func (p *BufferPool) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for elem := p.lru.Front(); elem != nil; elem = elem.Next() {
+		if err := p.writeBack(elem.Value.(*page)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// size returns the size of the file, the caller must hold the lock.
+func (p *BufferPool) size(key fileKey, owner Storage) (int64, error) {
+	if size, found := p.sizes[key]; found {
+		return size, nil
+	}
+
+	info, err := owner.Info(key.filename)
+	if err != nil {
+		return 0, err
+	}
+	p.sizes[key] = info.Size()
+	return info.Size(), nil
+}
+
+// page returns the page, loading it from the owner if it is not cached, the caller must hold the lock.
+func (p *BufferPool) page(key pageKey, owner Storage, fileSize int64) (*page, error) {
+	if elem, found := p.pages[key]; found {
+		p.stats.Hits++
+		p.lru.MoveToFront(elem)
+		return elem.Value.(*page), nil
+	}
+	p.stats.Misses++
+
+	partial := &Partial{
+		OffsetFrom: key.index * p.pageSize,
+		OffsetTo:   min((key.index+1)*p.pageSize, fileSize),
+	}
+	data, err := owner.ReadPartials(key.filename, []*Partial{partial})
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not load page", p.pageErrorDescriptor(key))
+	}
+
+	for p.lru.Len() >= p.capacity {
+		if err := p.evict(p.lru.Back()); err != nil {
+			return nil, err
+		}
+	}
+
+	pg := &page{key: key, owner: owner, data: data[0]}
+	p.pages[key] = p.lru.PushFront(pg)
+	return pg, nil
+}
+
+// read copies the cached contents of the partial into dst, the caller must hold the lock.
+func (p *BufferPool) read(key fileKey, owner Storage, fileSize int64, partial *Partial, dst []byte) error {
+	for offset := partial.OffsetFrom; offset < partial.OffsetTo; {
+		pg, err := p.page(pageKey{fileKey: key, index: offset / p.pageSize}, owner, fileSize)
+		if err != nil {
+			return err
+		}
+		pageOffset := offset % p.pageSize
+		n := copy(dst[offset-partial.OffsetFrom:], pg.data[pageOffset:min(int64(len(pg.data)), pageOffset+partial.OffsetTo-offset)])
+		offset += int64(n)
+	}
+	return nil
+}
+
+// write copies data into the cached pages starting at offset and marks them dirty, the caller must hold the lock.
+// The written range must lie within the file.
+func (p *BufferPool) write(key fileKey, owner Storage, fileSize int64, offset int64, data []byte) error {
+	for written := int64(0); written < int64(len(data)); {
+		pg, err := p.page(pageKey{fileKey: key, index: (offset + written) / p.pageSize}, owner, fileSize)
+		if err != nil {
+			return err
+		}
+		n := copy(pg.data[(offset+written)%p.pageSize:], data[written:])
+		pg.dirty = true
+		written += int64(n)
+	}
+	return nil
+}
+
+// flushFile writes the dirty pages of the file back, the caller must hold the lock.
+func (p *BufferPool) flushFile(key fileKey) error {
+	for elem := p.lru.Front(); elem != nil; elem = elem.Next() {
+		if pg := elem.Value.(*page); pg.key.fileKey == key {
+			if err := p.writeBack(pg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flushPath writes the dirty pages of all files of the layer at the given path and the layers below it back,
+// the caller must hold the lock.
+func (p *BufferPool) flushPath(path string) error {
+	prefix := fmt.Sprintf("%s%c", path, filepath.Separator)
+	for elem := p.lru.Front(); elem != nil; elem = elem.Next() {
+		if pg := elem.Value.(*page); pg.key.path == path || strings.HasPrefix(pg.key.path, prefix) {
+			if err := p.writeBack(pg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropFile removes all pages of the file without writing them back, the caller must hold the lock.
+func (p *BufferPool) dropFile(key fileKey) {
+	for elem := p.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if pg := elem.Value.(*page); pg.key.fileKey == key {
+			p.lru.Remove(elem)
+			delete(p.pages, pg.key)
+		}
+		elem = next
+	}
+	delete(p.sizes, key)
+}
+
+// dropPath removes all pages of the files of the layer at the given path and the layers below it without writing
+// them back, the caller must hold the lock.
+func (p *BufferPool) dropPath(path string) {
+	prefix := fmt.Sprintf("%s%c", path, filepath.Separator)
+	for elem := p.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if pg := elem.Value.(*page); pg.key.path == path || strings.HasPrefix(pg.key.path, prefix) {
+			p.lru.Remove(elem)
+			delete(p.pages, pg.key)
+		}
+		elem = next
+	}
+	for key := range p.sizes {
+		if key.path == path || strings.HasPrefix(key.path, prefix) {
+			delete(p.sizes, key)
+		}
+	}
+}
+
+// invalidate writes back and removes the pages of the file that overlap with the range starting at offset,
+// together with the last page of the file since its length is about to change, the caller must hold the lock.
+func (p *BufferPool) invalidate(key fileKey, offset int64, size int64) error {
+	fromIndex, toIndex := offset/p.pageSize, (offset+size)/p.pageSize
+	if fileSize, found := p.sizes[key]; found {
+		fromIndex = min(fromIndex, fileSize/p.pageSize)
+		toIndex = max(toIndex, fileSize/p.pageSize)
+	}
+
+	for index := fromIndex; index <= toIndex; index++ {
+		elem, found := p.pages[pageKey{fileKey: key, index: index}]
+		if !found {
+			continue
+		}
+		if err := p.evict(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict writes the page back if needed and removes it from the pool, the caller must hold the lock.
+func (p *BufferPool) evict(elem *list.Element) error {
+	pg := elem.Value.(*page)
+	if err := p.writeBack(pg); err != nil {
+		return err
+	}
+	p.lru.Remove(elem)
+	delete(p.pages, pg.key)
+	p.stats.Evictions++
+	return nil
+}
+
+// writeBack writes the page back into its owner if dirty, the caller must hold the lock.
+func (p *BufferPool) writeBack(pg *page) error {
+	if !pg.dirty {
+		return nil
+	}
+	if err := pg.owner.Offset(pg.key.filename, pg.key.index*p.pageSize, pg.data); err != nil {
+		return errors.Wrapf(err, "%s could not write back page", p.pageErrorDescriptor(pg.key))
+	}
+	pg.dirty = false
+	p.stats.WriteBacks++
+	return nil
+}
+
+func (p *BufferPool) pageErrorDescriptor(key pageKey) string {
+	return fmt.Sprintf("(page=[filename=%s, path=%s, index=%d])", key.filename, key.path, key.index)
+}
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// NewBuffered returns a Storage that reads and writes the files of the given storage through the pages of the pool.
+// Writes within the bounds of a file are buffered until their page is evicted, flushed or the file is synced,
+// all other writes go straight to the underlying storage. All access to the underlying files must go through the pool.
+func NewBuffered(storage Storage, pool *BufferPool) Storage {
+	return &buffered{
+		storage: storage,
+		pool:    pool,
+	}
+}
+
+type buffered struct {
+	storage Storage
+	pool    *BufferPool
+}
+
+func (b *buffered) NewLayer(path string) (Storage, error) {
+	layer, err := b.storage.NewLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewBuffered(layer, b.pool), nil
+}
+
+func (b *buffered) RemoveLayer(path string) error {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	b.pool.dropPath(b.layerPath(path))
+	return b.storage.RemoveLayer(path)
+}
+
+func (b *buffered) Path() string {
+	return b.storage.Path()
+}
+
+func (b *buffered) isReadOnly() bool {
+	return IsReadOnly(b.storage)
+}
+
+func (b *buffered) Close() error {
+	b.pool.mu.Lock()
+	err := b.pool.flushPath(b.storage.Path())
+	b.pool.mu.Unlock()
+	if err != nil {
+		return errors.Wrapf(err, "%s could not flush pages", b.errorDescriptor(""))
+	}
+	return b.storage.Close()
+}
+
+func (b *buffered) Lock(mode LockMode) (FileLock, error) {
+	return b.storage.Lock(mode)
+}
+
+func (b *buffered) Info(filename string) (os.FileInfo, error) {
+	return b.storage.Info(filename)
+}
+
+func (b *buffered) Exists(name string) (bool, error) {
+	return b.storage.Exists(name)
+}
+
+func (b *buffered) ReadAll(filename string) ([]byte, error) {
+	if err := b.flush(filename); err != nil {
+		return nil, err
+	}
+	return b.storage.ReadAll(filename)
+}
+
+func (b *buffered) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	key := b.fileKey(filename)
+	size, err := b.pool.size(key, b.storage)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file size", b.errorDescriptor(filename))
+	}
+
+	res := make([][]byte, len(partials))
+	for i, partial := range partials {
+		if partial.OffsetFrom < 0 || partial.OffsetTo > size {
+			return nil, errors.Wrapf(io.EOF, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", b.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+		res[i] = make([]byte, partial.OffsetTo-partial.OffsetFrom)
+		if err := b.pool.read(key, b.storage, size, partial, res[i]); err != nil {
+			return nil, errors.Wrapf(err, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", b.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+	}
+	return res, nil
+}
+
+func (b *buffered) ReadAfter(filename string, offset int64) ([]byte, error) {
+	if err := b.flush(filename); err != nil {
+		return nil, err
+	}
+	return b.storage.ReadAfter(filename, offset)
+}
+
+func (b *buffered) ReadBefore(filename string, offset int64) ([]byte, error) {
+	if err := b.flush(filename); err != nil {
+		return nil, err
+	}
+	return b.storage.ReadBefore(filename, offset)
+}
+
+func (b *buffered) List(filters ...FileFilter) ([]string, error) {
+	return b.storage.List(filters...)
+}
+
+func (b *buffered) CreateOrOverride(filename string, data []byte) error {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	b.pool.dropFile(b.fileKey(filename))
+	return b.storage.CreateOrOverride(filename, data)
+}
+
+func (b *buffered) Append(filename string, data []byte, opts ...WriteOption) error {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	key := b.fileKey(filename)
+	size, err := b.pool.size(key, b.storage)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file size", b.errorDescriptor(filename))
+	}
+	return b.writeThrough(key, size, int64(len(data)), func() error {
+		return b.storage.Append(filename, data, opts...)
+	})
+}
+
+func (b *buffered) Offset(filename string, offset int64, data []byte, opts ...WriteOption) error {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	key := b.fileKey(filename)
+	size, err := b.pool.size(key, b.storage)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file size", b.errorDescriptor(filename))
+	}
+
+	end := offset + int64(len(data))
+	if offset >= 0 && end <= size && !newWriteOptions(opts).sync {
+		if err := b.pool.write(key, b.storage, size, offset, data); err != nil {
+			return errors.Wrapf(err, "%s could not write to file at offset [offset=%d]", b.errorDescriptor(filename), offset)
+		}
+		return nil
+	}
+
+	return b.writeThrough(key, offset, int64(len(data)), func() error {
+		return b.storage.Offset(filename, offset, data, opts...)
+	})
+}
+
+func (b *buffered) Replace(filename string, partial *Partial, data []byte) error {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	key := b.fileKey(filename)
+	if err := b.pool.flushFile(key); err != nil {
+		return errors.Wrapf(err, "%s could not flush file", b.errorDescriptor(filename))
+	}
+	b.pool.dropFile(key)
+	return b.storage.Replace(filename, partial, data)
+}
+
+func (b *buffered) WriteBatch(filename string, batch *Batch, opts ...WriteOption) error {
+	if err := writeBatch(b, filename, batch, opts); err != nil {
+		return errors.Wrapf(err, "%s could not write batch", b.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (b *buffered) Delete(filename string) error {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	b.pool.dropFile(b.fileKey(filename))
+	return b.storage.Delete(filename)
+}
+
+func (b *buffered) Rename(from string, to string) error {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	if err := b.pool.flushFile(b.fileKey(from)); err != nil {
+		return errors.Wrapf(err, "%s could not flush file", b.errorDescriptor(from))
+	}
+	if err := b.pool.flushPath(b.layerPath(from)); err != nil {
+		return errors.Wrapf(err, "%s could not flush layer", b.errorDescriptor(from))
+	}
+	for _, name := range []string{from, to} {
+		b.pool.dropFile(b.fileKey(name))
+		b.pool.dropPath(b.layerPath(name))
+	}
+	return b.storage.Rename(from, to)
+}
+
+func (b *buffered) Sync(filename string) error {
+	if err := b.flush(filename); err != nil {
+		return err
+	}
+	return b.storage.Sync(filename)
+}
+
+// writeThrough applies the write of size bytes at offset straight to the underlying storage, after invalidating
+// the pages it affects, and records the new size of the file. The caller must hold the lock.
+func (b *buffered) writeThrough(key fileKey, offset int64, size int64, write func() error) error {
+	if err := b.pool.invalidate(key, offset, size); err != nil {
+		return errors.Wrapf(err, "%s could not invalidate pages", b.errorDescriptor(key.filename))
+	}
+	if err := write(); err != nil {
+		delete(b.pool.sizes, key)
+		return err
+	}
+	if fileSize, found := b.pool.sizes[key]; found {
+		b.pool.sizes[key] = max(fileSize, offset+size)
+	}
+	return nil
+}
+
+func (b *buffered) flush(filename string) error {
+	b.pool.mu.Lock()
+	defer b.pool.mu.Unlock()
+
+	if err := b.pool.flushFile(b.fileKey(filename)); err != nil {
+		return errors.Wrapf(err, "%s could not flush file", b.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (b *buffered) fileKey(filename string) fileKey {
+	return fileKey{path: b.storage.Path(), filename: filename}
+}
+
+// layerPath returns the path of the layer with the given name below this one.
+func (b *buffered) layerPath(name string) string {
+	return fmt.Sprintf("%s%c%s", b.storage.Path(), filepath.Separator, name)
+}
+
+func (b *buffered) errorDescriptor(filename string) string {
+	if filename == "" {
+		return fmt.Sprintf("(file=[path=%s])", b.storage.Path())
+	}
+	return fmt.Sprintf("(file=[filename=%s, path=%s])", filename, b.storage.Path())
+}
@@ -0,0 +1,76 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestNewBufferPool(t *testing.T) {
+	t.Run("fail - invalid page size", func(t *testing.T) {
+		_, err := storage.NewBufferPool(0, 1)
+		assert.EqualError(t, err, "invalid page size [size=0]")
+	})
+	t.Run("fail - invalid capacity", func(t *testing.T) {
+		_, err := storage.NewBufferPool(1, 0)
+		assert.EqualError(t, err, "invalid capacity [capacity=0]")
+	})
+}
+
+func TestBuffered(t *testing.T) {
+	t.Run("success - repeated reads hit the pool", func(t *testing.T) {
+		pool, err := storage.NewBufferPool(4, 2)
+		require.NoError(t, err)
+		s := storage.NewBuffered(storage.NewMemory(), pool)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("01234567")))
+
+		for range 3 {
+			res, err := s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 2, OffsetTo: 6}})
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("2345")}, res)
+		}
+		assert.Equal(t, storage.BufferPoolStats{Hits: 4, Misses: 2}, pool.Stats())
+	})
+
+	t.Run("success - dirty pages are written back", func(t *testing.T) {
+		pool, err := storage.NewBufferPool(4, 1)
+		require.NoError(t, err)
+		inner := storage.NewMemory()
+		s := storage.NewBuffered(inner, pool)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("01234567")))
+
+		require.NoError(t, s.Offset("data.bin", 1, []byte("ab")))
+		res, err := inner.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("01234567"), res, "write must be buffered")
+
+		require.NoError(t, s.Offset("data.bin", 5, []byte("cd")))
+		res, err = inner.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0ab34567"), res, "eviction must write the page back")
+
+		require.NoError(t, pool.Flush())
+		res, err = inner.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0ab34cd7"), res)
+		assert.Equal(t, int64(2), pool.Stats().WriteBacks)
+	})
+
+	t.Run("success - appends are visible to cached reads", func(t *testing.T) {
+		pool, err := storage.NewBufferPool(4, 2)
+		require.NoError(t, err)
+		s := storage.NewBuffered(storage.NewMemory(), pool)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("012")))
+
+		_, err = s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 0, OffsetTo: 3}})
+		require.NoError(t, err)
+		require.NoError(t, s.Append("data.bin", []byte("345")))
+
+		res, err := s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 0, OffsetTo: 6}})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("012345")}, res)
+	})
+}
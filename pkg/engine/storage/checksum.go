@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+const checksumSize = 4
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// NewChecksummed returns a Storage that stores a CRC32C checksum with every block of blockSize bytes of its files
+// and verifies it whenever the block is read, a mismatch is reported as a *CorruptionError.
+func NewChecksummed(storage Storage, blockSize int64) (Storage, error) {
+	return newBlockStorage(storage, blockSize, checksumCodec{})
+}
+
+type checksumCodec struct{}
+
+func (c checksumCodec) overhead() int64 {
+	return checksumSize
+}
+
+func (c checksumCodec) headerSize() int64 {
+	return 0
+}
+
+func (c checksumCodec) newHeader() ([]byte, error) {
+	return nil, nil
+}
+
+func (c checksumCodec) checkHeader(_ []byte) error {
+	return nil
+}
+
+func (c checksumCodec) encode(_ []byte, _ int64, _ bool, plain []byte) ([]byte, error) {
+	res := make([]byte, len(plain)+checksumSize)
+	copy(res, plain)
+	binary.LittleEndian.PutUint32(res[len(plain):], crc32.Checksum(plain, checksumTable))
+	return res, nil
+}
+
+func (c checksumCodec) decode(_ []byte, _ int64, _ bool, stored []byte) ([]byte, error) {
+	if len(stored) < checksumSize {
+		return nil, errors.Errorf("truncated block [size=%d]", len(stored))
+	}
+	plain, checksum := stored[:len(stored)-checksumSize], stored[len(stored)-checksumSize:]
+	if expected, actual := binary.LittleEndian.Uint32(checksum), crc32.Checksum(plain, checksumTable); expected != actual {
+		return nil, errors.Errorf("checksum mismatch [expected=%08x, actual=%08x]", expected, actual)
+	}
+	return plain, nil
+}
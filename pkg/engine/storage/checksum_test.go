@@ -0,0 +1,89 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestChecksummed(t *testing.T) {
+	t.Run("success - blocks are stored with checksums", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewChecksummed(inner, 4)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123456789")))
+
+		info, err := inner.Info("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10+3*4), info.Size())
+
+		info, err = s.Info("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10), info.Size())
+	})
+
+	t.Run("fail - corrupted block", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewChecksummed(inner, 4)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123456789")))
+		require.NoError(t, inner.Offset("data.bin", 9, []byte{0xFF})) // Flips the second byte of the second block
+
+		res, err := s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 0, OffsetTo: 4}})
+		assert.NoError(t, err, "blocks other than the corrupted one must stay readable")
+		assert.Equal(t, [][]byte{[]byte("0123")}, res)
+
+		_, err = s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 2, OffsetTo: 6}})
+		var corruption *storage.CorruptionError
+		require.True(t, errors.As(err, &corruption))
+		assert.Equal(t, "data.bin", corruption.Filename)
+		assert.Equal(t, int64(4), corruption.Offset)
+
+		_, err = s.ReadAll("data.bin")
+		assert.True(t, errors.As(err, &corruption))
+	})
+
+	t.Run("success - overwrite replaces a torn block", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewChecksummed(inner, 4)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123456789")))
+		require.NoError(t, inner.Offset("data.bin", 9, []byte{0xFF}))
+
+		var corruption *storage.CorruptionError
+		assert.ErrorAs(t, s.Offset("data.bin", 5, []byte("X")), &corruption)
+		require.NoError(t, s.Offset("data.bin", 4, []byte("4X67"), storage.WithOverwrite()))
+
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("01234X6789"), res)
+	})
+
+	t.Run("success - overwrite replaces a block torn too short", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewChecksummed(inner, 4)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123")))
+		require.NoError(t, inner.Append("data.bin", []byte{0x34, 0x35})) // Torn append of the second block
+
+		require.NoError(t, s.Offset("data.bin", 4, []byte("45"), storage.WithOverwrite()))
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("012345"), res)
+	})
+
+	t.Run("fail - truncated block", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewChecksummed(inner, 4)
+		require.NoError(t, err)
+		require.NoError(t, inner.CreateOrOverride("data.bin", []byte{0x00, 0x01}))
+
+		_, err = s.Info("data.bin")
+		var corruption *storage.CorruptionError
+		assert.True(t, errors.As(err, &corruption))
+	})
+}
@@ -0,0 +1,635 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/sys"
+)
+
+const compressedFramesSuffix = ".frames"
+
+// NewCompressed returns a Storage that compresses its files in independently stored blocks of blockSize bytes,
+// so that any part of a file can be read by decompressing only the blocks that hold it.
+//
+// Every file is stored as an index under its own name and a frames file holding the compressed blocks. Rewritten
+// blocks are appended to the frames file, the frames file is compacted into a new generation once most of it is no
+// longer referenced. The indexes are kept in memory by the storage and its layers, they are replaced atomically when
+// the file is synced, written with WithSync or compacted, and when the storage is closed. A crash therefore loses the
+// writes made since, as the frames they reference are never overwritten the file is left as it was last persisted.
+// The calls of the storage and its layers run one at a time, the files must not be written through another storage.
+func NewCompressed(storage Storage, blockSize int64) (Storage, error) {
+	if blockSize < 1 {
+		return nil, errors.Errorf("invalid block size [size=%d]", blockSize)
+	}
+	return &compressed{
+		storage:   storage,
+		blockSize: blockSize,
+		indexes:   &compressedIndexes{indexes: make(map[fileKey]*compressedIndex)},
+	}, nil
+}
+
+type compressed struct {
+	storage   Storage
+	blockSize int64
+	// indexes is shared with the layers
+	indexes *compressedIndexes
+}
+
+// compressedIndexes caches the indexes of the compressed files, its lock is held by every call of the storage.
+type compressedIndexes struct {
+	mu      sync.Mutex
+	indexes map[fileKey]*compressedIndex
+}
+
+// compressedIndex locates the compressed blocks of a file within its frames file.
+type compressedIndex struct {
+	generation int64
+	size       int64
+	frames     []*Partial
+	// live is the number of bytes of the frames file referenced by the index
+	live int64
+	// owner is the storage the index is persisted into
+	owner Storage
+	// dirty is set once the index is changed without being persisted
+	dirty bool
+}
+
+func (i *compressedIndex) Bytes() []byte {
+	frames := make([][]byte, 0, 2*len(i.frames))
+	for _, frame := range i.frames {
+		frames = append(frames, sys.Int64AsBytes(frame.OffsetFrom), sys.Int64AsBytes(frame.OffsetTo))
+	}
+	return sys.ConcatSlices(
+		sys.New(sys.Int64AsBytes(i.generation)),
+		sys.New(sys.Int64AsBytes(i.size)),
+		sys.New(sys.ConcatSlices(frames...)),
+	)
+}
+
+func (i *compressedIndex) Load(payload []byte) error {
+	payloads, err := sys.ReadAll(payload)
+	if err != nil {
+		return errors.Wrap(err, "deserialization failed")
+	}
+	if len(payloads) != 3 { // The payload of the index persists of 3 different sections, one for each field
+		return errors.New("corrupted payload")
+	}
+	if i.generation, err = sys.BytesAsInt64(payloads[0]); err != nil {
+		return errors.Wrap(err, "could not load generation")
+	}
+	if i.size, err = sys.BytesAsInt64(payloads[1]); err != nil {
+		return errors.Wrap(err, "could not load size")
+	}
+
+	frames := payloads[2]
+	if int64(len(frames))%(2*sys.Int64ByteSize) != 0 {
+		return errors.New("could not load frames")
+	}
+	i.frames = make([]*Partial, int64(len(frames))/(2*sys.Int64ByteSize))
+	for n := range i.frames {
+		frame := frames[int64(n)*2*sys.Int64ByteSize:]
+		from, _ := sys.BytesAsInt64(frame[:sys.Int64ByteSize])
+		to, _ := sys.BytesAsInt64(frame[sys.Int64ByteSize : 2*sys.Int64ByteSize])
+		i.frames[n] = &Partial{OffsetFrom: from, OffsetTo: to}
+		i.live += to - from
+	}
+	return nil
+}
+
+// frame points the block at the frame.
+func (i *compressedIndex) frame(block int64, frame *Partial) {
+	if block < int64(len(i.frames)) {
+		i.live -= i.frames[block].OffsetTo - i.frames[block].OffsetFrom
+		i.frames[block] = frame
+	} else {
+		i.frames = append(i.frames, frame)
+	}
+	i.live += frame.OffsetTo - frame.OffsetFrom
+}
+
+func (c *compressed) NewLayer(path string) (Storage, error) {
+	layer, err := c.storage.NewLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return &compressed{storage: layer, blockSize: c.blockSize, indexes: c.indexes}, nil
+}
+
+func (c *compressed) RemoveLayer(path string) error {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	c.dropPath(c.layerPath(path))
+	return c.storage.RemoveLayer(path)
+}
+
+func (c *compressed) Path() string {
+	return c.storage.Path()
+}
+
+func (c *compressed) isReadOnly() bool {
+	return IsReadOnly(c.storage)
+}
+
+func (c *compressed) Close() error {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	for key, index := range c.indexes.indexes {
+		if !isInPath(key, c.storage.Path()) {
+			continue
+		}
+		if err := persistIndex(key.filename, index); err != nil {
+			return errors.Wrapf(err, "(file=[filename=%s, path=%s]) could not persist index", key.filename, key.path)
+		}
+	}
+	return c.storage.Close()
+}
+
+func (c *compressed) Lock(mode LockMode) (FileLock, error) {
+	return c.storage.Lock(mode)
+}
+
+func (c *compressed) Info(filename string) (os.FileInfo, error) {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	info, err := c.storage.Info(filename)
+	if err != nil {
+		return nil, err
+	}
+	index, err := c.index(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedFileInfo{FileInfo: info, size: index.size}, nil
+}
+
+func (c *compressed) Exists(name string) (bool, error) {
+	return c.storage.Exists(name)
+}
+
+func (c *compressed) ReadAll(filename string) ([]byte, error) {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	index, err := c.index(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.read(filename, index, 0, index.size)
+}
+
+func (c *compressed) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	index, err := c.index(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", c.errorDescriptor(filename))
+	}
+
+	res := make([][]byte, len(partials))
+	for i, partial := range partials {
+		if partial.OffsetFrom < 0 || partial.OffsetTo > index.size {
+			return nil, errors.Wrapf(io.EOF, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", c.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+		res[i], err = c.read(filename, index, partial.OffsetFrom, partial.OffsetTo)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", c.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+	}
+	return res, nil
+}
+
+func (c *compressed) ReadAfter(filename string, offset int64) ([]byte, error) {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	index, err := c.index(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", c.errorDescriptor(filename))
+	}
+
+	res, err := c.read(filename, index, min(offset, index.size), index.size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read file data from offset [offset=%d]", c.errorDescriptor(filename), offset)
+	}
+	return res, nil
+}
+
+func (c *compressed) ReadBefore(filename string, offset int64) ([]byte, error) {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	index, err := c.index(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", c.errorDescriptor(filename))
+	}
+	if offset > 0 && index.size == 0 {
+		return nil, errors.Wrapf(io.EOF, "%s could not read data to offset [offset=%d]", c.errorDescriptor(filename), offset)
+	}
+
+	data, err := c.read(filename, index, 0, min(offset, index.size))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read data to offset [offset=%d]", c.errorDescriptor(filename), offset)
+	}
+	res := make([]byte, offset)
+	copy(res, data)
+	return res, nil
+}
+
+func (c *compressed) List(filters ...FileFilter) ([]string, error) {
+	return c.storage.List(append([]FileFilter{isNotCompressedFramesFilter}, filters...)...)
+}
+
+func (c *compressed) CreateOrOverride(filename string, data []byte) error {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	var generation int64
+	if _, err := c.storage.Info(filename); err == nil {
+		index, err := c.index(filename)
+		if err != nil {
+			return errors.Wrapf(err, "%s could not read index", c.errorDescriptor(filename))
+		}
+		generation = index.generation
+	}
+
+	if err := c.rewrite(filename, generation, data); err != nil {
+		return errors.Wrapf(err, "%s could not write file", c.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (c *compressed) Append(filename string, data []byte, opts ...WriteOption) error {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	index, err := c.index(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open file", c.errorDescriptor(filename))
+	}
+	if err := c.write(filename, index, index.size, data, opts); err != nil {
+		return errors.Wrapf(err, "%s could not write to file", c.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (c *compressed) Offset(filename string, offset int64, data []byte, opts ...WriteOption) error {
+	if offset < 0 {
+		return errors.Errorf("%s could not write to file at offset [offset=%d]", c.errorDescriptor(filename), offset)
+	}
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	index, err := c.index(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open file", c.errorDescriptor(filename))
+	}
+	if err := c.write(filename, index, offset, data, opts); err != nil {
+		return errors.Wrapf(err, "%s could not write to file at offset [offset=%d]", c.errorDescriptor(filename), offset)
+	}
+	return nil
+}
+
+func (c *compressed) Replace(filename string, partial *Partial, data []byte) error {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	index, err := c.index(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file", c.errorDescriptor(filename))
+	}
+	current, err := c.read(filename, index, 0, index.size)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file", c.errorDescriptor(filename))
+	}
+	if err := c.rewrite(filename, index.generation, replacePartial(current, partial, data)); err != nil {
+		return errors.Wrapf(err, "%s could not write file", c.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (c *compressed) WriteBatch(filename string, batch *Batch, opts ...WriteOption) error {
+	if err := writeBatch(c, filename, batch, opts); err != nil {
+		return errors.Wrapf(err, "%s could not write batch", c.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (c *compressed) Delete(filename string) error {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	return c.delete(filename)
+}
+
+// Rename moves the index and the frames file of a file separately, unlike the rename of a layer it is therefore
+// not atomic.
+func (c *compressed) Rename(from string, to string) error {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	if layer, err := hasLayer(c.storage, from); err != nil {
+		return err
+	} else if layer {
+		if err := c.persistPath(c.layerPath(from)); err != nil {
+			return errors.Wrapf(err, "%s could not persist indexes", c.errorDescriptor(from))
+		}
+		c.dropPath(c.layerPath(from))
+		c.dropPath(c.layerPath(to))
+		return c.storage.Rename(from, to)
+	}
+
+	index, err := c.index(from)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not rename file", c.errorDescriptor(from))
+	}
+	if err := persistIndex(from, index); err != nil {
+		return errors.Wrapf(err, "%s could not persist index", c.errorDescriptor(from))
+	}
+	if exists, err := c.storage.Exists(to); err != nil {
+		return err
+	} else if exists {
+		if err := c.delete(to); err != nil {
+			return errors.Wrapf(err, "%s could not replace file", c.errorDescriptor(to))
+		}
+	}
+	delete(c.indexes.indexes, c.fileKey(from))
+	if err := c.storage.Rename(compressedFramesFile(from, index.generation), compressedFramesFile(to, index.generation)); err != nil {
+		return errors.Wrapf(err, "%s could not rename frames", c.errorDescriptor(from))
+	}
+	return c.storage.Rename(from, to)
+}
+
+// Sync persists the index of the file and flushes it together with its frames to stable storage.
+func (c *compressed) Sync(filename string) error {
+	c.indexes.mu.Lock()
+	defer c.indexes.mu.Unlock()
+
+	index, err := c.index(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open file", c.errorDescriptor(filename))
+	}
+	if err := c.storage.Sync(compressedFramesFile(filename, index.generation)); err != nil {
+		return errors.Wrapf(err, "%s could not sync frames", c.errorDescriptor(filename))
+	}
+	if err := persistIndex(filename, index); err != nil {
+		return errors.Wrapf(err, "%s could not persist index", c.errorDescriptor(filename))
+	}
+	return c.storage.Sync(filename)
+}
+
+func (c *compressed) delete(filename string) error {
+	index, err := c.index(filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not delete file", c.errorDescriptor(filename))
+	}
+	delete(c.indexes.indexes, c.fileKey(filename))
+	if err := c.storage.Delete(filename); err != nil {
+		return err
+	}
+	if err := c.storage.Delete(compressedFramesFile(filename, index.generation)); err != nil {
+		return errors.Wrapf(err, "%s could not delete frames", c.errorDescriptor(filename))
+	}
+	return nil
+}
+
+// read returns the plain data between the offsets, decompressing only the blocks that hold it.
+func (c *compressed) read(filename string, index *compressedIndex, from int64, to int64) ([]byte, error) {
+	if from >= to {
+		return []byte{}, nil
+	}
+
+	firstBlock, lastBlock := from/c.blockSize, (to-1)/c.blockSize
+	plain, err := c.readBlocks(filename, index, firstBlock, lastBlock)
+	if err != nil {
+		return nil, err
+	}
+	start := from - firstBlock*c.blockSize
+	return plain[start : start+to-from], nil
+}
+
+// write writes the data at offset by appending a new frame for every block it touches, the gap between the end
+// of the file and the offset is filled with zeros. With WithOverwrite the blocks are not read.
+func (c *compressed) write(filename string, index *compressedIndex, offset int64, data []byte, opts []WriteOption) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	options := newWriteOptions(opts)
+	end := offset + int64(len(data))
+	firstBlock, lastBlock := min(offset, index.size)/c.blockSize, (end-1)/c.blockSize
+	blocksStart := firstBlock * c.blockSize
+
+	plain := make([]byte, min(max(index.size, end), (lastBlock+1)*c.blockSize)-blocksStart)
+	if blocksStart < index.size && !options.overwrite {
+		existing, err := c.readBlocks(filename, index, firstBlock, min(lastBlock, int64(len(index.frames))-1))
+		if err != nil {
+			return errors.Wrap(err, "could not read blocks")
+		}
+		copy(plain, existing)
+	}
+	copy(plain[offset-blocksStart:], data)
+
+	framesFile := compressedFramesFile(filename, index.generation)
+	info, err := c.storage.Info(framesFile)
+	if err != nil {
+		return errors.Wrap(err, "could not read frames info")
+	}
+	frames, partials, err := c.compress(plain, info.Size())
+	if err != nil {
+		return errors.Wrap(err, "could not compress blocks")
+	}
+	var appendOpts []WriteOption // The frames are appended, overwriting their blocks would zero the previous frames
+	if options.sync {
+		appendOpts = append(appendOpts, WithSync())
+	}
+	if err := c.storage.Append(framesFile, frames, appendOpts...); err != nil {
+		return errors.Wrap(err, "could not append frames")
+	}
+
+	for i, partial := range partials {
+		index.frame(firstBlock+int64(i), partial)
+	}
+	index.size = max(index.size, end)
+	index.dirty = true
+
+	if info.Size()+int64(len(frames)) > 2*index.live+c.blockSize {
+		current, err := c.read(filename, index, 0, index.size)
+		if err != nil {
+			return errors.Wrap(err, "could not read file for compaction")
+		}
+		return c.rewrite(filename, index.generation, current)
+	}
+	if options.sync {
+		if err := persistIndex(filename, index); err != nil {
+			return errors.Wrap(err, "could not persist index")
+		}
+	}
+	return nil
+}
+
+// rewrite writes the whole file into the frames file of the next generation, swaps the index over to it and
+// removes the frames file of the previous generation.
+func (c *compressed) rewrite(filename string, generation int64, data []byte) error {
+	frames, partials, err := c.compress(data, 0)
+	if err != nil {
+		return errors.Wrap(err, "could not compress blocks")
+	}
+
+	index := &compressedIndex{generation: generation + 1, size: int64(len(data)), owner: c.storage}
+	for i, partial := range partials {
+		index.frame(int64(i), partial)
+	}
+	if err := c.storage.CreateOrOverride(compressedFramesFile(filename, index.generation), frames); err != nil {
+		return errors.Wrap(err, "could not write frames")
+	}
+	if err := c.storage.CreateOrOverride(filename, index.Bytes()); err != nil {
+		return errors.Wrap(err, "could not write index")
+	}
+	c.indexes.indexes[c.fileKey(filename)] = index
+
+	previous := compressedFramesFile(filename, generation)
+	if _, err := c.storage.Info(previous); err == nil {
+		if err := c.storage.Delete(previous); err != nil {
+			return errors.Wrap(err, "could not delete previous frames")
+		}
+	}
+	return nil
+}
+
+// compress compresses the plain data block by block, the returned partials locate the frames assuming they
+// are written starting at the given offset.
+func (c *compressed) compress(plain []byte, offset int64) ([]byte, []*Partial, error) {
+	var frames bytes.Buffer
+	partials := make([]*Partial, 0, (int64(len(plain))+c.blockSize-1)/c.blockSize)
+	for start := int64(0); start < int64(len(plain)); start += c.blockSize {
+		from := int64(frames.Len())
+		w, err := flate.NewWriter(&frames, flate.BestSpeed)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := w.Write(plain[start:min(start+c.blockSize, int64(len(plain)))]); err != nil {
+			return nil, nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, nil, err
+		}
+		partials = append(partials, &Partial{OffsetFrom: offset + from, OffsetTo: offset + int64(frames.Len())})
+	}
+	return frames.Bytes(), partials, nil
+}
+
+// readBlocks returns the plain data of the blocks between the given indexes inclusive.
+func (c *compressed) readBlocks(filename string, index *compressedIndex, firstBlock int64, lastBlock int64) ([]byte, error) {
+	frames, err := c.storage.ReadPartials(compressedFramesFile(filename, index.generation), index.frames[firstBlock:lastBlock+1])
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read frames")
+	}
+
+	res := make([]byte, 0, (lastBlock-firstBlock+1)*c.blockSize)
+	for i, frame := range frames {
+		plain, err := io.ReadAll(flate.NewReader(bytes.NewReader(frame)))
+		if err != nil {
+			return nil, &CorruptionError{
+				Path:     c.storage.Path(),
+				Filename: filename,
+				Offset:   (firstBlock + int64(i)) * c.blockSize,
+				Err:      errors.Wrap(err, "could not decompress block"),
+			}
+		}
+		res = append(res, plain...)
+	}
+	return res, nil
+}
+
+// index returns the cached index of the file, loading it on the first use. The caller must hold the lock.
+func (c *compressed) index(filename string) (*compressedIndex, error) {
+	if index, ok := c.indexes.indexes[c.fileKey(filename)]; ok {
+		return index, nil
+	}
+	payload, err := c.storage.ReadAll(filename)
+	if err != nil {
+		return nil, err
+	}
+	index := &compressedIndex{owner: c.storage}
+	if err := index.Load(payload); err != nil {
+		return nil, &CorruptionError{
+			Path:     c.storage.Path(),
+			Filename: filename,
+			Err:      errors.Wrap(err, "could not load index"),
+		}
+	}
+	c.indexes.indexes[c.fileKey(filename)] = index
+	return index, nil
+}
+
+// persistPath persists the changed indexes of the files of the layer at the path, the caller must hold the lock.
+func (c *compressed) persistPath(path string) error {
+	for key, index := range c.indexes.indexes {
+		if isInPath(key, path) {
+			if err := persistIndex(key.filename, index); err != nil {
+				return errors.Wrapf(err, "(file=[filename=%s, path=%s]) could not persist index", key.filename, key.path)
+			}
+		}
+	}
+	return nil
+}
+
+// dropPath removes the indexes of the files of the layer at the path without persisting them, the caller must hold
+// the lock.
+func (c *compressed) dropPath(path string) {
+	for key := range c.indexes.indexes {
+		if isInPath(key, path) {
+			delete(c.indexes.indexes, key)
+		}
+	}
+}
+
+func (c *compressed) fileKey(filename string) fileKey {
+	return fileKey{path: c.storage.Path(), filename: filename}
+}
+
+func (c *compressed) layerPath(name string) string {
+	return fmt.Sprintf("%s%c%s", c.storage.Path(), filepath.Separator, name)
+}
+
+func (c *compressed) errorDescriptor(filename string) string {
+	return fmt.Sprintf("(file=[filename=%s, path=%s])", filename, c.storage.Path())
+}
+
+// persistIndex atomically replaces the stored index of the file if it was changed.
+func persistIndex(filename string, index *compressedIndex) error {
+	if !index.dirty {
+		return nil
+	}
+	if err := index.owner.CreateOrOverride(filename, index.Bytes()); err != nil {
+		return err
+	}
+	index.dirty = false
+	return nil
+}
+
+// isInPath reports whether the file belongs to the layer at the path or to one of the layers below it.
+func isInPath(key fileKey, path string) bool {
+	return key.path == path || strings.HasPrefix(key.path, fmt.Sprintf("%s%c", path, filepath.Separator))
+}
+
+func compressedFramesFile(filename string, generation int64) string {
+	return fmt.Sprintf(".%s.%d%s", filename, generation, compressedFramesSuffix)
+}
+
+func isNotCompressedFramesFilter(entry os.DirEntry) (bool, error) {
+	return !strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), compressedFramesSuffix), nil
+}
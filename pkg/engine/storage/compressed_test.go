@@ -0,0 +1,120 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestCompressed(t *testing.T) {
+	t.Run("success - padded data is stored compressed", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewCompressed(inner, 4096)
+		require.NoError(t, err)
+
+		data := make([]byte, 64*1024)
+		copy(data[1000:], "ktsivkov")
+		require.NoError(t, s.CreateOrOverride("data.bin", data))
+
+		info, err := s.Info("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), info.Size())
+
+		var stored int64
+		files, err := inner.List(storage.IsFileFilter)
+		require.NoError(t, err)
+		for _, file := range files {
+			info, err := inner.Info(file)
+			require.NoError(t, err)
+			stored += info.Size()
+		}
+		assert.Less(t, stored, int64(len(data))/10)
+
+		res, err := s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 1000, OffsetTo: 1008}})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("ktsivkov")}, res)
+	})
+
+	t.Run("success - rewritten blocks are compacted", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewCompressed(inner, 4)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("01234567")))
+
+		for i := range 100 {
+			require.NoError(t, s.Offset("data.bin", int64(i%8), []byte{'x'}))
+		}
+
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("xxxxxxxx"), res)
+
+		files, err := inner.List(storage.IsFileFilter)
+		assert.NoError(t, err)
+		assert.Len(t, files, 2, "only the index and a single generation of frames must remain")
+
+		listed, err := s.List()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"data.bin"}, listed)
+	})
+
+	t.Run("success - index is persisted when synced", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewCompressed(inner, 4)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123")))
+		persisted, err := inner.ReadAll("data.bin")
+		require.NoError(t, err)
+
+		require.NoError(t, s.Append("data.bin", []byte("4567")))
+		index, err := inner.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, persisted, index, "the index must only change in memory")
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("01234567"), res)
+
+		require.NoError(t, s.Sync("data.bin"))
+		reopened, err := storage.NewCompressed(inner, 4)
+		require.NoError(t, err)
+		res, err = reopened.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("01234567"), res)
+	})
+
+	t.Run("success - indexes of the layers are persisted on close", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewCompressed(inner, 4)
+		require.NoError(t, err)
+		layer, err := s.NewLayer("layer")
+		require.NoError(t, err)
+		require.NoError(t, layer.CreateOrOverride("data.bin", []byte("0123")))
+		require.NoError(t, layer.Offset("data.bin", 2, []byte("xy")))
+		require.NoError(t, s.Close())
+
+		reopened, err := storage.NewCompressed(inner, 4)
+		require.NoError(t, err)
+		reopenedLayer, err := reopened.NewLayer("layer")
+		require.NoError(t, err)
+		res, err := reopenedLayer.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("01xy"), res)
+	})
+
+	t.Run("success - crash before the index is persisted leaves the previous contents", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s, err := storage.NewCompressed(inner, 4)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123")))
+		require.NoError(t, s.Offset("data.bin", 0, []byte("xy")))
+
+		reopened, err := storage.NewCompressed(inner, 4)
+		require.NoError(t, err)
+		res, err := reopened.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0123"), res)
+	})
+}
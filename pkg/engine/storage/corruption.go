@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// CorruptionError reports data of a file that failed its integrity verification.
+type CorruptionError struct {
+	Path     string
+	Filename string
+	// Offset is the offset of the first byte of the corrupted block
+	Offset int64
+	// Table is the name of the table the file belongs to, it is set by the structure layer
+	Table string
+	Err   error
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("(corruption=[filename=%s, path=%s, offset=%d]) %s", e.Filename, e.Path, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("(corruption=[table=%s, filename=%s, path=%s, offset=%d]) %s", e.Table, e.Filename, e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
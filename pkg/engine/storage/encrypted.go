@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// NewEncrypted returns a Storage that encrypts its files with AES-GCM in independently stored blocks of blockSize
+// bytes, every block is stored with its own random nonce and authentication tag, so that any part of a file can be
+// read or written without touching the rest of it. Every file starts with a header holding a random file id, blocks
+// are bound to the id, to their position within the file and to whether they are the last block of the file. A
+// block that was tampered with or moved within or between files and a file truncated at a block boundary are
+// reported as a *CorruptionError.
+func NewEncrypted(storage Storage, blockSize int64, keyProvider KeyProvider) (Storage, error) {
+	aead, err := newAEAD(keyProvider)
+	if err != nil {
+		return nil, err
+	}
+	return newBlockStorage(storage, blockSize, &encryptionCodec{aead: aead})
+}
+
+// newAEAD returns the AES-GCM cipher of the key of the provider.
+func newAEAD(keyProvider KeyProvider) (cipher.AEAD, error) {
+	key, err := keyProvider.Key()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get encryption key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create gcm")
+	}
+	return aead, nil
+}
+
+const (
+	encryptionFileIdSize = 16
+	encryptionHeaderSize = int64(len(encryptionMagic) + 2 + encryptionFileIdSize)
+	// encryptionFormatVersion is 2 since the last block is marked in the additional data
+	encryptionFormatVersion = 2
+)
+
+// encryptionMagic starts the header of every encrypted file, it is followed by the uint16 format version and the id.
+const encryptionMagic = "KTEF"
+
+type encryptionCodec struct {
+	aead cipher.AEAD
+}
+
+func (c *encryptionCodec) overhead() int64 {
+	return int64(c.aead.NonceSize() + c.aead.Overhead())
+}
+
+func (c *encryptionCodec) headerSize() int64 {
+	return encryptionHeaderSize
+}
+
+func (c *encryptionCodec) newHeader() ([]byte, error) {
+	header := make([]byte, encryptionHeaderSize)
+	copy(header, encryptionMagic)
+	binary.LittleEndian.PutUint16(header[len(encryptionMagic):], encryptionFormatVersion)
+	if _, err := rand.Read(header[len(encryptionMagic)+2:]); err != nil {
+		return nil, errors.Wrap(err, "could not generate file id")
+	}
+	return header, nil
+}
+
+func (c *encryptionCodec) checkHeader(header []byte) error {
+	if int64(len(header)) != encryptionHeaderSize || !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return errors.New("invalid file header")
+	}
+	if version := binary.LittleEndian.Uint16(header[len(encryptionMagic):]); version != encryptionFormatVersion {
+		return errors.Errorf("unsupported format version [version=%d]", version)
+	}
+	return nil
+}
+
+func (c *encryptionCodec) encode(header []byte, index int64, final bool, plain []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), int64(len(plain))+c.overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "could not generate nonce")
+	}
+	return c.aead.Seal(nonce, nonce, plain, c.additionalData(header, index, final)), nil
+}
+
+func (c *encryptionCodec) decode(header []byte, index int64, final bool, stored []byte) ([]byte, error) {
+	if int64(len(stored)) < c.overhead() {
+		return nil, errors.Errorf("truncated block [size=%d]", len(stored))
+	}
+	nonce, ciphertext := stored[:c.aead.NonceSize()], stored[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, c.additionalData(header, index, final))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt block")
+	}
+	return plain, nil
+}
+
+// additionalData binds the block to the header of its file, to its position within the file and to whether it is the
+// last block, so that dropping the blocks at the end of the file is detected. The id is taken from the header rather
+// than from the filename so that files can be renamed without being re-encrypted.
+func (c *encryptionCodec) additionalData(header []byte, index int64, final bool) []byte {
+	res := make([]byte, len(header)+9)
+	copy(res, header)
+	binary.LittleEndian.PutUint64(res[len(header):], uint64(index))
+	if final {
+		res[len(header)+8] = 1
+	}
+	return res
+}
@@ -0,0 +1,137 @@
+package storage_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestEncrypted(t *testing.T) {
+	// overhead is the size of the nonce and of the authentication tag stored with every block
+	const overhead = 12 + 16
+	newEncrypted := func(t *testing.T, inner storage.Storage) storage.Storage {
+		keyFile := filepath.Join(t.TempDir(), "key")
+		require.NoError(t, storage.CreateKeyFile(keyFile))
+		s, err := storage.NewEncrypted(inner, 16, storage.NewFileKeyProvider(keyFile))
+		require.NoError(t, err)
+		return s
+	}
+
+	t.Run("success - data is not stored in plain", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s := newEncrypted(t, inner)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("ktsivkov-ktsivkov-ktsivkov")))
+		require.NoError(t, s.Offset("data.bin", 18, []byte("KTSIVKOV")))
+
+		stored, err := inner.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.False(t, bytes.Contains(stored, []byte("ktsivkov")))
+
+		res, err := s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 9, OffsetTo: 26}})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("ktsivkov-KTSIVKOV")}, res)
+	})
+
+	t.Run("fail - moved block", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s := newEncrypted(t, inner)
+		require.NoError(t, s.CreateOrOverride("data.bin", make([]byte, 32)))
+
+		stored, err := inner.ReadAll("data.bin")
+		require.NoError(t, err)
+		blockSize := 16 + overhead
+		header, blocks := stored[:len(stored)-2*blockSize], stored[len(stored)-2*blockSize:]
+		moved := append(append(append([]byte{}, header...), blocks[blockSize:]...), blocks[:blockSize]...)
+		require.NoError(t, inner.CreateOrOverride("data.bin", moved))
+
+		_, err = s.ReadAll("data.bin")
+		var corruption *storage.CorruptionError
+		assert.True(t, errors.As(err, &corruption))
+	})
+
+	t.Run("fail - block swapped between files", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s := newEncrypted(t, inner)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("ktsivkov")))
+		require.NoError(t, s.CreateOrOverride("schema.bin", []byte("KTSIVKOV")))
+
+		data, err := inner.ReadAll("data.bin")
+		require.NoError(t, err)
+		schema, err := inner.ReadAll("schema.bin")
+		require.NoError(t, err)
+		headerSize := len(data) - 8 - overhead
+		swapped := append(append([]byte{}, schema[:headerSize]...), data[headerSize:]...)
+		require.NoError(t, inner.CreateOrOverride("schema.bin", swapped))
+
+		_, err = s.ReadAll("schema.bin")
+		var corruption *storage.CorruptionError
+		assert.True(t, errors.As(err, &corruption))
+	})
+
+	t.Run("fail - file truncated at a block boundary", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s := newEncrypted(t, inner)
+		require.NoError(t, s.CreateOrOverride("data.bin", make([]byte, 16)))
+		require.NoError(t, s.Append("data.bin", make([]byte, 16)))
+
+		stored, err := inner.ReadAll("data.bin")
+		require.NoError(t, err)
+		require.NoError(t, inner.CreateOrOverride("data.bin", stored[:len(stored)-16-overhead]))
+
+		_, err = s.ReadAll("data.bin")
+		var corruption *storage.CorruptionError
+		assert.True(t, errors.As(err, &corruption))
+	})
+
+	t.Run("success - appends past a full block keep the file readable", func(t *testing.T) {
+		s := newEncrypted(t, storage.NewMemory())
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("ktsivkov-ktsivko")))
+		require.NoError(t, s.Append("data.bin", []byte("v-ktsivkov")))
+		require.NoError(t, s.Offset("data.bin", 32, []byte("!")))
+
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ktsivkov-ktsivkov-ktsivkov\x00\x00\x00\x00\x00\x00!"), res)
+	})
+
+	t.Run("success - renamed file is still readable", func(t *testing.T) {
+		s := newEncrypted(t, storage.NewMemory())
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("ktsivkov-ktsivkov-ktsivkov")))
+		require.NoError(t, s.Rename("data.bin", "data.1.bin"))
+
+		res, err := s.ReadAll("data.1.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ktsivkov-ktsivkov-ktsivkov"), res)
+	})
+
+	t.Run("fail - file without header", func(t *testing.T) {
+		inner := storage.NewMemory()
+		s := newEncrypted(t, inner)
+		require.NoError(t, inner.CreateOrOverride("data.bin", []byte("ktsivkov")))
+
+		_, err := s.ReadAll("data.bin")
+		var corruption *storage.CorruptionError
+		assert.True(t, errors.As(err, &corruption))
+	})
+
+	t.Run("fail - invalid key file", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "key")
+		require.NoError(t, os.WriteFile(keyFile, []byte("short"), 0600))
+
+		_, err := storage.NewEncrypted(storage.NewMemory(), 16, storage.NewFileKeyProvider(keyFile))
+		assert.ErrorContains(t, err, "invalid key size [size=5]")
+	})
+
+	t.Run("fail - key file already exists", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "key")
+		require.NoError(t, storage.CreateKeyFile(keyFile))
+		assert.Error(t, storage.CreateKeyFile(keyFile))
+	})
+}
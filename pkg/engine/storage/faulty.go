@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInjected is the error returned by the faults of a Faulty storage that have no error of their own.
+var ErrInjected = errors.New("injected fault")
+
+type FaultAction int
+
+const (
+	// FaultFail fails the call without performing it.
+	FaultFail FaultAction = iota
+	// FaultShortWrite writes only the first Bytes bytes of the data of an Append or Offset and fails the call.
+	FaultShortWrite
+	// FaultDelay sleeps for Delay before performing the call.
+	FaultDelay
+	// FaultCorrupt flips the bits of the first byte of every slice of data read or written by the call.
+	FaultCorrupt
+)
+
+// Fault describes a call of a Faulty storage that misbehaves.
+type Fault struct {
+	Op Op
+	// Filename restricts the fault to the calls on the file, it matches the files of every layer
+	Filename string
+	// Nth is the number of the matching call that triggers the fault starting from 1, 0 triggers it on every call
+	Nth    int
+	Action FaultAction
+	// Err is returned by FaultFail and FaultShortWrite, it defaults to ErrInjected
+	Err   error
+	Bytes int
+	Delay time.Duration
+}
+
+// Faulty is a Storage that misbehaves on the calls described by its faults, it is meant for testing how the code
+// built on top of a storage copes with failing disks. The faults are shared by all of its layers.
+type Faulty struct {
+	storage Storage
+	script  *faultScript
+}
+
+type faultScript struct {
+	mu     sync.Mutex
+	faults []*scriptedFault
+}
+
+type scriptedFault struct {
+	Fault
+	// calls is the number of calls that matched the fault so far
+	calls int
+}
+
+func NewFaulty(storage Storage, faults ...Fault) *Faulty {
+	f := &Faulty{
+		storage: storage,
+		script:  &faultScript{},
+	}
+	f.Inject(faults...)
+	return f
+}
+
+// Inject adds the faults, the matching calls are counted from the moment a fault is injected.
+func (f *Faulty) Inject(faults ...Fault) {
+	f.script.mu.Lock()
+	defer f.script.mu.Unlock()
+
+	for _, fault := range faults {
+		f.script.faults = append(f.script.faults, &scriptedFault{Fault: fault})
+	}
+}
+
+// Reset removes all faults.
+func (f *Faulty) Reset() {
+	f.script.mu.Lock()
+	defer f.script.mu.Unlock()
+
+	f.script.faults = nil
+}
+
+func (f *Faulty) NewLayer(path string) (Storage, error) {
+	layer, err := f.storage.NewLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Faulty{storage: layer, script: f.script}, nil
+}
+
+func (f *Faulty) RemoveLayer(path string) error {
+	if fault := f.trigger(OpRemoveLayer, path); fault != nil && fault.Action != FaultDelay {
+		return f.fail(fault, path)
+	}
+	return f.storage.RemoveLayer(path)
+}
+
+func (f *Faulty) Path() string {
+	return f.storage.Path()
+}
+
+func (f *Faulty) isReadOnly() bool {
+	return IsReadOnly(f.storage)
+}
+
+func (f *Faulty) Close() error {
+	return f.storage.Close()
+}
+
+func (f *Faulty) Lock(mode LockMode) (FileLock, error) {
+	return f.storage.Lock(mode)
+}
+
+func (f *Faulty) Info(filename string) (os.FileInfo, error) {
+	if fault := f.trigger(OpInfo, filename); fault != nil && fault.Action == FaultFail {
+		return nil, f.fail(fault, filename)
+	}
+	return f.storage.Info(filename)
+}
+
+func (f *Faulty) Exists(name string) (bool, error) {
+	if fault := f.trigger(OpExists, name); fault != nil && fault.Action == FaultFail {
+		return false, f.fail(fault, name)
+	}
+	return f.storage.Exists(name)
+}
+
+func (f *Faulty) ReadAll(filename string) ([]byte, error) {
+	fault := f.trigger(OpReadAll, filename)
+	if fault != nil && fault.Action == FaultFail {
+		return nil, f.fail(fault, filename)
+	}
+	res, err := f.storage.ReadAll(filename)
+	if err != nil {
+		return nil, err
+	}
+	return corrupt(fault, res), nil
+}
+
+func (f *Faulty) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	fault := f.trigger(OpReadPartials, filename)
+	if fault != nil && fault.Action == FaultFail {
+		return nil, f.fail(fault, filename)
+	}
+	res, err := f.storage.ReadPartials(filename, partials)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i] = corrupt(fault, res[i])
+	}
+	return res, nil
+}
+
+func (f *Faulty) ReadAfter(filename string, offset int64) ([]byte, error) {
+	fault := f.trigger(OpReadAfter, filename)
+	if fault != nil && fault.Action == FaultFail {
+		return nil, f.fail(fault, filename)
+	}
+	res, err := f.storage.ReadAfter(filename, offset)
+	if err != nil {
+		return nil, err
+	}
+	return corrupt(fault, res), nil
+}
+
+func (f *Faulty) ReadBefore(filename string, offset int64) ([]byte, error) {
+	fault := f.trigger(OpReadBefore, filename)
+	if fault != nil && fault.Action == FaultFail {
+		return nil, f.fail(fault, filename)
+	}
+	res, err := f.storage.ReadBefore(filename, offset)
+	if err != nil {
+		return nil, err
+	}
+	return corrupt(fault, res), nil
+}
+
+func (f *Faulty) List(filters ...FileFilter) ([]string, error) {
+	return f.storage.List(filters...)
+}
+
+func (f *Faulty) CreateOrOverride(filename string, data []byte) error {
+	fault := f.trigger(OpCreateOrOverride, filename)
+	if fault != nil && (fault.Action == FaultFail || fault.Action == FaultShortWrite) {
+		return f.fail(fault, filename)
+	}
+	return f.storage.CreateOrOverride(filename, corrupt(fault, data))
+}
+
+func (f *Faulty) Append(filename string, data []byte, opts ...WriteOption) error {
+	fault := f.trigger(OpAppend, filename)
+	if fault != nil && fault.Action == FaultFail {
+		return f.fail(fault, filename)
+	}
+	if fault != nil && fault.Action == FaultShortWrite {
+		if err := f.storage.Append(filename, data[:min(fault.Bytes, len(data))], opts...); err != nil {
+			return err
+		}
+		return f.fail(fault, filename)
+	}
+	return f.storage.Append(filename, corrupt(fault, data), opts...)
+}
+
+func (f *Faulty) Offset(filename string, offset int64, data []byte, opts ...WriteOption) error {
+	fault := f.trigger(OpOffset, filename)
+	if fault != nil && fault.Action == FaultFail {
+		return f.fail(fault, filename)
+	}
+	if fault != nil && fault.Action == FaultShortWrite {
+		if err := f.storage.Offset(filename, offset, data[:min(fault.Bytes, len(data))], opts...); err != nil {
+			return err
+		}
+		return f.fail(fault, filename)
+	}
+	return f.storage.Offset(filename, offset, corrupt(fault, data), opts...)
+}
+
+func (f *Faulty) Replace(filename string, partial *Partial, data []byte) error {
+	fault := f.trigger(OpReplace, filename)
+	if fault != nil && (fault.Action == FaultFail || fault.Action == FaultShortWrite) {
+		return f.fail(fault, filename)
+	}
+	return f.storage.Replace(filename, partial, corrupt(fault, data))
+}
+
+// WriteBatch applies the batch through the single writes of the storage, so that their faults apply to it as well.
+func (f *Faulty) WriteBatch(filename string, batch *Batch, opts ...WriteOption) error {
+	if fault := f.trigger(OpWriteBatch, filename); fault != nil && fault.Action != FaultDelay {
+		return f.fail(fault, filename)
+	}
+	return writeBatch(f, filename, batch, opts)
+}
+
+func (f *Faulty) Delete(filename string) error {
+	if fault := f.trigger(OpDelete, filename); fault != nil && fault.Action != FaultDelay {
+		return f.fail(fault, filename)
+	}
+	return f.storage.Delete(filename)
+}
+
+func (f *Faulty) Rename(from string, to string) error {
+	if fault := f.trigger(OpRename, from); fault != nil && fault.Action != FaultDelay {
+		return f.fail(fault, from)
+	}
+	return f.storage.Rename(from, to)
+}
+
+func (f *Faulty) Sync(filename string) error {
+	if fault := f.trigger(OpSync, filename); fault != nil && fault.Action != FaultDelay {
+		return f.fail(fault, filename)
+	}
+	return f.storage.Sync(filename)
+}
+
+// trigger counts the call against the faults and returns the first fault it triggers, delays are applied right away.
+func (f *Faulty) trigger(op Op, filename string) *Fault {
+	f.script.mu.Lock()
+	var triggered *Fault
+	for _, fault := range f.script.faults {
+		if fault.Op != op || (fault.Filename != "" && fault.Filename != filename) {
+			continue
+		}
+		fault.calls++
+		if triggered == nil && (fault.Nth == 0 || fault.Nth == fault.calls) {
+			triggered = &fault.Fault
+		}
+	}
+	f.script.mu.Unlock()
+
+	if triggered != nil && triggered.Action == FaultDelay {
+		time.Sleep(triggered.Delay)
+	}
+	return triggered
+}
+
+func (f *Faulty) fail(fault *Fault, filename string) error {
+	err := fault.Err
+	if err == nil {
+		err = ErrInjected
+	}
+	return errors.Wrapf(err, "%s could not %s", f.errorDescriptor(filename), fault.Op)
+}
+
+// corrupt returns a corrupted copy of the data if the fault corrupts it, the given data is never modified.
+func corrupt(fault *Fault, data []byte) []byte {
+	if fault == nil || fault.Action != FaultCorrupt || len(data) == 0 {
+		return data
+	}
+	res := append([]byte{}, data...)
+	res[0] ^= 0xFF
+	return res
+}
+
+func (f *Faulty) errorDescriptor(filename string) string {
+	return fmt.Sprintf("(fault=[filename=%s, path=%s])", filename, f.storage.Path())
+}
@@ -0,0 +1,65 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestFaulty(t *testing.T) {
+	t.Run("fail - nth offset", func(t *testing.T) {
+		s := storage.NewFaulty(storage.NewMemory(), storage.Fault{Op: storage.OpOffset, Filename: "data.bin", Nth: 2})
+		require.NoError(t, s.CreateOrOverride("data.bin", nil))
+		require.NoError(t, s.CreateOrOverride("other.bin", nil))
+
+		assert.NoError(t, s.Offset("other.bin", 0, []byte("a")))
+		assert.NoError(t, s.Offset("data.bin", 0, []byte("a")))
+		assert.ErrorIs(t, s.Offset("data.bin", 1, []byte("b")), storage.ErrInjected)
+		assert.NoError(t, s.Offset("data.bin", 1, []byte("c")))
+
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ac"), res)
+	})
+
+	t.Run("fail - short write", func(t *testing.T) {
+		s := storage.NewFaulty(storage.NewMemory(), storage.Fault{Op: storage.OpAppend, Action: storage.FaultShortWrite, Bytes: 2})
+		require.NoError(t, s.CreateOrOverride("data.bin", nil))
+
+		assert.ErrorIs(t, s.Append("data.bin", []byte("abcd")), storage.ErrInjected)
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ab"), res)
+	})
+
+	t.Run("success - corrupt and reset", func(t *testing.T) {
+		s := storage.NewFaulty(storage.NewMemory())
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte{0x0F, 0x01}))
+
+		s.Inject(storage.Fault{Op: storage.OpReadAll, Action: storage.FaultCorrupt})
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0xF0, 0x01}, res)
+
+		s.Reset()
+		res, err = s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x0F, 0x01}, res)
+	})
+
+	t.Run("success - delay", func(t *testing.T) {
+		s := storage.NewFaulty(storage.NewMemory(), storage.Fault{Op: storage.OpInfo, Action: storage.FaultDelay, Delay: 10 * time.Millisecond})
+		layer, err := s.NewLayer("layer")
+		require.NoError(t, err)
+		require.NoError(t, layer.CreateOrOverride("data.bin", nil))
+
+		start := time.Now()
+		_, err = layer.Info("data.bin")
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+	})
+}
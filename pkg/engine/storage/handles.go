@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"container/list"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// handlePool keeps a bounded number of files open between calls, closing the least recently used ones first.
+// Handles that are in use are never closed, the pool may therefore temporarily hold more handles than its capacity.
+type handlePool struct {
+	mu       sync.Mutex
+	capacity int
+	// readOnly opens the files for reading only
+	readOnly bool
+	handles  map[string]*list.Element
+	// lru holds the open handles, the most recently used handle is at the front
+	lru *list.List
+}
+
+type handle struct {
+	path string
+	file *os.File
+	// mu serializes the writes that depend on the size of the file
+	mu   sync.Mutex
+	refs int
+	// detached is set once the handle is removed from the pool, it gets closed as soon as it is no longer in use
+	detached bool
+}
+
+func newHandlePool(capacity int, readOnly bool) *handlePool {
+	return &handlePool{
+		capacity: capacity,
+		readOnly: readOnly,
+		handles:  make(map[string]*list.Element, capacity),
+		lru:      list.New(),
+	}
+}
+
+// acquire returns an open handle of the file, it must be released once no longer used.
+func (p *handlePool) acquire(path string) (*handle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if elem, found := p.handles[path]; found {
+		p.lru.MoveToFront(elem)
+		h := elem.Value.(*handle)
+		h.refs++
+		return h, nil
+	}
+
+	flag := os.O_RDWR
+	if p.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for elem := p.lru.Back(); elem != nil && p.lru.Len() >= p.capacity; {
+		prev := elem.Prev()
+		if elem.Value.(*handle).refs == 0 {
+			_ = p.detach(elem)
+		}
+		elem = prev
+	}
+
+	h := &handle{path: path, file: file, refs: 1}
+	p.handles[path] = p.lru.PushFront(h)
+	return h, nil
+}
+
+func (p *handlePool) release(h *handle) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h.refs--
+	if h.detached && h.refs == 0 {
+		return h.file.Close()
+	}
+	return nil
+}
+
+// invalidate closes the handle of the file, it must be called whenever the file is removed or replaced.
+func (p *handlePool) invalidate(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elem, found := p.handles[path]
+	if !found {
+		return nil
+	}
+	return p.detach(elem)
+}
+
+// closePrefix closes the handles of all files whose path starts with the given prefix.
+func (p *handlePool) closePrefix(prefix string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for elem := p.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if strings.HasPrefix(elem.Value.(*handle).path, prefix) {
+			if err := p.detach(elem); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		elem = next
+	}
+	if len(errs) != 0 {
+		return errors.Errorf("could not close %d file handle(s), first error: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+// detach removes the handle from the pool and closes it if it is not in use, the caller must hold the lock.
+func (p *handlePool) detach(elem *list.Element) error {
+	h := elem.Value.(*handle)
+	p.lru.Remove(elem)
+	delete(p.handles, h.path)
+	h.detached = true
+	if h.refs == 0 {
+		return h.file.Close()
+	}
+	return nil
+}
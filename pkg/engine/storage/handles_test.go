@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlePool(t *testing.T) {
+	t.Run("success - handles are bounded", func(t *testing.T) {
+		s, err := NewWithMaxOpenFiles(t.TempDir(), 2)
+		require.NoError(t, err)
+		disk := s.(*storage)
+
+		for _, filename := range []string{"a.bin", "b.bin", "c.bin"} {
+			require.NoError(t, s.CreateOrOverride(filename, []byte(filename)))
+			_, err := s.ReadPartials(filename, []*Partial{{OffsetFrom: 0, OffsetTo: 1}})
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 2, disk.handles.lru.Len())
+		assert.NotContains(t, disk.handles.handles, disk.writer.pathToFile("a.bin"))
+	})
+
+	t.Run("success - handles are invalidated on override and delete", func(t *testing.T) {
+		s, err := New(t.TempDir())
+		require.NoError(t, err)
+		disk := s.(*storage)
+
+		require.NoError(t, s.CreateOrOverride("a.bin", []byte("old")))
+		require.NoError(t, s.Append("a.bin", []byte("!")))
+		assert.Contains(t, disk.handles.handles, disk.writer.pathToFile("a.bin"))
+
+		require.NoError(t, s.CreateOrOverride("a.bin", []byte("new")))
+		assert.NotContains(t, disk.handles.handles, disk.writer.pathToFile("a.bin"))
+		res, err := s.ReadAll("a.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("new"), res)
+
+		require.NoError(t, s.Delete("a.bin"))
+		assert.NotContains(t, disk.handles.handles, disk.writer.pathToFile("a.bin"))
+	})
+
+	t.Run("success - read-only storage opens the files for reading only", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := New(dir)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("a.bin", []byte("abc")))
+		require.NoError(t, s.Close())
+
+		readOnly, err := NewReadOnly(dir)
+		require.NoError(t, err)
+		disk := readOnly.(*storage)
+		res, err := readOnly.ReadPartials("a.bin", []*Partial{{OffsetFrom: 0, OffsetTo: 1}})
+		require.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("a")}, res)
+		checksummed, err := NewChecksummed(readOnly, 16)
+		require.NoError(t, err)
+		assert.True(t, IsReadOnly(checksummed))
+		assert.False(t, IsReadOnly(s))
+
+		h, err := disk.handles.acquire(disk.writer.pathToFile("a.bin"))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, disk.handles.release(h)) }()
+		_, err = h.file.WriteAt([]byte("!"), 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("success - close releases the handles of the layer", func(t *testing.T) {
+		s, err := New(t.TempDir())
+		require.NoError(t, err)
+		disk := s.(*storage)
+		layer, err := s.NewLayer("layer")
+		require.NoError(t, err)
+
+		require.NoError(t, s.CreateOrOverride("root.bin", nil))
+		require.NoError(t, layer.CreateOrOverride("layer.bin", nil))
+		require.NoError(t, s.Sync("root.bin"))
+		require.NoError(t, layer.Sync("layer.bin"))
+		require.NoError(t, layer.Close())
+		assert.Equal(t, 1, disk.handles.lru.Len())
+
+		require.NoError(t, s.Close())
+		assert.Equal(t, 0, disk.handles.lru.Len())
+	})
+}
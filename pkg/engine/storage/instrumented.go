@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of the latency histograms, the last bucket of a histogram
+// counts the calls slower than all of them.
+var LatencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// Event describes a completed call of an instrumented storage.
+type Event struct {
+	Op Op
+	// Path is the path of the layer the call was made on
+	Path     string
+	Filename string
+	// Bytes is the number of bytes read or written by the call
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// Hook receives the events of an instrumented storage, it is called synchronously after every call.
+type Hook interface {
+	OnEvent(event Event)
+}
+
+type HookFunc func(event Event)
+
+func (f HookFunc) OnEvent(event Event) {
+	f(event)
+}
+
+type OpMetrics struct {
+	Calls  int64
+	Errors int64
+	Bytes  int64
+	// Latency holds the number of calls per bucket of LatencyBuckets, followed by the calls slower than all of them
+	Latency      []int64
+	TotalLatency time.Duration
+}
+
+// MetricsSnapshot is a copy of the metrics of an instrumented storage.
+type MetricsSnapshot struct {
+	// Layers holds the metrics by the path of the layer and the operation
+	Layers map[string]map[Op]OpMetrics
+}
+
+// Total returns the metrics of the operation summed over all layers.
+func (s MetricsSnapshot) Total(op Op) OpMetrics {
+	res := OpMetrics{Latency: make([]int64, len(LatencyBuckets)+1)}
+	for _, ops := range s.Layers {
+		metrics, found := ops[op]
+		if !found {
+			continue
+		}
+		res.Calls += metrics.Calls
+		res.Errors += metrics.Errors
+		res.Bytes += metrics.Bytes
+		res.TotalLatency += metrics.TotalLatency
+		for i, count := range metrics.Latency {
+			res.Latency[i] += count
+		}
+	}
+	return res
+}
+
+// NewInstrumented returns a Storage that records the calls, bytes and latencies of every operation per layer and
+// passes every call as an event to the hooks. The metrics are shared by all of its layers.
+func NewInstrumented(storage Storage, hooks ...Hook) *Instrumented {
+	return &Instrumented{
+		storage: storage,
+		metrics: &metrics{layers: make(map[string]map[Op]*OpMetrics)},
+		hooks:   hooks,
+	}
+}
+
+type Instrumented struct {
+	storage Storage
+	metrics *metrics
+	hooks   []Hook
+}
+
+type metrics struct {
+	mu     sync.Mutex
+	layers map[string]map[Op]*OpMetrics
+}
+
+// Snapshot returns a copy of the metrics of all layers.
+func (i *Instrumented) Snapshot() MetricsSnapshot {
+	i.metrics.mu.Lock()
+	defer i.metrics.mu.Unlock()
+
+	res := MetricsSnapshot{Layers: make(map[string]map[Op]OpMetrics, len(i.metrics.layers))}
+	for path, ops := range i.metrics.layers {
+		res.Layers[path] = make(map[Op]OpMetrics, len(ops))
+		for op, metrics := range ops {
+			copied := *metrics
+			copied.Latency = append([]int64{}, metrics.Latency...)
+			res.Layers[path][op] = copied
+		}
+	}
+	return res
+}
+
+func (i *Instrumented) NewLayer(path string) (Storage, error) {
+	layer, err := i.storage.NewLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Instrumented{storage: layer, metrics: i.metrics, hooks: i.hooks}, nil
+}
+
+func (i *Instrumented) RemoveLayer(path string) error {
+	start := time.Now()
+	err := i.storage.RemoveLayer(path)
+	i.record(OpRemoveLayer, path, 0, start, err)
+	return err
+}
+
+func (i *Instrumented) Path() string {
+	return i.storage.Path()
+}
+
+func (i *Instrumented) isReadOnly() bool {
+	return IsReadOnly(i.storage)
+}
+
+func (i *Instrumented) Close() error {
+	return i.storage.Close()
+}
+
+func (i *Instrumented) Lock(mode LockMode) (FileLock, error) {
+	return i.storage.Lock(mode)
+}
+
+func (i *Instrumented) Info(filename string) (os.FileInfo, error) {
+	start := time.Now()
+	res, err := i.storage.Info(filename)
+	i.record(OpInfo, filename, 0, start, err)
+	return res, err
+}
+
+func (i *Instrumented) Exists(name string) (bool, error) {
+	start := time.Now()
+	res, err := i.storage.Exists(name)
+	i.record(OpExists, name, 0, start, err)
+	return res, err
+}
+
+func (i *Instrumented) ReadAll(filename string) ([]byte, error) {
+	start := time.Now()
+	res, err := i.storage.ReadAll(filename)
+	i.record(OpReadAll, filename, int64(len(res)), start, err)
+	return res, err
+}
+
+func (i *Instrumented) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	start := time.Now()
+	res, err := i.storage.ReadPartials(filename, partials)
+	size := int64(0)
+	for _, data := range res {
+		size += int64(len(data))
+	}
+	i.record(OpReadPartials, filename, size, start, err)
+	return res, err
+}
+
+func (i *Instrumented) ReadAfter(filename string, offset int64) ([]byte, error) {
+	start := time.Now()
+	res, err := i.storage.ReadAfter(filename, offset)
+	i.record(OpReadAfter, filename, int64(len(res)), start, err)
+	return res, err
+}
+
+func (i *Instrumented) ReadBefore(filename string, offset int64) ([]byte, error) {
+	start := time.Now()
+	res, err := i.storage.ReadBefore(filename, offset)
+	i.record(OpReadBefore, filename, int64(len(res)), start, err)
+	return res, err
+}
+
+func (i *Instrumented) List(filters ...FileFilter) ([]string, error) {
+	start := time.Now()
+	res, err := i.storage.List(filters...)
+	i.record(OpList, "", 0, start, err)
+	return res, err
+}
+
+func (i *Instrumented) CreateOrOverride(filename string, data []byte) error {
+	start := time.Now()
+	err := i.storage.CreateOrOverride(filename, data)
+	i.record(OpCreateOrOverride, filename, int64(len(data)), start, err)
+	return err
+}
+
+func (i *Instrumented) Append(filename string, data []byte, opts ...WriteOption) error {
+	start := time.Now()
+	err := i.storage.Append(filename, data, opts...)
+	i.record(OpAppend, filename, int64(len(data)), start, err)
+	return err
+}
+
+func (i *Instrumented) Offset(filename string, offset int64, data []byte, opts ...WriteOption) error {
+	start := time.Now()
+	err := i.storage.Offset(filename, offset, data, opts...)
+	i.record(OpOffset, filename, int64(len(data)), start, err)
+	return err
+}
+
+func (i *Instrumented) Replace(filename string, partial *Partial, data []byte) error {
+	start := time.Now()
+	err := i.storage.Replace(filename, partial, data)
+	i.record(OpReplace, filename, int64(len(data)), start, err)
+	return err
+}
+
+func (i *Instrumented) WriteBatch(filename string, batch *Batch, opts ...WriteOption) error {
+	start := time.Now()
+	err := i.storage.WriteBatch(filename, batch, opts...)
+	i.record(OpWriteBatch, filename, batch.Size(), start, err)
+	return err
+}
+
+func (i *Instrumented) Delete(filename string) error {
+	start := time.Now()
+	err := i.storage.Delete(filename)
+	i.record(OpDelete, filename, 0, start, err)
+	return err
+}
+
+func (i *Instrumented) Rename(from string, to string) error {
+	start := time.Now()
+	err := i.storage.Rename(from, to)
+	i.record(OpRename, from, 0, start, err)
+	return err
+}
+
+func (i *Instrumented) Sync(filename string) error {
+	start := time.Now()
+	err := i.storage.Sync(filename)
+	i.record(OpSync, filename, 0, start, err)
+	return err
+}
+
+// record adds the call to the metrics of the layer and passes it to the hooks.
+func (i *Instrumented) record(op Op, filename string, size int64, start time.Time, err error) {
+	event := Event{
+		Op:       op,
+		Path:     i.storage.Path(),
+		Filename: filename,
+		Bytes:    size,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+
+	i.metrics.mu.Lock()
+	ops, found := i.metrics.layers[event.Path]
+	if !found {
+		ops = make(map[Op]*OpMetrics)
+		i.metrics.layers[event.Path] = ops
+	}
+	metrics, found := ops[op]
+	if !found {
+		metrics = &OpMetrics{Latency: make([]int64, len(LatencyBuckets)+1)}
+		ops[op] = metrics
+	}
+	metrics.Calls++
+	if err != nil {
+		metrics.Errors++
+	} else {
+		metrics.Bytes += size
+	}
+	metrics.Latency[latencyBucket(event.Duration)]++
+	metrics.TotalLatency += event.Duration
+	i.metrics.mu.Unlock()
+
+	for _, hook := range i.hooks {
+		hook.OnEvent(event)
+	}
+}
+
+func latencyBucket(duration time.Duration) int {
+	for i, bound := range LatencyBuckets {
+		if duration <= bound {
+			return i
+		}
+	}
+	return len(LatencyBuckets)
+}
@@ -0,0 +1,47 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestInstrumented(t *testing.T) {
+	t.Run("success - metrics per layer", func(t *testing.T) {
+		var events []storage.Event
+		s := storage.NewInstrumented(storage.NewMemory(), storage.HookFunc(func(event storage.Event) {
+			events = append(events, event)
+		}))
+		layer, err := s.NewLayer("users")
+		require.NoError(t, err)
+
+		require.NoError(t, layer.CreateOrOverride("data.bin", []byte("0123")))
+		require.NoError(t, layer.Append("data.bin", []byte("45")))
+		_, err = layer.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 0, OffsetTo: 2}, {OffsetFrom: 4, OffsetTo: 6}})
+		require.NoError(t, err)
+		_, err = layer.ReadAll("missing.bin")
+		require.Error(t, err)
+
+		snapshot := s.Snapshot()
+		ops := snapshot.Layers[layer.Path()]
+		assert.Equal(t, int64(1), ops[storage.OpAppend].Calls)
+		assert.Equal(t, int64(2), ops[storage.OpAppend].Bytes)
+		assert.Equal(t, int64(4), ops[storage.OpReadPartials].Bytes)
+		assert.Equal(t, int64(1), ops[storage.OpReadAll].Errors)
+
+		calls := int64(0)
+		for _, count := range ops[storage.OpAppend].Latency {
+			calls += count
+		}
+		assert.Equal(t, int64(1), calls)
+		assert.Equal(t, int64(6), snapshot.Total(storage.OpCreateOrOverride).Bytes+snapshot.Total(storage.OpAppend).Bytes)
+
+		require.Len(t, events, 4)
+		assert.Equal(t, storage.OpReadAll, events[3].Op)
+		assert.Equal(t, "missing.bin", events[3].Filename)
+		assert.Error(t, events[3].Err)
+	})
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"crypto/rand"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// KeySize is the size of the keys generated by CreateKeyFile, it selects AES-256.
+const KeySize = 32
+
+// KeyProvider supplies the key material used to encrypt storages.
+type KeyProvider interface {
+	// Key returns an AES key of 16, 24 or 32 bytes.
+	Key() ([]byte, error)
+}
+
+// NewFileKeyProvider returns a KeyProvider that reads the raw key from the given file.
+func NewFileKeyProvider(path string) KeyProvider {
+	return &fileKeyProvider{path: path}
+}
+
+type fileKeyProvider struct {
+	path string
+}
+
+func (p *fileKeyProvider) Key() ([]byte, error) {
+	key, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "(key_file=[path=%s]) could not read key", p.path)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, errors.Errorf("(key_file=[path=%s]) invalid key size [size=%d]", p.path, len(key))
+	}
+}
+
+// CreateKeyFile generates a random key and writes it into a new file readable only by its owner.
+func CreateKeyFile(path string) error {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return errors.Wrap(err, "could not generate key")
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "(key_file=[path=%s]) could not create file", path)
+	}
+	if _, err := file.Write(key); err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "(key_file=[path=%s]) could not write key", path)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "(key_file=[path=%s]) could not sync file", path)
+	}
+	return file.Close()
+}
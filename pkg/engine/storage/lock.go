@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// lockFilename is the name of the file holding the lock of a layer, it is hidden from List.
+const lockFilename = ".lock"
+
+// ErrReadOnly is returned by the writes of a storage opened by NewReadOnly.
+var ErrReadOnly = errors.New("storage is read-only")
+
+type LockMode int
+
+const (
+	// LockShared may be held by any number of holders at the same time, as long as nobody holds LockExclusive.
+	LockShared LockMode = iota
+	// LockExclusive may only be held by a single holder.
+	LockExclusive
+)
+
+func (m LockMode) String() string {
+	if m == LockExclusive {
+		return "exclusive"
+	}
+	return "shared"
+}
+
+// Locker takes advisory locks on storage layers, locks never wait for a conflicting lock to be released.
+//
+// On unix the locks of the disk storage are flocks on a lock file of the layer, they are released when their
+// process exits and the lock file is removed by the last holder. Elsewhere the lock is emulated by exclusively
+// creating the lock file, shared locks are taken as exclusive ones and the lock file of a crashed process stays
+// behind, keeping the layer locked until it is removed by hand.
+type Locker interface {
+	// Lock locks the layer in the given mode, it fails with a *LockedError if a conflicting lock is held.
+	Lock(mode LockMode) (FileLock, error)
+}
+
+type FileLock interface {
+	Unlock() error
+}
+
+// LockedError reports a lock that could not be taken because a conflicting lock is held by another holder.
+type LockedError struct {
+	Path string
+	Mode LockMode
+	// PID is the process id of the holder of the exclusive lock, it is 0 if unknown or if the lock is shared
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("(lock=[path=%s, mode=%s]) database in use", e.Path, e.Mode)
+	}
+	return fmt.Sprintf("(lock=[path=%s, mode=%s]) database in use by pid %d", e.Path, e.Mode, e.PID)
+}
+
+func (p *storage) Lock(mode LockMode) (FileLock, error) {
+	return lockLayer(p.path, mode)
+}
+
+// lockLayer locks the lock file of the layer at the given path, the process id is recorded in it for exclusive locks
+// only, since the holders of a shared lock would overwrite each other's.
+func lockLayer(path string, mode LockMode) (*diskLock, error) {
+	lockPath := fmt.Sprintf("%s%c%s", path, filepath.Separator, lockFilename)
+	file, err := lockFile(lockPath, mode)
+	if errors.Is(err, errLockHeld) {
+		return nil, &LockedError{Path: path, Mode: mode, PID: readLockPID(lockPath)}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "(lock=[path=%s, mode=%s]) could not lock", path, mode)
+	}
+
+	lock := &diskLock{path: lockPath, file: file}
+	if mode != LockExclusive {
+		return lock, nil
+	}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err != nil {
+		_ = lock.Unlock()
+		return nil, errors.Wrapf(err, "(lock=[path=%s, mode=%s]) could not record pid", path, mode)
+	}
+	return lock, nil
+}
+
+type diskLock struct {
+	path string
+	file *os.File
+}
+
+func (l *diskLock) Unlock() error {
+	if err := unlockFile(l.path, l.file); err != nil {
+		return errors.Wrapf(err, "(lock=[path=%s]) could not unlock", l.path)
+	}
+	return nil
+}
+
+func readLockPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
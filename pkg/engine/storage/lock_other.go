@@ -0,0 +1,29 @@
+//go:build !unix
+
+package storage
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var errLockHeld = errors.New("lock is held")
+
+// lockFile emulates the lock by exclusively creating the file, shared locks are therefore taken as exclusive ones.
+// The file is removed on unlock. Unlike a flock it is not released when the process exits, the file of a crashed
+// process stays behind and every later lock fails with a *LockedError until the file is removed by hand.
+func lockFile(path string, _ LockMode) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil, errLockHeld
+	}
+	return file, err
+}
+
+func unlockFile(path string, file *os.File) error {
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
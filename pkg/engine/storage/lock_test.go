@@ -0,0 +1,110 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("fail - path in use", func(t *testing.T) {
+		path := t.TempDir()
+		s, err := storage.New(path)
+		require.NoError(t, err)
+
+		_, err = storage.New(path)
+		var locked *storage.LockedError
+		require.ErrorAs(t, err, &locked)
+		assert.Equal(t, os.Getpid(), locked.PID)
+		assert.Contains(t, err.Error(), "database in use by pid")
+
+		require.NoError(t, s.Close())
+		reopened, err := storage.New(path)
+		require.NoError(t, err)
+		assert.NoError(t, reopened.Close())
+	})
+}
+
+func TestNewReadOnly(t *testing.T) {
+	t.Run("success - reads next to a writer", func(t *testing.T) {
+		path := t.TempDir()
+		s, err := storage.New(path)
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("ktdb")))
+
+		readOnly, err := storage.NewReadOnly(path)
+		require.NoError(t, err)
+		defer func() { _ = readOnly.Close() }()
+
+		res, err := readOnly.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ktdb"), res)
+	})
+
+	t.Run("fail - write", func(t *testing.T) {
+		readOnly, err := storage.NewReadOnly(t.TempDir())
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, readOnly.CreateOrOverride("data.bin", nil), storage.ErrReadOnly)
+		assert.ErrorIs(t, readOnly.Append("data.bin", []byte("a")), storage.ErrReadOnly)
+		assert.ErrorIs(t, readOnly.Delete("data.bin"), storage.ErrReadOnly)
+	})
+}
+
+func TestStorage_Lock(t *testing.T) {
+	t.Run("success - lock file is removed by the last holder", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+		layer, err := s.NewLayer("users")
+		require.NoError(t, err)
+
+		first, err := layer.Lock(storage.LockShared)
+		require.NoError(t, err)
+		second, err := layer.Lock(storage.LockShared)
+		require.NoError(t, err)
+		require.NoError(t, first.Unlock())
+		_, err = os.Stat(filepath.Join(layer.Path(), ".lock"))
+		assert.NoError(t, err)
+
+		require.NoError(t, second.Unlock())
+		_, err = os.Stat(filepath.Join(layer.Path(), ".lock"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		exclusive, err := layer.Lock(storage.LockExclusive)
+		require.NoError(t, err)
+		require.NoError(t, exclusive.Unlock())
+		_, err = os.Stat(filepath.Join(layer.Path(), ".lock"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("success - pid is recorded for exclusive locks only", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+		layer, err := s.NewLayer("users")
+		require.NoError(t, err)
+
+		shared, err := layer.Lock(storage.LockShared)
+		require.NoError(t, err)
+		_, err = layer.Lock(storage.LockExclusive)
+		var locked *storage.LockedError
+		require.ErrorAs(t, err, &locked)
+		assert.Equal(t, 0, locked.PID)
+		assert.NotContains(t, err.Error(), "by pid")
+		require.NoError(t, shared.Unlock())
+
+		exclusive, err := layer.Lock(storage.LockExclusive)
+		require.NoError(t, err)
+		_, err = layer.Lock(storage.LockShared)
+		require.ErrorAs(t, err, &locked)
+		assert.Equal(t, os.Getpid(), locked.PID)
+		require.NoError(t, exclusive.Unlock())
+	})
+}
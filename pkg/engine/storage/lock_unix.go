@@ -0,0 +1,66 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+var errLockHeld = errors.New("lock is held")
+
+// lockFile takes a non-blocking flock on the file, the lock is released when the returned file is closed,
+// including when the process exits. The file may be removed by the last holder between being opened and being
+// locked, it is then opened again so that all holders lock the same file.
+func lockFile(path string, mode LockMode) (*os.File, error) {
+	how := syscall.LOCK_SH
+	if mode == LockExclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+			_ = file.Close()
+			if errors.Is(err, syscall.EWOULDBLOCK) {
+				return nil, errLockHeld
+			}
+			return nil, err
+		}
+
+		current, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			_ = file.Close()
+			return nil, err
+		}
+		locked, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		if current != nil && os.SameFile(current, locked) {
+			return file, nil
+		}
+		_ = file.Close()
+	}
+}
+
+// unlockFile removes the file if no one else holds a lock on it, which is the case if the lock can be converted to
+// an exclusive one. The file is removed before the lock is released, see lockFile.
+func unlockFile(path string, file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
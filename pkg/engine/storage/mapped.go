@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// NewMapped returns a Storage that serves ReadPartials and ReadAfter of the files of the given disk storage from
+// read-only memory mappings, without copying the data or calling into the kernel once a file is mapped.
+// The mappings are shared by all layers of the returned storage. A file is mapped with room to grow past its end,
+// which is doubled whenever the file outgrows it, so that a growing file is only remapped a logarithmic number of
+// times. The mapping of a file that is replaced, deleted, renamed or remapped is unmapped as soon as no pin holds it.
+//
+// The slices returned by ReadPartials and ReadAfter point into the mappings, they must never be modified. The slices
+// returned by the storage itself are only valid until their file is next written, the reads that keep them longer
+// or run alongside the writes go through Pin. Storages that modify the data they read, such as the buffered storage,
+// must therefore not be created on top of it. All writes to the files must go through the returned storage.
+func NewMapped(s Storage) (*Mapped, error) {
+	disk, ok := s.(*storage)
+	if !ok {
+		return nil, errors.Errorf("(storage=[path=%s]) memory mapping requires a disk storage", s.Path())
+	}
+	if !mmapSupported {
+		return nil, errors.Errorf("(storage=[path=%s]) memory mapping is not supported on this platform", s.Path())
+	}
+	return &Mapped{
+		storage:  disk,
+		mappings: &mappings{files: make(map[string]*mapping)},
+	}, nil
+}
+
+type Mapped struct {
+	*storage
+	mappings *mappings
+}
+
+// mappings holds the current mapping of every mapped file by its path, together with the mappings that got replaced
+// while pinned, which are kept alive until their last pin is released.
+type mappings struct {
+	mu      sync.RWMutex
+	files   map[string]*mapping
+	retired []*mapping
+}
+
+// mappedMinCapacity is the number of bytes the smallest mapping spans.
+const mappedMinCapacity = 1 << 16
+
+type mapping struct {
+	path string
+	// data spans the capacity of the mapping, only its first size bytes are within the file
+	data []byte
+	size int64
+	// refs is the number of pins holding the mapping, it is only incremented under the read lock of the mappings
+	refs atomic.Int64
+}
+
+// Pin returns a reader of the storage whose reads keep the mappings they are served from alive until release is
+// called, the slices it returns remain valid until then even if their files are written. The reader must not be used
+// after the release.
+func (m *Mapped) Pin() (Reader, func() error) {
+	p := &pinned{Mapped: m, held: make(map[*mapping]struct{})}
+	return p, p.release
+}
+
+type pinned struct {
+	*Mapped
+	mu   sync.Mutex
+	held map[*mapping]struct{}
+}
+
+func (p *pinned) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	return p.Mapped.readPartials(filename, partials, p)
+}
+
+func (p *pinned) ReadAfter(filename string, offset int64) ([]byte, error) {
+	return p.Mapped.readAfter(filename, offset, p)
+}
+
+// hold adds a reference to the mapping unless the pin holds it already, the caller must hold the lock of the mappings.
+func (p *pinned) hold(current *mapping) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, found := p.held[current]; !found {
+		p.held[current] = struct{}{}
+		current.refs.Add(1)
+	}
+}
+
+// release drops the references of the pin, unmapping the retired mappings no other pin holds.
+func (p *pinned) release() error {
+	p.Mapped.mappings.mu.Lock()
+	defer p.Mapped.mappings.mu.Unlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for held := range p.held {
+		if held.refs.Add(-1) != 0 {
+			continue
+		}
+		if idx := slices.Index(p.Mapped.mappings.retired, held); idx >= 0 {
+			p.Mapped.mappings.retired = slices.Delete(p.Mapped.mappings.retired, idx, idx+1)
+			if err := munmapFile(held.data); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	clear(p.held)
+	if len(errs) != 0 {
+		return errors.Errorf("could not unmap %d file(s), first error: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+func (m *Mapped) NewLayer(path string) (Storage, error) {
+	layer, err := m.storage.NewLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapped{
+		storage:  layer.(*storage),
+		mappings: m.mappings,
+	}, nil
+}
+
+func (m *Mapped) Close() error {
+	if err := m.unmapPrefix(fmt.Sprintf("%s%c", m.storage.path, filepath.Separator)); err != nil {
+		return errors.Wrapf(err, "could not unmap storager=[path=%s]", m.storage.path)
+	}
+	return m.storage.Close()
+}
+
+func (m *Mapped) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	return m.readPartials(filename, partials, nil)
+}
+
+func (m *Mapped) readPartials(filename string, partials []*Partial, pin *pinned) ([][]byte, error) {
+	to := int64(0)
+	for _, partial := range partials {
+		if partial.OffsetFrom < 0 || partial.OffsetFrom > partial.OffsetTo {
+			return nil, errors.Errorf("%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", m.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+		to = max(to, partial.OffsetTo)
+	}
+
+	data, err := m.data(filename, to, pin)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not map file", m.errorDescriptor(filename))
+	}
+
+	res := make([][]byte, len(partials))
+	for i, partial := range partials {
+		if partial.OffsetTo > int64(len(data)) {
+			return nil, errors.Wrapf(io.EOF, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", m.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+		res[i] = data[partial.OffsetFrom:partial.OffsetTo:partial.OffsetTo]
+	}
+	return res, nil
+}
+
+func (m *Mapped) ReadAfter(filename string, offset int64) ([]byte, error) {
+	return m.readAfter(filename, offset, nil)
+}
+
+func (m *Mapped) readAfter(filename string, offset int64, pin *pinned) ([]byte, error) {
+	if offset < 0 {
+		return nil, errors.Errorf("%s could not skip file data to offset [offset=%d]", m.errorDescriptor(filename), offset)
+	}
+
+	// the whole file is needed, a mapping is only known to be complete after checking the size of the file
+	data, err := m.data(filename, -1, pin)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not map file", m.errorDescriptor(filename))
+	}
+	return data[min(offset, int64(len(data))):len(data):len(data)], nil
+}
+
+func (m *Mapped) CreateOrOverride(filename string, data []byte) error {
+	if err := m.retire(filename); err != nil {
+		return errors.Wrapf(err, "%s could not unmap file", m.errorDescriptor(filename))
+	}
+	return m.storage.CreateOrOverride(filename, data)
+}
+
+func (m *Mapped) Replace(filename string, partial *Partial, data []byte) error {
+	if err := m.retire(filename); err != nil {
+		return errors.Wrapf(err, "%s could not unmap file", m.errorDescriptor(filename))
+	}
+	return m.storage.Replace(filename, partial, data)
+}
+
+func (m *Mapped) WriteBatch(filename string, batch *Batch, opts ...WriteOption) error {
+	if newWriteOptions(opts).atomic {
+		if err := m.retire(filename); err != nil {
+			return errors.Wrapf(err, "%s could not unmap file", m.errorDescriptor(filename))
+		}
+	}
+	return m.storage.WriteBatch(filename, batch, opts...)
+}
+
+func (m *Mapped) Delete(filename string) error {
+	if err := m.retire(filename); err != nil {
+		return errors.Wrapf(err, "%s could not unmap file", m.errorDescriptor(filename))
+	}
+	return m.storage.Delete(filename)
+}
+
+func (m *Mapped) Rename(from string, to string) error {
+	for _, name := range []string{from, to} {
+		if err := m.retire(name); err != nil {
+			return errors.Wrapf(err, "%s could not unmap file", m.errorDescriptor(name))
+		}
+		if err := m.retirePrefix(fmt.Sprintf("%s%c", m.pathToFile(name), filepath.Separator)); err != nil {
+			return errors.Wrapf(err, "could not unmap storager=[path=%s]", m.pathToFile(name))
+		}
+	}
+	return m.storage.Rename(from, to)
+}
+
+func (m *Mapped) RemoveLayer(path string) error {
+	if err := m.retirePrefix(fmt.Sprintf("%s%c", m.pathToFile(path), filepath.Separator)); err != nil {
+		return errors.Wrapf(err, "could not unmap storager=[path=%s]", m.pathToFile(path))
+	}
+	return m.storage.RemoveLayer(path)
+}
+
+// data returns the mapped contents of the file, the size of the file is checked again if the contents end before the
+// given offset or the offset is negative. The file is only remapped if it outgrew the capacity of its mapping, the
+// pages past the end of the file become readable through the mapping as the file grows. The mapping is held by the
+// pin if one is given.
+func (m *Mapped) data(filename string, to int64, pin *pinned) ([]byte, error) {
+	path := m.pathToFile(filename)
+
+	m.mappings.mu.RLock()
+	current, found := m.mappings.files[path]
+	if found && to >= 0 && to <= current.size {
+		defer m.mappings.mu.RUnlock()
+		if pin != nil {
+			pin.hold(current)
+		}
+		return current.data[:current.size:current.size], nil
+	}
+	m.mappings.mu.RUnlock()
+
+	m.mappings.mu.Lock()
+	defer m.mappings.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	current, found = m.mappings.files[path]
+	if !found || size > int64(len(current.data)) {
+		capacity := int64(mappedMinCapacity)
+		for capacity < size {
+			capacity *= 2
+		}
+		data, err := mmapFile(path, capacity)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			if err := m.mappings.retire(current); err != nil {
+				return nil, err
+			}
+		}
+		current = &mapping{path: path, data: data}
+		m.mappings.files[path] = current
+	}
+	current.size = size
+	if pin != nil {
+		pin.hold(current)
+	}
+	return current.data[:size:size], nil
+}
+
+// retire stops serving reads of the file from its current mapping, it must be called before the file is replaced.
+func (m *Mapped) retire(filename string) error {
+	path := m.pathToFile(filename)
+
+	m.mappings.mu.Lock()
+	defer m.mappings.mu.Unlock()
+
+	current, found := m.mappings.files[path]
+	if !found {
+		return nil
+	}
+	delete(m.mappings.files, path)
+	return m.mappings.retire(current)
+}
+
+// retirePrefix retires the current mappings of all files whose path starts with the given prefix.
+func (m *Mapped) retirePrefix(prefix string) error {
+	m.mappings.mu.Lock()
+	defer m.mappings.mu.Unlock()
+
+	var errs []error
+	for path, current := range m.mappings.files {
+		if strings.HasPrefix(path, prefix) {
+			delete(m.mappings.files, path)
+			if err := m.mappings.retire(current); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return errors.Errorf("could not unmap %d file(s), first error: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+// retire unmaps the mapping unless a pin holds it, in which case it is kept until the last pin is released. The
+// caller must hold the lock and have removed the mapping from the files.
+func (ms *mappings) retire(old *mapping) error {
+	if old.refs.Load() > 0 {
+		ms.retired = append(ms.retired, old)
+		return nil
+	}
+	return munmapFile(old.data)
+}
+
+// unmapPrefix unmaps the current and retired mappings of all files whose path starts with the given prefix.
+func (m *Mapped) unmapPrefix(prefix string) error {
+	m.mappings.mu.Lock()
+	defer m.mappings.mu.Unlock()
+
+	var errs []error
+	for path, current := range m.mappings.files {
+		if strings.HasPrefix(path, prefix) {
+			if err := munmapFile(current.data); err != nil {
+				errs = append(errs, err)
+			}
+			delete(m.mappings.files, path)
+		}
+	}
+	retired := m.mappings.retired[:0]
+	for _, old := range m.mappings.retired {
+		if !strings.HasPrefix(old.path, prefix) {
+			retired = append(retired, old)
+			continue
+		}
+		if err := munmapFile(old.data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	m.mappings.retired = retired
+
+	if len(errs) != 0 {
+		return errors.Errorf("could not unmap %d file(s), first error: %s", len(errs), errs[0])
+	}
+	return nil
+}
+
+func (m *Mapped) pathToFile(filename string) string {
+	return m.storage.reader.pathToFile(filename)
+}
+
+func (m *Mapped) errorDescriptor(filename string) string {
+	return m.storage.reader.errorDescriptor(filename)
+}
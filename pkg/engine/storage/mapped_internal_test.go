@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMappings(t *testing.T) {
+	t.Run("success - retired mappings are unmapped once no pin holds them", func(t *testing.T) {
+		disk, err := New(t.TempDir())
+		require.NoError(t, err)
+		s, err := NewMapped(disk)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, s.Close()) }()
+
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("first")))
+		_, err = s.ReadAfter("data.bin", 0)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("second")))
+		assert.Empty(t, s.mappings.retired, "mapping without pins is unmapped right away")
+
+		first, releaseFirst := s.Pin()
+		second, releaseSecond := s.Pin()
+		for _, pinned := range []Reader{first, second} {
+			res, err := pinned.ReadPartials("data.bin", []*Partial{{OffsetFrom: 0, OffsetTo: 6}})
+			require.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("second")}, res)
+		}
+		require.NoError(t, s.Delete("data.bin"))
+		assert.Len(t, s.mappings.retired, 1)
+
+		require.NoError(t, releaseFirst())
+		assert.Len(t, s.mappings.retired, 1, "mapping is still held by the second pin")
+		require.NoError(t, releaseSecond())
+		assert.Empty(t, s.mappings.retired)
+	})
+
+	t.Run("success - remapped file releases its previous mapping", func(t *testing.T) {
+		disk, err := New(t.TempDir())
+		require.NoError(t, err)
+		s, err := NewMapped(disk)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, s.Close()) }()
+
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123")))
+		pinned, release := s.Pin()
+		_, err = pinned.ReadAfter("data.bin", 0)
+		require.NoError(t, err)
+		require.NoError(t, s.Append("data.bin", make([]byte, mappedMinCapacity)))
+		res, err := s.ReadAfter("data.bin", mappedMinCapacity)
+		require.NoError(t, err)
+		assert.Len(t, res, 4)
+		assert.Len(t, s.mappings.retired, 1)
+
+		require.NoError(t, release())
+		assert.Empty(t, s.mappings.retired)
+	})
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+)
+
+const mmapSupported = false
+
+func mmapFile(_ string, _ int64) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported")
+}
+
+func munmapFile(_ []byte) error {
+	return nil
+}
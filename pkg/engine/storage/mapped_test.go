@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestNewMapped(t *testing.T) {
+	t.Run("success - remaps on growth", func(t *testing.T) {
+		disk, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+		s, err := storage.NewMapped(disk)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, s.Close()) }()
+
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123")))
+		first, err := s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 0, OffsetTo: 4}})
+		require.NoError(t, err)
+
+		require.NoError(t, s.Append("data.bin", []byte("4567")))
+		require.NoError(t, s.Offset("data.bin", 0, []byte("X")))
+		grown, err := s.ReadPartials("data.bin", []*storage.Partial{{OffsetFrom: 2, OffsetTo: 8}})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("234567"), grown[0])
+		assert.Equal(t, []byte("X123"), first[0], "mappings share the pages of the file")
+
+		after, err := s.ReadAfter("data.bin", 6)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("67"), after)
+	})
+
+	t.Run("success - growth within the capacity keeps the mapping", func(t *testing.T) {
+		disk, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+		s, err := storage.NewMapped(disk)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, s.Close()) }()
+
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("0123")))
+		first, err := s.ReadAfter("data.bin", 0)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, s.Append("data.bin", []byte("4567")))
+		}
+		grown, err := s.ReadAfter("data.bin", 0)
+		require.NoError(t, err)
+		assert.Len(t, grown, 404)
+		assert.Same(t, &first[0], &grown[0])
+	})
+
+	t.Run("success - pinned reads keep replaced mappings readable until released", func(t *testing.T) {
+		disk, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+		s, err := storage.NewMapped(disk)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, s.Close()) }()
+
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("old contents")))
+		pinned, release := s.Pin()
+		old, err := pinned.ReadAfter("data.bin", 0)
+		require.NoError(t, err)
+		defer func() { assert.NoError(t, release()) }()
+
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("new")))
+		current, err := s.ReadAfter("data.bin", 0)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("new"), current)
+		assert.Equal(t, []byte("old contents"), old)
+	})
+
+	t.Run("fail - not a disk storage", func(t *testing.T) {
+		_, err := storage.NewMapped(storage.NewMemory())
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+// mmapFile maps the first size bytes of the file read-only, the mapping stays valid after the file is closed. The
+// size may exceed the size of the file, the pages past its end must not be read until the file grew past them.
+func mmapFile(path string, size int64) ([]byte, error) {
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
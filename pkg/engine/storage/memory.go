@@ -0,0 +1,442 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const memoryRootPath = ":memory:"
+
+// NewMemory returns a Storage that keeps all of its files and layers in memory.
+func NewMemory() Storage {
+	return &memory{
+		mu:    &sync.RWMutex{},
+		path:  memoryRootPath,
+		node:  newMemoryNode(),
+		locks: make(map[string]*memoryLock),
+	}
+}
+
+type memory struct {
+	// mu is shared between all layers of the same root
+	mu   *sync.RWMutex
+	path string
+	node *memoryNode
+	// locks holds the locks of all layers of the same root by their path
+	locks map[string]*memoryLock
+}
+
+// memoryLock is the state of the lock of a layer, it is only ever shared within the process.
+type memoryLock struct {
+	shared    int
+	exclusive bool
+}
+
+type memoryNode struct {
+	files  map[string]*memoryFile
+	layers map[string]*memoryNode
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryNode() *memoryNode {
+	return &memoryNode{
+		files:  make(map[string]*memoryFile),
+		layers: make(map[string]*memoryNode),
+	}
+}
+
+func (m *memory) NewLayer(path string) (Storage, error) {
+	if err := validateLayerPath(path); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.node.files[path]; found {
+		return nil, errors.Errorf("could not create storager=[path=%s] file already exists", m.pathToFile(path))
+	}
+	node, found := m.node.layers[path]
+	if !found {
+		node = newMemoryNode()
+		m.node.layers[path] = node
+	}
+
+	return &memory{
+		mu:    m.mu,
+		path:  m.pathToFile(path),
+		node:  node,
+		locks: m.locks,
+	}, nil
+}
+
+func (m *memory) RemoveLayer(path string) error {
+	if err := validateLayerPath(path); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.node.layers[path]; !found {
+		return errors.Wrapf(&os.PathError{Op: "remove", Path: m.pathToFile(path), Err: os.ErrNotExist}, "could not remove storager=[path=%s]", m.pathToFile(path))
+	}
+	delete(m.node.layers, path)
+	return nil
+}
+
+func (m *memory) Path() string {
+	return m.path
+}
+
+func (m *memory) Close() error {
+	return nil
+}
+
+func (m *memory) Lock(mode LockMode) (FileLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, found := m.locks[m.path]
+	if !found {
+		state = &memoryLock{}
+		m.locks[m.path] = state
+	}
+	if state.exclusive || (mode == LockExclusive && state.shared > 0) {
+		return nil, &LockedError{Path: m.path, Mode: mode, PID: os.Getpid()}
+	}
+
+	if mode == LockExclusive {
+		state.exclusive = true
+	} else {
+		state.shared++
+	}
+	return &memoryFileLock{memory: m, mode: mode}, nil
+}
+
+type memoryFileLock struct {
+	memory *memory
+	mode   LockMode
+	once   sync.Once
+}
+
+func (l *memoryFileLock) Unlock() error {
+	l.once.Do(func() {
+		l.memory.mu.Lock()
+		defer l.memory.mu.Unlock()
+
+		state := l.memory.locks[l.memory.path]
+		if l.mode == LockExclusive {
+			state.exclusive = false
+		} else {
+			state.shared--
+		}
+	})
+	return nil
+}
+
+func (m *memory) Info(filename string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, err := m.file("stat", filename)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryFileInfo{name: filename, size: int64(len(file.data)), modTime: file.modTime}, nil
+}
+
+func (m *memory) Exists(name string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, file := m.node.files[name]
+	_, layer := m.node.layers[name]
+	return file || layer, nil
+}
+
+func (m *memory) ReadAll(filename string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, err := m.file("open", filename)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, file.data...), nil
+}
+
+func (m *memory) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, err := m.file("open", filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", m.errorDescriptor(filename))
+	}
+
+	res := make([][]byte, len(partials))
+	for i, partial := range partials {
+		if partial.OffsetFrom < 0 || partial.OffsetTo > int64(len(file.data)) {
+			return nil, errors.Wrapf(io.EOF, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", m.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+		res[i] = append([]byte{}, file.data[partial.OffsetFrom:partial.OffsetTo]...)
+	}
+
+	return res, nil
+}
+
+func (m *memory) ReadAfter(filename string, offset int64) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, err := m.file("open", filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", m.errorDescriptor(filename))
+	}
+	if offset < 0 {
+		return nil, errors.Errorf("%s could not skip file data to offset [offset=%d]", m.errorDescriptor(filename), offset)
+	}
+
+	return append([]byte{}, file.data[min(offset, int64(len(file.data))):]...), nil
+}
+
+func (m *memory) ReadBefore(filename string, offset int64) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, err := m.file("open", filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", m.errorDescriptor(filename))
+	}
+	if offset > 0 && len(file.data) == 0 {
+		return nil, errors.Wrapf(io.EOF, "%s could not read data to offset [offset=%d]", m.errorDescriptor(filename), offset)
+	}
+
+	res := make([]byte, offset)
+	copy(res, file.data)
+	return res, nil
+}
+
+func (m *memory) List(filters ...FileFilter) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := make([]os.DirEntry, 0, len(m.node.files)+len(m.node.layers))
+	for name, file := range m.node.files {
+		entries = append(entries, fs.FileInfoToDirEntry(&memoryFileInfo{name: name, size: int64(len(file.data)), modTime: file.modTime}))
+	}
+	for name := range m.node.layers {
+		entries = append(entries, fs.FileInfoToDirEntry(&memoryFileInfo{name: name, dir: true}))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	matches := make([]string, 0, len(entries))
+EntryLoop:
+	for _, entry := range entries {
+		for _, filter := range filters {
+			filterRes, err := filter(entry)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s filter failed on entry=[name=%s]", m.errorDescriptor(""), entry.Name())
+			}
+			if !filterRes {
+				continue EntryLoop
+			}
+		}
+		matches = append(matches, entry.Name())
+	}
+
+	return matches, nil
+}
+
+func (m *memory) CreateOrOverride(filename string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.node.layers[filename]; found {
+		return errors.Errorf("%s could not open file, is a layer", m.errorDescriptor(filename))
+	}
+	m.node.files[filename] = &memoryFile{data: append([]byte{}, data...), modTime: time.Now()}
+	return nil
+}
+
+func (m *memory) Append(filename string, data []byte, _ ...WriteOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := m.file("open", filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open file", m.errorDescriptor(filename))
+	}
+	file.data = append(file.data, data...)
+	file.modTime = time.Now()
+	return nil
+}
+
+func (m *memory) Offset(filename string, offset int64, data []byte, _ ...WriteOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := m.file("open", filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open file", m.errorDescriptor(filename))
+	}
+	if offset < 0 {
+		return errors.Errorf("%s could not write to file at offset [offset=%d]", m.errorDescriptor(filename), offset)
+	}
+	if end := offset + int64(len(data)); end > int64(len(file.data)) {
+		file.data = append(file.data, make([]byte, end-int64(len(file.data)))...)
+	}
+	copy(file.data[offset:], data)
+	file.modTime = time.Now()
+	return nil
+}
+
+func (m *memory) Replace(filename string, partial *Partial, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := m.file("open", filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file", m.errorDescriptor(filename))
+	}
+	file.data = replacePartial(file.data, partial, data)
+	file.modTime = time.Now()
+	return nil
+}
+
+// WriteBatch always applies the batch atomically.
+func (m *memory) WriteBatch(filename string, batch *Batch, _ ...WriteOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := m.file("open", filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open file", m.errorDescriptor(filename))
+	}
+	data, err := batch.apply(file.data)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not apply batch", m.errorDescriptor(filename))
+	}
+	file.data = data
+	file.modTime = time.Now()
+	return nil
+}
+
+func (m *memory) Delete(filename string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.file("remove", filename); err != nil {
+		return errors.Wrapf(err, "%s could not delete file", m.errorDescriptor(filename))
+	}
+	delete(m.node.files, filename)
+	return nil
+}
+
+func (m *memory) Rename(from string, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if node, found := m.node.layers[from]; found {
+		if _, found := m.node.files[to]; found {
+			return errors.Errorf("%s could not rename layer [to=%s], is a file", m.errorDescriptor(from), to)
+		}
+		if existing, found := m.node.layers[to]; found && (len(existing.files) != 0 || len(existing.layers) != 0) {
+			return errors.Errorf("%s could not rename layer [to=%s], layer is not empty", m.errorDescriptor(from), to)
+		}
+		delete(m.node.layers, from)
+		m.node.layers[to] = node
+		return nil
+	}
+
+	file, err := m.file("rename", from)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not rename file [to=%s]", m.errorDescriptor(from), to)
+	}
+	if _, found := m.node.layers[to]; found {
+		return errors.Errorf("%s could not rename file [to=%s], is a layer", m.errorDescriptor(from), to)
+	}
+	delete(m.node.files, from)
+	m.node.files[to] = file
+	return nil
+}
+
+func (m *memory) Sync(filename string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, err := m.file("open", filename); err != nil {
+		return errors.Wrapf(err, "%s could not open file", m.errorDescriptor(filename))
+	}
+	return nil
+}
+
+// file returns the file with the given name, the caller must hold the lock.
+func (m *memory) file(op string, filename string) (*memoryFile, error) {
+	file, found := m.node.files[filename]
+	if !found {
+		return nil, &os.PathError{Op: op, Path: m.pathToFile(filename), Err: os.ErrNotExist}
+	}
+	return file, nil
+}
+
+func (m *memory) pathToFile(filename string) string {
+	return fmt.Sprintf("%s%c%s", m.path, filepath.Separator, filename)
+}
+
+func (m *memory) errorDescriptor(filename string) string {
+	if filename == "" {
+		return fmt.Sprintf("(file=[path=%s])", m.path)
+	}
+	return fmt.Sprintf("(file=[filename=%s, path=%s])", filename, m.path)
+}
+
+// memoryFileInfo is the synthetic os.FileInfo of the files and layers of a memory storage.
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memoryFileInfo) Name() string {
+	return i.name
+}
+
+func (i *memoryFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memoryFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *memoryFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *memoryFileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i *memoryFileInfo) Sys() any {
+	return nil
+}
@@ -0,0 +1,23 @@
+package storage
+
+// Op names an operation of a Storage.
+type Op string
+
+const (
+	OpInfo             Op = "Info"
+	OpExists           Op = "Exists"
+	OpReadAll          Op = "ReadAll"
+	OpReadPartials     Op = "ReadPartials"
+	OpReadAfter        Op = "ReadAfter"
+	OpReadBefore       Op = "ReadBefore"
+	OpList             Op = "List"
+	OpCreateOrOverride Op = "CreateOrOverride"
+	OpAppend           Op = "Append"
+	OpOffset           Op = "Offset"
+	OpReplace          Op = "Replace"
+	OpWriteBatch       Op = "WriteBatch"
+	OpDelete           Op = "Delete"
+	OpRename           Op = "Rename"
+	OpRemoveLayer      Op = "RemoveLayer"
+	OpSync             Op = "Sync"
+)
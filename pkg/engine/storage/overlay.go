@@ -0,0 +1,921 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/sys"
+)
+
+const overlayBlocksSuffix = ".overlay"
+const overlayWhiteoutSuffix = ".whiteout"
+
+// overlayOpaqueFilename marks a layer of the upper storage that replaces a removed lower layer of the same path.
+const overlayOpaqueFilename = ".overlay.opaque"
+
+// NewOverlay returns a Storage that presents the files of the upper storage on top of the files of the lower one.
+// Reads fall through to the lower storage, writes only ever go to the upper storage: the blocks of blockSize bytes
+// touched by a write are copied up and the lower file is never modified, deleted files are hidden by whiteouts.
+// The lower storage should be read-only, see NewReadOnly, its layers are never written but may get created.
+//
+// Removed layers are hidden by whiteouts as well, a layer created again in place of a removed one hides the lower
+// layer completely.
+//
+// The upper storage holds the copied up blocks at their offsets in a file of the same name, together with a block
+// map recording which blocks of the file it holds. A file and its block map are not updated atomically, the overlay
+// is meant for short-lived branches that get discarded or merged rather than for crash-safe storage.
+func NewOverlay(upper Storage, lower Storage, blockSize int64) (*Overlay, error) {
+	if blockSize < 1 {
+		return nil, errors.Errorf("invalid block size [size=%d]", blockSize)
+	}
+	return &Overlay{
+		mu:        &sync.Mutex{},
+		upper:     upper,
+		lower:     lower,
+		blockSize: blockSize,
+	}, nil
+}
+
+type Overlay struct {
+	// mu is shared between all layers of the same overlay
+	mu        *sync.Mutex
+	upper     Storage
+	lower     Storage
+	blockSize int64
+}
+
+// overlayBlocks is the block map of a file copied up to the upper storage.
+type overlayBlocks struct {
+	size int64
+	// present holds a bit for every block of the file, set if the block is held by the upper storage
+	present []byte
+}
+
+func (b *overlayBlocks) Bytes() []byte {
+	return sys.ConcatSlices(
+		sys.New(sys.Int64AsBytes(b.size)),
+		sys.New(b.present),
+	)
+}
+
+func (b *overlayBlocks) Load(payload []byte) error {
+	payloads, err := sys.ReadAll(payload)
+	if err != nil {
+		return errors.Wrap(err, "deserialization failed")
+	}
+	if len(payloads) != 2 { // The payload of the block map persists of 2 different sections, one for each field
+		return errors.New("corrupted payload")
+	}
+	if b.size, err = sys.BytesAsInt64(payloads[0]); err != nil {
+		return errors.Wrap(err, "could not load size")
+	}
+	b.present = payloads[1]
+	return nil
+}
+
+func (b *overlayBlocks) has(index int64) bool {
+	return index/8 < int64(len(b.present)) && b.present[index/8]&(1<<(index%8)) != 0
+}
+
+// mark sets the blocks between the indexes inclusive as present.
+func (b *overlayBlocks) mark(first int64, last int64) {
+	if need := last/8 + 1; need > int64(len(b.present)) {
+		b.present = append(b.present, make([]byte, need-int64(len(b.present)))...)
+	}
+	for index := first; index <= last; index++ {
+		b.present[index/8] |= 1 << (index % 8)
+	}
+}
+
+// truncate clears the blocks from the given index on.
+func (b *overlayBlocks) truncate(from int64) {
+	for index := from; index/8 < int64(len(b.present)); index++ {
+		b.present[index/8] &^= 1 << (index % 8)
+	}
+}
+
+func (o *Overlay) NewLayer(path string) (Storage, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.newLayer(path)
+}
+
+// newLayer opens the layer, replacing the removed lower layer if the path is whited out, the caller must hold
+// the lock.
+func (o *Overlay) newLayer(path string) (*Overlay, error) {
+	whiteout, err := o.upper.Exists(overlayWhiteoutFile(path))
+	if err != nil {
+		return nil, err
+	}
+	upper, err := o.upper.NewLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	if whiteout {
+		if err := upper.CreateOrOverride(overlayOpaqueFilename, nil); err != nil {
+			return nil, errors.Wrapf(err, "%s could not mark layer as opaque", o.errorDescriptor(path))
+		}
+		if err := o.removeWhiteout(path); err != nil {
+			return nil, err
+		}
+	}
+
+	opaque, err := upper.Exists(overlayOpaqueFilename)
+	if err != nil {
+		return nil, err
+	}
+	var lower Storage
+	if opaque {
+		lower = NewMemory()
+	} else if lower, err = o.lower.NewLayer(path); err != nil {
+		return nil, err
+	}
+	return &Overlay{mu: o.mu, upper: upper, lower: lower, blockSize: o.blockSize}, nil
+}
+
+// RemoveLayer removes the layer from the upper storage and hides the lower layer of the same path behind a whiteout.
+func (o *Overlay) RemoveLayer(path string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.removeLayer(path)
+}
+
+// removeLayer removes the layer, the caller must hold the lock.
+func (o *Overlay) removeLayer(path string) error {
+	if err := validateLayerPath(path); err != nil {
+		return err
+	}
+	upper, err := o.upper.Exists(path)
+	if err != nil {
+		return err
+	}
+	lower, err := o.lowerExists(path)
+	if err != nil {
+		return err
+	}
+	if whiteout, err := o.upper.Exists(overlayWhiteoutFile(path)); err != nil {
+		return err
+	} else if whiteout {
+		lower = false
+	}
+	if !upper && !lower {
+		return errors.Wrapf(&os.PathError{Op: "remove", Path: o.pathToFile(path), Err: os.ErrNotExist}, "could not remove storager=[path=%s]", o.pathToFile(path))
+	}
+
+	if upper {
+		if err := o.upper.RemoveLayer(path); err != nil {
+			return err
+		}
+	}
+	if lower {
+		return o.upper.CreateOrOverride(overlayWhiteoutFile(path), nil)
+	}
+	return nil
+}
+
+func (o *Overlay) Path() string {
+	return o.upper.Path()
+}
+
+func (o *Overlay) Close() error {
+	if err := o.upper.Close(); err != nil {
+		return err
+	}
+	return o.lower.Close()
+}
+
+func (o *Overlay) Lock(mode LockMode) (FileLock, error) {
+	return o.upper.Lock(mode)
+}
+
+func (o *Overlay) Info(filename string) (os.FileInfo, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks, err := o.blocks("stat", filename)
+	if err != nil {
+		return nil, err
+	}
+	if blocks == nil {
+		return o.lower.Info(filename)
+	}
+	info, err := o.upper.Info(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedFileInfo{FileInfo: info, size: blocks.size}, nil
+}
+
+func (o *Overlay) Exists(name string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.exists(name)
+}
+
+// exists reports whether the file or layer exists in either storage and is not whited out, the caller must hold
+// the lock.
+func (o *Overlay) exists(name string) (bool, error) {
+	if whiteout, err := o.upper.Exists(overlayWhiteoutFile(name)); err != nil || whiteout {
+		return false, err
+	}
+	if upper, err := o.upper.Exists(name); err != nil || upper {
+		return upper, err
+	}
+	return o.lowerExists(name)
+}
+
+// lowerExists reports whether the file or layer exists in the lower storage, ignoring whiteouts.
+func (o *Overlay) lowerExists(name string) (bool, error) {
+	exists, err := o.lower.Exists(name)
+	if err != nil && errors.Is(err, os.ErrNotExist) { // A layer created through the overlay may not exist below it
+		return false, nil
+	}
+	return exists, err
+}
+
+func (o *Overlay) ReadAll(filename string) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks, err := o.blocks("open", filename)
+	if err != nil {
+		return nil, err
+	}
+	if blocks == nil {
+		return o.lower.ReadAll(filename)
+	}
+	return o.read(filename, blocks, 0, blocks.size)
+}
+
+func (o *Overlay) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks, err := o.blocks("open", filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", o.errorDescriptor(filename))
+	}
+	if blocks == nil {
+		return o.lower.ReadPartials(filename, partials)
+	}
+
+	res := make([][]byte, len(partials))
+	for i, partial := range partials {
+		if partial.OffsetFrom < 0 || partial.OffsetTo > blocks.size {
+			return nil, errors.Wrapf(io.EOF, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", o.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+		res[i], err = o.read(filename, blocks, partial.OffsetFrom, partial.OffsetTo)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", o.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
+		}
+	}
+	return res, nil
+}
+
+func (o *Overlay) ReadAfter(filename string, offset int64) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks, err := o.blocks("open", filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", o.errorDescriptor(filename))
+	}
+	if blocks == nil {
+		return o.lower.ReadAfter(filename, offset)
+	}
+	if offset < 0 {
+		return nil, errors.Errorf("%s could not skip file data to offset [offset=%d]", o.errorDescriptor(filename), offset)
+	}
+	return o.read(filename, blocks, min(offset, blocks.size), blocks.size)
+}
+
+func (o *Overlay) ReadBefore(filename string, offset int64) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks, err := o.blocks("open", filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", o.errorDescriptor(filename))
+	}
+	if blocks == nil {
+		return o.lower.ReadBefore(filename, offset)
+	}
+	if offset > 0 && blocks.size == 0 {
+		return nil, errors.Wrapf(io.EOF, "%s could not read data to offset [offset=%d]", o.errorDescriptor(filename), offset)
+	}
+
+	data, err := o.read(filename, blocks, 0, min(offset, blocks.size))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read data to offset [offset=%d]", o.errorDescriptor(filename), offset)
+	}
+	res := make([]byte, offset)
+	copy(res, data)
+	return res, nil
+}
+
+func (o *Overlay) List(filters ...FileFilter) ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	all, err := o.upper.List()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not list upper storage", o.errorDescriptor(""))
+	}
+	hidden := make(map[string]struct{})
+	for _, name := range all {
+		if filename, found := overlayFilename(name, overlayWhiteoutSuffix); found {
+			hidden[filename] = struct{}{}
+		}
+	}
+
+	upper, err := o.upper.List(append([]FileFilter{isNotOverlayFileFilter}, filters...)...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not list upper storage", o.errorDescriptor(""))
+	}
+	lower, err := o.lower.List(filters...)
+	if err != nil && !errors.Is(err, os.ErrNotExist) { // A layer created through the overlay may not exist below it
+		return nil, errors.Wrapf(err, "%s could not list lower storage", o.errorDescriptor(""))
+	}
+
+	res := append([]string{}, upper...)
+	for _, name := range upper {
+		hidden[name] = struct{}{}
+	}
+	for _, name := range lower {
+		if _, found := hidden[name]; !found {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (o *Overlay) CreateOrOverride(filename string, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.upper.CreateOrOverride(filename, data); err != nil {
+		return err
+	}
+	blocks := &overlayBlocks{size: int64(len(data))}
+	if len(data) != 0 {
+		blocks.mark(0, (blocks.size-1)/o.blockSize)
+	}
+	if err := o.saveBlocks(filename, blocks); err != nil {
+		return err
+	}
+	return o.removeWhiteout(filename)
+}
+
+func (o *Overlay) Append(filename string, data []byte, opts ...WriteOption) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks, err := o.copyUpBlocks(filename)
+	if err != nil {
+		return err
+	}
+	return o.write(filename, blocks, blocks.size, data, opts)
+}
+
+func (o *Overlay) Offset(filename string, offset int64, data []byte, opts ...WriteOption) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if offset < 0 {
+		return errors.Errorf("%s could not write to file at offset [offset=%d]", o.errorDescriptor(filename), offset)
+	}
+	blocks, err := o.copyUpBlocks(filename)
+	if err != nil {
+		return err
+	}
+	return o.write(filename, blocks, offset, data, opts)
+}
+
+// Replace copies up and rewrites the blocks from the one holding the start of the partial to the end of the file.
+func (o *Overlay) Replace(filename string, partial *Partial, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks, err := o.copyUpBlocks(filename)
+	if err != nil {
+		return err
+	}
+
+	first := min(partial.OffsetFrom, blocks.size) / o.blockSize
+	start := first * o.blockSize
+	tail, err := o.read(filename, blocks, start, blocks.size)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file", o.errorDescriptor(filename))
+	}
+	tail = replacePartial(tail, &Partial{OffsetFrom: partial.OffsetFrom - start, OffsetTo: partial.OffsetTo - start}, data)
+
+	if err := o.upper.Offset(filename, start, tail); err != nil {
+		return err
+	}
+	blocks.size = start + int64(len(tail))
+	blocks.truncate(first)
+	if len(tail) != 0 {
+		blocks.mark(first, (blocks.size-1)/o.blockSize)
+	}
+	return o.saveBlocks(filename, blocks)
+}
+
+func (o *Overlay) WriteBatch(filename string, batch *Batch, opts ...WriteOption) error {
+	if err := writeBatch(o, filename, batch, opts); err != nil {
+		return errors.Wrapf(err, "%s could not write batch", o.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (o *Overlay) Delete(filename string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.delete(filename)
+}
+
+// delete removes the file from the upper storage and hides the lower one, the caller must hold the lock.
+func (o *Overlay) delete(filename string) error {
+	blocks, err := o.blocks("remove", filename)
+	if err != nil {
+		return err
+	}
+	if blocks != nil {
+		if err := o.upper.Delete(filename); err != nil {
+			return err
+		}
+		if err := o.upper.Delete(overlayBlocksFile(filename)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := o.lower.Info(filename); err != nil {
+		if blocks == nil {
+			return err
+		}
+		return nil
+	}
+	return o.upper.CreateOrOverride(overlayWhiteoutFile(filename), nil)
+}
+
+// Rename copies the file or the layer to the new name and removes it from the old one, unlike the rename of other
+// storages it is therefore not atomic.
+func (o *Overlay) Rename(from string, to string) error {
+	o.mu.Lock()
+	isLayer, err := o.isRenamedLayer(from, to)
+	if err != nil || !isLayer {
+		if err == nil {
+			err = o.renameFile(from, to)
+		}
+		o.mu.Unlock()
+		return err
+	}
+	o.mu.Unlock()
+
+	// The layers are copied through the overlay itself, which takes the lock for every file
+	if err := o.RemoveLayer(to); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "%s could not rename layer [to=%s]", o.errorDescriptor(from), to)
+	}
+	source, err := o.NewLayer(from)
+	if err != nil {
+		return err
+	}
+	target, err := o.NewLayer(to)
+	if err != nil {
+		return err
+	}
+	if err := copyStorage(source, target); err != nil {
+		return errors.Wrapf(err, "%s could not copy layer [to=%s]", o.errorDescriptor(from), to)
+	}
+	return o.RemoveLayer(from)
+}
+
+// isRenamedLayer reports whether the name to be renamed is a layer, it fails if it does not exist. The caller must
+// hold the lock.
+func (o *Overlay) isRenamedLayer(from string, to string) (bool, error) {
+	if exists, err := o.exists(from); err != nil {
+		return false, err
+	} else if !exists {
+		return false, errors.Wrapf(&os.PathError{Op: "rename", Path: o.pathToFile(from), Err: os.ErrNotExist}, "%s could not rename file [to=%s]", o.errorDescriptor(from), to)
+	}
+	return o.isLayer(from)
+}
+
+// renameFile moves the file by writing its merged contents to the new name, the caller must hold the lock.
+func (o *Overlay) renameFile(from string, to string) error {
+	blocks, err := o.blocks("open", from)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if blocks == nil {
+		data, err = o.lower.ReadAll(from)
+	} else {
+		data, err = o.read(from, blocks, 0, blocks.size)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read file", o.errorDescriptor(from))
+	}
+
+	if err := o.upper.CreateOrOverride(to, data); err != nil {
+		return err
+	}
+	target := &overlayBlocks{size: int64(len(data))}
+	if len(data) != 0 {
+		target.mark(0, (target.size-1)/o.blockSize)
+	}
+	if err := o.saveBlocks(to, target); err != nil {
+		return err
+	}
+	if err := o.removeWhiteout(to); err != nil {
+		return err
+	}
+	return o.delete(from)
+}
+
+func (o *Overlay) Sync(filename string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks, err := o.blocks("sync", filename)
+	if err != nil {
+		return err
+	}
+	if blocks == nil {
+		_, err := o.lower.Info(filename) // The lower file is never written, there is nothing to flush
+		return err
+	}
+	return o.upper.Sync(filename)
+}
+
+// Discard removes everything written to the overlay, leaving the lower storage as the only contents.
+func (o *Overlay) Discard() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := clearStorage(o.upper); err != nil {
+		return errors.Wrapf(err, "%s could not clear upper storage", o.errorDescriptor(""))
+	}
+	return nil
+}
+
+// Merge applies everything written to the overlay to the target and discards it. The target has to hold the same
+// contents as the lower storage, usually it is a writable storage of the same path.
+func (o *Overlay) Merge(target Storage) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.merge(target); err != nil {
+		return errors.Wrapf(err, "%s could not merge", o.errorDescriptor(""))
+	}
+	if err := clearStorage(o.upper); err != nil {
+		return errors.Wrapf(err, "%s could not clear upper storage", o.errorDescriptor(""))
+	}
+	return nil
+}
+
+// merge applies the contents of the upper storage to the target, the caller must hold the lock.
+func (o *Overlay) merge(target Storage) error {
+	names, err := o.upper.List()
+	if err != nil {
+		return errors.Wrap(err, "could not list upper storage")
+	}
+	layers, err := o.upper.List(IsDirFilter)
+	if err != nil {
+		return errors.Wrap(err, "could not list upper storage")
+	}
+	isLayer := make(map[string]struct{}, len(layers))
+	for _, name := range layers {
+		isLayer[name] = struct{}{}
+	}
+
+	for _, name := range names {
+		if _, found := isLayer[name]; found {
+			if err := o.mergeLayer(target, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if filename, found := overlayFilename(name, overlayWhiteoutSuffix); found {
+			if err := removeFromTarget(target, filename); err != nil {
+				return errors.Wrapf(err, "could not delete file [filename=%s]", filename)
+			}
+			continue
+		}
+		if filename, found := overlayFilename(name, overlayBlocksSuffix); found {
+			if err := o.mergeFile(target, filename); err != nil {
+				return errors.Wrapf(err, "could not merge file [filename=%s]", filename)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *Overlay) mergeLayer(target Storage, path string) error {
+	layer, err := o.newLayer(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not open layer [path=%s]", path)
+	}
+	if opaque, err := layer.upper.Exists(overlayOpaqueFilename); err != nil {
+		return err
+	} else if opaque {
+		if err := removeFromTarget(target, path); err != nil {
+			return errors.Wrapf(err, "could not remove target layer [path=%s]", path)
+		}
+	}
+	targetLayer, err := target.NewLayer(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not open target layer [path=%s]", path)
+	}
+	return layer.merge(targetLayer)
+}
+
+// mergeFile writes the blocks held by the upper storage into the target, the whole file is written if it shrank.
+func (o *Overlay) mergeFile(target Storage, filename string) error {
+	blocks, err := o.blocks("open", filename)
+	if err != nil {
+		return err
+	}
+
+	info, err := target.Info(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err != nil || info.Size() > blocks.size {
+		data, err := o.read(filename, blocks, 0, blocks.size)
+		if err != nil {
+			return err
+		}
+		return target.CreateOrOverride(filename, data)
+	}
+
+	for first := int64(0); first*o.blockSize < blocks.size; first++ {
+		if !blocks.has(first) {
+			continue
+		}
+		last := first
+		for (last+1)*o.blockSize < blocks.size && blocks.has(last+1) {
+			last++
+		}
+		from, to := first*o.blockSize, min((last+1)*o.blockSize, blocks.size)
+		data, err := o.upper.ReadPartials(filename, []*Partial{{OffsetFrom: from, OffsetTo: to}})
+		if err != nil {
+			return err
+		}
+		if err := target.Offset(filename, from, data[0]); err != nil {
+			return err
+		}
+		first = last
+	}
+	return target.Sync(filename)
+}
+
+// blocks returns the block map of the file, it is nil if the file was never written through the overlay.
+// A whiteout file is reported as not existing.
+func (o *Overlay) blocks(op string, filename string) (*overlayBlocks, error) {
+	if _, err := o.upper.Info(overlayWhiteoutFile(filename)); err == nil {
+		return nil, &os.PathError{Op: op, Path: o.pathToFile(filename), Err: os.ErrNotExist}
+	}
+
+	payload, err := o.upper.ReadAll(overlayBlocksFile(filename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "could not read block map")
+	}
+	blocks := &overlayBlocks{}
+	if err := blocks.Load(payload); err != nil {
+		return nil, errors.Wrap(err, "could not load block map")
+	}
+	return blocks, nil
+}
+
+// copyUpBlocks returns the block map of the file, creating an empty one for a file that is only held by the lower
+// storage so far.
+func (o *Overlay) copyUpBlocks(filename string) (*overlayBlocks, error) {
+	blocks, err := o.blocks("open", filename)
+	if err != nil || blocks != nil {
+		return blocks, err
+	}
+
+	info, err := o.lower.Info(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.upper.CreateOrOverride(filename, nil); err != nil {
+		return nil, err
+	}
+	return &overlayBlocks{size: info.Size()}, nil
+}
+
+// write writes the data at offset by copying up every block it touches, the gap between the end of the file and the
+// offset is filled with zeros.
+func (o *Overlay) write(filename string, blocks *overlayBlocks, offset int64, data []byte, opts []WriteOption) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	end := offset + int64(len(data))
+	first, last := min(offset, blocks.size)/o.blockSize, (end-1)/o.blockSize
+	start := first * o.blockSize
+
+	buf := make([]byte, min(max(blocks.size, end), (last+1)*o.blockSize)-start)
+	existing, err := o.read(filename, blocks, min(start, blocks.size), min(start+int64(len(buf)), blocks.size))
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read blocks", o.errorDescriptor(filename))
+	}
+	copy(buf, existing)
+	copy(buf[offset-start:], data)
+
+	if err := o.upper.Offset(filename, start, buf, opts...); err != nil {
+		return err
+	}
+	blocks.size = max(blocks.size, end)
+	blocks.mark(first, last)
+	return o.saveBlocks(filename, blocks)
+}
+
+// read returns the data between the offsets, reading every run of blocks from the storage holding it.
+func (o *Overlay) read(filename string, blocks *overlayBlocks, from int64, to int64) ([]byte, error) {
+	res := make([]byte, to-from)
+	if from >= to {
+		return res, nil
+	}
+
+	lowerSize := int64(0)
+	if info, err := o.lower.Info(filename); err == nil {
+		lowerSize = min(info.Size(), blocks.size)
+	}
+
+	for offset := from; offset < to; {
+		index := offset / o.blockSize
+		upper := blocks.has(index)
+		runEnd := min((index+1)*o.blockSize, to)
+		for runEnd < to && blocks.has(runEnd/o.blockSize) == upper {
+			runEnd = min(runEnd+o.blockSize, to)
+		}
+
+		source, sourceEnd := o.upper, runEnd
+		if !upper {
+			source, sourceEnd = o.lower, min(runEnd, lowerSize)
+		}
+		if offset < sourceEnd {
+			data, err := source.ReadPartials(filename, []*Partial{{OffsetFrom: offset, OffsetTo: sourceEnd}})
+			if err != nil {
+				return nil, err
+			}
+			copy(res[offset-from:], data[0])
+		}
+		offset = runEnd
+	}
+	return res, nil
+}
+
+func (o *Overlay) saveBlocks(filename string, blocks *overlayBlocks) error {
+	if err := o.upper.CreateOrOverride(overlayBlocksFile(filename), blocks.Bytes()); err != nil {
+		return errors.Wrapf(err, "%s could not write block map", o.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (o *Overlay) removeWhiteout(filename string) error {
+	if err := o.upper.Delete(overlayWhiteoutFile(filename)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "%s could not remove whiteout", o.errorDescriptor(filename))
+	}
+	return nil
+}
+
+// isLayer reports whether the existing name is a layer, the caller must hold the lock.
+func (o *Overlay) isLayer(name string) (bool, error) {
+	if layer, err := hasLayer(o.upper, name); err != nil || layer {
+		return layer, err
+	}
+	layer, err := hasLayer(o.lower, name)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return layer, err
+}
+
+func (o *Overlay) pathToFile(filename string) string {
+	return fmt.Sprintf("%s%c%s", o.Path(), filepath.Separator, filename)
+}
+
+func (o *Overlay) errorDescriptor(filename string) string {
+	if filename == "" {
+		return fmt.Sprintf("(overlay=[path=%s])", o.Path())
+	}
+	return fmt.Sprintf("(overlay=[filename=%s, path=%s])", filename, o.Path())
+}
+
+// clearStorage deletes all files of the storage and of all layers below it.
+func clearStorage(s Storage) error {
+	layers, err := s.List(IsDirFilter)
+	if err != nil {
+		return err
+	}
+	for _, path := range layers {
+		layer, err := s.NewLayer(path)
+		if err != nil {
+			return err
+		}
+		if err := clearStorage(layer); err != nil {
+			return err
+		}
+	}
+
+	files, err := s.List(IsFileFilter)
+	if err != nil {
+		return err
+	}
+	for _, filename := range files {
+		if err := s.Delete(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyStorage writes all files and layers of the source storage into the target.
+func copyStorage(source Storage, target Storage) error {
+	layers, err := source.List(IsDirFilter)
+	if err != nil {
+		return err
+	}
+	for _, path := range layers {
+		sourceLayer, err := source.NewLayer(path)
+		if err != nil {
+			return err
+		}
+		targetLayer, err := target.NewLayer(path)
+		if err != nil {
+			return err
+		}
+		if err := copyStorage(sourceLayer, targetLayer); err != nil {
+			return err
+		}
+	}
+
+	files, err := source.List(IsFileFilter)
+	if err != nil {
+		return err
+	}
+	for _, filename := range files {
+		data, err := source.ReadAll(filename)
+		if err != nil {
+			return err
+		}
+		if err := target.CreateOrOverride(filename, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFromTarget removes the file or the layer of the given name from the target if it exists.
+func removeFromTarget(target Storage, name string) error {
+	if exists, err := target.Exists(name); err != nil || !exists {
+		return err
+	}
+	if layer, err := hasLayer(target, name); err != nil {
+		return err
+	} else if layer {
+		return target.RemoveLayer(name)
+	}
+	return target.Delete(name)
+}
+
+func overlayBlocksFile(filename string) string {
+	return "." + filename + overlayBlocksSuffix
+}
+
+func overlayWhiteoutFile(filename string) string {
+	return "." + filename + overlayWhiteoutSuffix
+}
+
+// overlayFilename returns the name of the file the overlay file with the given suffix belongs to.
+func overlayFilename(name string, suffix string) (string, bool) {
+	if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, suffix) || len(name) <= len(suffix)+1 {
+		return "", false
+	}
+	return name[1 : len(name)-len(suffix)], true
+}
+
+func isNotOverlayFileFilter(entry fs.DirEntry) (bool, error) {
+	_, blocks := overlayFilename(entry.Name(), overlayBlocksSuffix)
+	_, whiteout := overlayFilename(entry.Name(), overlayWhiteoutSuffix)
+	return !blocks && !whiteout && entry.Name() != overlayOpaqueFilename, nil
+}
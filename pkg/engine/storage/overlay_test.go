@@ -0,0 +1,118 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func newOverlay(t *testing.T) (*storage.Overlay, storage.Storage, storage.Storage) {
+	lower := storage.NewMemory()
+	require.NoError(t, lower.CreateOrOverride("data.bin", []byte("0123456789")))
+	require.NoError(t, lower.CreateOrOverride("gone.bin", []byte("gone")))
+	layer, err := lower.NewLayer("layer")
+	require.NoError(t, err)
+	require.NoError(t, layer.CreateOrOverride("nested.bin", []byte("nested")))
+
+	upper := storage.NewMemory()
+	overlay, err := storage.NewOverlay(upper, lower, 4)
+	require.NoError(t, err)
+	return overlay, upper, lower
+}
+
+func TestOverlay(t *testing.T) {
+	t.Run("success - copy up touched blocks only", func(t *testing.T) {
+		overlay, upper, lower := newOverlay(t)
+
+		require.NoError(t, overlay.Offset("data.bin", 5, []byte("X")))
+		require.NoError(t, overlay.Append("data.bin", []byte("ab")))
+
+		res, err := overlay.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("01234X6789ab"), res)
+
+		original, err := lower.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0123456789"), original)
+
+		copied, err := upper.ReadBefore("data.bin", 4)
+		assert.NoError(t, err)
+		assert.Equal(t, make([]byte, 4), copied, "the first block is never copied up")
+	})
+
+	t.Run("success - replace shrinks the file", func(t *testing.T) {
+		overlay, _, _ := newOverlay(t)
+
+		require.NoError(t, overlay.Replace("data.bin", &storage.Partial{OffsetFrom: 5, OffsetTo: 9}, []byte("-")))
+		require.NoError(t, overlay.Offset("data.bin", 8, []byte("!")))
+
+		res, err := overlay.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{'0', '1', '2', '3', '4', '-', '9', 0x00, '!'}, res)
+	})
+
+	t.Run("success - whiteout", func(t *testing.T) {
+		overlay, _, lower := newOverlay(t)
+
+		require.NoError(t, overlay.Delete("gone.bin"))
+		_, err := overlay.Info("gone.bin")
+		assert.Error(t, err)
+		files, err := overlay.List(storage.IsFileFilter)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"data.bin"}, files)
+
+		_, err = lower.Info("gone.bin")
+		assert.NoError(t, err)
+
+		require.NoError(t, overlay.CreateOrOverride("gone.bin", []byte("back")))
+		res, err := overlay.ReadAll("gone.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("back"), res)
+	})
+
+	t.Run("success - discard", func(t *testing.T) {
+		overlay, upper, _ := newOverlay(t)
+		layer, err := overlay.NewLayer("layer")
+		require.NoError(t, err)
+		require.NoError(t, layer.Offset("nested.bin", 0, []byte("N")))
+		require.NoError(t, overlay.Delete("gone.bin"))
+
+		require.NoError(t, overlay.Discard())
+
+		res, err := layer.ReadAll("nested.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("nested"), res)
+		_, err = overlay.Info("gone.bin")
+		assert.NoError(t, err)
+		files, err := upper.List(storage.IsFileFilter)
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+	})
+
+	t.Run("success - merge", func(t *testing.T) {
+		overlay, _, lower := newOverlay(t)
+		layer, err := overlay.NewLayer("layer")
+		require.NoError(t, err)
+		require.NoError(t, layer.Offset("nested.bin", 0, []byte("N")))
+		require.NoError(t, overlay.Offset("data.bin", 9, []byte("!")))
+		require.NoError(t, overlay.Delete("gone.bin"))
+		require.NoError(t, overlay.CreateOrOverride("new.bin", []byte("new")))
+
+		require.NoError(t, overlay.Merge(lower))
+
+		files, err := lower.List(storage.IsFileFilter)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"data.bin", "new.bin"}, files)
+		res, err := lower.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("012345678!"), res)
+		lowerLayer, err := lower.NewLayer("layer")
+		require.NoError(t, err)
+		res, err = lowerLayer.ReadAll("nested.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("Nested"), res)
+	})
+}
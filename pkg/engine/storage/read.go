@@ -11,6 +11,8 @@ import (
 
 type Reader interface {
 	Info(filename string) (os.FileInfo, error)
+	// Exists reports whether a file or a layer with the given name exists.
+	Exists(name string) (bool, error)
 	ReadAll(filename string) ([]byte, error)
 	ReadPartials(filename string, partials []*Partial) ([][]byte, error)
 	ReadAfter(filename string, offset int64) ([]byte, error)
@@ -19,19 +21,41 @@ type Reader interface {
 }
 
 type reader struct {
-	path string
+	path    string
+	handles *handlePool
 }
 
 func (r *reader) Info(filename string) (os.FileInfo, error) {
-	return os.Stat(filename)
+	return os.Stat(r.pathToFile(filename))
+}
+
+func (r *reader) Exists(name string) (bool, error) {
+	if _, err := os.Stat(r.pathToFile(name)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "%s could not read file info", r.errorDescriptor(name))
+	}
+	return true, nil
 }
 
 func (r *reader) ReadAll(filename string) ([]byte, error) {
-	return os.ReadFile(filename)
+	h, err := r.handles.acquire(r.pathToFile(filename))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not open file", r.errorDescriptor(filename))
+	}
+
+	res, err := r.readFrom(h.file, 0)
+	if err != nil {
+		_ = r.handles.release(h)
+		return nil, errors.Wrapf(err, "%s could not read file data", r.errorDescriptor(filename))
+	}
+
+	return res, r.handles.release(h)
 }
 
 func (r *reader) ReadPartials(filename string, partials []*Partial) ([][]byte, error) {
-	file, err := os.OpenFile(r.pathToFile(filename), os.O_RDONLY, 0644)
+	h, err := r.handles.acquire(r.pathToFile(filename))
 	if err != nil {
 		return nil, errors.Wrapf(err, "%s could not open file", r.errorDescriptor(filename))
 	}
@@ -39,48 +63,43 @@ func (r *reader) ReadPartials(filename string, partials []*Partial) ([][]byte, e
 	res := make([][]byte, len(partials))
 	for i, partial := range partials {
 		res[i] = make([]byte, partial.OffsetTo-partial.OffsetFrom)
-		if _, err := file.ReadAt(res[i], partial.OffsetFrom); err != nil {
-			_ = file.Close()
+		if _, err := h.file.ReadAt(res[i], partial.OffsetFrom); err != nil {
+			_ = r.handles.release(h)
 			return nil, errors.Wrapf(err, "%s could not read from file partial [offsetFrom=%d, offsetTo=%d]", r.errorDescriptor(filename), partial.OffsetFrom, partial.OffsetTo)
 		}
 	}
 
-	return res, file.Close()
+	return res, r.handles.release(h)
 }
 
 func (r *reader) ReadAfter(filename string, offset int64) ([]byte, error) {
-	file, err := os.OpenFile(r.pathToFile(filename), os.O_RDONLY, 0644)
+	h, err := r.handles.acquire(r.pathToFile(filename))
 	if err != nil {
 		return nil, errors.Wrapf(err, "%s could not open file", r.errorDescriptor(filename))
 	}
 
-	if _, err := file.Seek(offset, io.SeekStart); err != nil {
-		_ = file.Close()
-		return nil, errors.Wrapf(err, "%s could not skip file data to offset [offset=%d]", r.errorDescriptor(filename), offset)
-	}
-
-	res, err := io.ReadAll(file)
+	res, err := r.readFrom(h.file, offset)
 	if err != nil {
-		_ = file.Close()
+		_ = r.handles.release(h)
 		return nil, errors.Wrapf(err, "%s could not read file data from offset [offset=%d]", r.errorDescriptor(filename), offset)
 	}
 
-	return res, file.Close()
+	return res, r.handles.release(h)
 }
 
 func (r *reader) ReadBefore(filename string, offset int64) ([]byte, error) {
-	file, err := os.OpenFile(r.pathToFile(filename), os.O_RDONLY, 0644)
+	h, err := r.handles.acquire(r.pathToFile(filename))
 	if err != nil {
 		return nil, errors.Wrapf(err, "%s could not open file", r.errorDescriptor(filename))
 	}
 
 	res := make([]byte, offset)
-	if _, err := file.Read(res); err != nil {
-		_ = file.Close()
+	if n, err := h.file.ReadAt(res, 0); err != nil && (err != io.EOF || n == 0) {
+		_ = r.handles.release(h)
 		return nil, errors.Wrapf(err, "%s could not read data to offset [offset=%d]", r.errorDescriptor(filename), offset)
 	}
 
-	return res, file.Close()
+	return res, r.handles.release(h)
 }
 
 func (r *reader) List(filters ...FileFilter) ([]string, error) {
@@ -92,6 +111,9 @@ func (r *reader) List(filters ...FileFilter) ([]string, error) {
 	matches := make([]string, 0, len(entries))
 EntryLoop:
 	for _, entry := range entries {
+		if isTempFile(entry.Name()) || entry.Name() == lockFilename {
+			continue
+		}
 		for _, filter := range filters {
 			filterRes, err := filter(entry)
 			if err != nil {
@@ -107,6 +129,16 @@ EntryLoop:
 	return matches, nil
 }
 
+// readFrom reads the file data from the given offset until the end of the file.
+func (r *reader) readFrom(file *os.File, offset int64) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(io.NewSectionReader(file, offset, max(info.Size()-offset, 0)))
+}
+
 func (r *reader) pathToFile(filename string) string {
 	return fmt.Sprintf("%s%c%s", r.path, filepath.Separator, filename)
 }
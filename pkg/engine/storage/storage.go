@@ -4,42 +4,173 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
+// ErrInvalidLayerPath is returned by NewLayer for paths that are not a single, non-hidden path element.
+var ErrInvalidLayerPath = errors.New("invalid layer path")
+
+// DefaultMaxOpenFiles is the number of file handles a storage created by New keeps open between calls.
+const DefaultMaxOpenFiles = 64
+
 type Storage interface {
 	NewLayer(path string) (Storage, error)
+	// RemoveLayer removes the layer at the given path together with all of its files and layers.
+	RemoveLayer(path string) error
+	// Path returns the location of the layer, it uniquely identifies the layer within its root storage.
+	Path() string
+	// Close releases the resources held by the layer and all layers below it, the storage must not be used afterward.
+	Close() error
+	Locker
 	Reader
 	Writer
 }
 
 type storage struct {
-	path string
+	path    string
+	handles *handlePool
+	// lock is the exclusive lock of the root storage, it is nil for layers and read-only storages
+	lock *diskLock
 	reader
 	writer
 }
 
 func (p *storage) NewLayer(path string) (Storage, error) {
-	return New(fmt.Sprintf("%s%c%s", p.path, filepath.Separator, path))
+	if err := validateLayerPath(path); err != nil {
+		return nil, err
+	}
+	return newStorage(fmt.Sprintf("%s%c%s", p.path, filepath.Separator, path), p.handles, p.readOnly)
+}
+
+func (p *storage) RemoveLayer(path string) error {
+	if err := validateLayerPath(path); err != nil {
+		return err
+	}
+	if p.readOnly {
+		return errors.Wrapf(ErrReadOnly, "could not remove storager=[path=%s]", p.writer.pathToFile(path))
+	}
+
+	layerPath := p.writer.pathToFile(path)
+	if _, err := os.Stat(layerPath); err != nil {
+		return errors.Wrapf(err, "could not remove storager=[path=%s]", layerPath)
+	}
+	if err := p.handles.closePrefix(fmt.Sprintf("%s%c", layerPath, filepath.Separator)); err != nil {
+		return errors.Wrapf(err, "could not close storager=[path=%s]", layerPath)
+	}
+	if err := os.RemoveAll(layerPath); err != nil {
+		return errors.Wrapf(err, "could not remove storager=[path=%s]", layerPath)
+	}
+	if err := syncDir(p.path); err != nil {
+		return errors.Wrapf(err, "could not sync storager=[path=%s]", p.path)
+	}
+	return nil
+}
+
+func (p *storage) Path() string {
+	return p.path
+}
+
+func (p *storage) isReadOnly() bool {
+	return p.readOnly
+}
+
+func (p *storage) Close() error {
+	if err := p.handles.closePrefix(fmt.Sprintf("%s%c", p.path, filepath.Separator)); err != nil {
+		return errors.Wrapf(err, "could not close storager=[path=%s]", p.path)
+	}
+	if p.lock != nil {
+		if err := p.lock.Unlock(); err != nil {
+			return errors.Wrapf(err, "could not unlock storager=[path=%s]", p.path)
+		}
+		p.lock = nil
+	}
+	return nil
 }
 
+// New creates a storage that exclusively locks its path until closed, a second storage created on the same path,
+// by this or any other process, fails with a *LockedError.
 func New(path string) (Storage, error) {
+	return NewWithMaxOpenFiles(path, DefaultMaxOpenFiles)
+}
+
+// NewWithMaxOpenFiles creates a storage that keeps up to maxOpenFiles file handles open between calls,
+// the handles are shared with all of its layers.
+func NewWithMaxOpenFiles(path string, maxOpenFiles int) (Storage, error) {
+	if maxOpenFiles < 1 {
+		return nil, errors.Errorf("invalid max open files [max_open_files=%d]", maxOpenFiles)
+	}
+	res, err := newStorage(path, newHandlePool(maxOpenFiles, false), false)
+	if err != nil {
+		return nil, err
+	}
+	res.lock, err = lockLayer(path, LockExclusive)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not lock storager=[path=%s]", path)
+	}
+	return res, nil
+}
+
+// NewReadOnly creates a storage of an existing path that takes no lock and rejects all writes with ErrReadOnly,
+// it may be used next to a storage created by New. Readers and writers of the same data have to coordinate
+// through the locks of the layers holding it.
+func NewReadOnly(path string) (Storage, error) {
+	return newStorage(path, newHandlePool(DefaultMaxOpenFiles, true), true)
+}
+
+// IsReadOnly reports whether the storage rejects all writes with ErrReadOnly, as the storages created by NewReadOnly
+// and the storages stacked on top of them do.
+func IsReadOnly(s Storage) bool {
+	ro, ok := s.(interface{ isReadOnly() bool })
+	return ok && ro.isReadOnly()
+}
+
+func newStorage(path string, handles *handlePool, readOnly bool) (*storage, error) {
 	if path == "" {
 		return nil, errors.New("cannot create storager for an empty path")
 	}
 
-	if err := os.Mkdir(path, 0755); err != nil && os.IsNotExist(err) {
-		return nil, errors.Wrapf(err, "could not create storager=[path=%s]", path)
+	if !readOnly {
+		if err := os.Mkdir(path, 0755); err != nil && os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "could not create storager=[path=%s]", path)
+		}
 	}
 
 	return &storage{
-		path: path,
+		path:    path,
+		handles: handles,
 		reader: reader{
-			path: path,
+			path:    path,
+			handles: handles,
 		},
 		writer: writer{
-			path: path,
+			path:     path,
+			handles:  handles,
+			readOnly: readOnly,
 		},
 	}, nil
 }
+
+// validateLayerPath ensures that the layer is created directly below its parent, so that user supplied names can
+// never escape the root of the storage or collide with the hidden files created by the storage itself.
+func validateLayerPath(path string) error {
+	if path == "" || strings.HasPrefix(path, ".") || strings.ContainsAny(path, "/\\\x00") || filepath.IsAbs(path) || filepath.VolumeName(path) != "" {
+		return errors.Wrapf(ErrInvalidLayerPath, "cannot create storager=[path=%q]", path)
+	}
+	return nil
+}
+
+// hasLayer reports whether the storage holds a layer of the given name.
+func hasLayer(s Storage, name string) (bool, error) {
+	layers, err := s.List(IsDirFilter)
+	if err != nil {
+		return false, err
+	}
+	for _, layer := range layers {
+		if layer == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
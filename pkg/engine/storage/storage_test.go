@@ -0,0 +1,389 @@
+package storage_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+// implementations returns a fresh instance of every Storage implementation that must honour the behaviour below.
+func implementations(t *testing.T) map[string]storage.Storage {
+	disk, err := storage.New(t.TempDir())
+	require.NoError(t, err)
+	pool, err := storage.NewBufferPool(4, 3)
+	require.NoError(t, err)
+	checksummed, err := storage.NewChecksummed(storage.NewMemory(), 3)
+	require.NoError(t, err)
+	compressed, err := storage.NewCompressed(storage.NewMemory(), 3)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, storage.CreateKeyFile(keyFile))
+	encrypted, err := storage.NewEncrypted(storage.NewMemory(), 3, storage.NewFileKeyProvider(keyFile))
+	require.NoError(t, err)
+	mappedDisk, err := storage.New(t.TempDir())
+	require.NoError(t, err)
+	mapped, err := storage.NewMapped(mappedDisk)
+	require.NoError(t, err)
+
+	overlay, err := storage.NewOverlay(storage.NewMemory(), storage.NewMemory(), 3)
+	require.NoError(t, err)
+
+	return map[string]storage.Storage{
+		"disk":         disk,
+		"memory":       storage.NewMemory(),
+		"buffered":     storage.NewBuffered(storage.NewMemory(), pool),
+		"checksummed":  checksummed,
+		"compressed":   compressed,
+		"encrypted":    encrypted,
+		"mapped":       mapped,
+		"faulty":       storage.NewFaulty(storage.NewMemory()),
+		"instrumented": storage.NewInstrumented(storage.NewMemory()),
+		"overlay":      overlay,
+	}
+}
+
+func TestStorage(t *testing.T) {
+	for name, s := range implementations(t) {
+		t.Run(name, func(t *testing.T) {
+			testStorage(t, s)
+		})
+	}
+}
+
+func testStorage(t *testing.T, s storage.Storage) {
+	t.Run("create and read", func(t *testing.T) {
+		require.NoError(t, s.CreateOrOverride("create.bin", []byte("ktsivkov")))
+
+		res, err := s.ReadAll("create.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ktsivkov"), res)
+
+		info, err := s.Info("create.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, "create.bin", info.Name())
+		assert.Equal(t, int64(8), info.Size())
+		assert.False(t, info.IsDir())
+	})
+
+	t.Run("override", func(t *testing.T) {
+		require.NoError(t, s.CreateOrOverride("override.bin", []byte("ktsivkov")))
+		require.NoError(t, s.CreateOrOverride("override.bin", []byte("kt")))
+
+		res, err := s.ReadAll("override.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("kt"), res)
+	})
+
+	t.Run("append and offset", func(t *testing.T) {
+		require.NoError(t, s.CreateOrOverride("write.bin", nil))
+		require.NoError(t, s.Append("write.bin", []byte("abc")))
+		require.NoError(t, s.Append("write.bin", []byte("def"), storage.WithSync()))
+		require.NoError(t, s.Offset("write.bin", 1, []byte("XY")))
+		require.NoError(t, s.Offset("write.bin", 8, []byte("Z"), storage.WithSync()))
+		require.NoError(t, s.Sync("write.bin"))
+
+		res, err := s.ReadAll("write.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{'a', 'X', 'Y', 'd', 'e', 'f', 0x00, 0x00, 'Z'}, res)
+	})
+
+	t.Run("read partials", func(t *testing.T) {
+		require.NoError(t, s.CreateOrOverride("partials.bin", []byte("0123456789")))
+
+		res, err := s.ReadPartials("partials.bin", []*storage.Partial{
+			{OffsetFrom: 0, OffsetTo: 2},
+			{OffsetFrom: 5, OffsetTo: 10},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("01"), []byte("56789")}, res)
+
+		_, err = s.ReadPartials("partials.bin", []*storage.Partial{{OffsetFrom: 8, OffsetTo: 12}})
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("read after and before", func(t *testing.T) {
+		require.NoError(t, s.CreateOrOverride("around.bin", []byte("0123456789")))
+
+		after, err := s.ReadAfter("around.bin", 7)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("789"), after)
+
+		before, err := s.ReadBefore("around.bin", 3)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("012"), before)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		require.NoError(t, s.CreateOrOverride("replace.bin", []byte("hello world")))
+		require.NoError(t, s.Replace("replace.bin", &storage.Partial{OffsetFrom: 6, OffsetTo: 11}, []byte("ktdb!")))
+		require.NoError(t, s.Replace("replace.bin", &storage.Partial{OffsetFrom: 0, OffsetTo: 5}, []byte("hi")))
+
+		res, err := s.ReadAll("replace.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hi ktdb!"), res)
+	})
+
+	t.Run("write batch", func(t *testing.T) {
+		require.NoError(t, s.CreateOrOverride("batch.bin", []byte("0123")))
+		batch := storage.NewBatch().
+			Offset(1, []byte("ab")).
+			Append([]byte("xy")).
+			Offset(3, []byte("c")).
+			Append([]byte("z"))
+		require.NoError(t, s.WriteBatch("batch.bin", batch))
+
+		res, err := s.ReadAll("batch.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0abcxyz"), res)
+
+		atomic := storage.NewBatch().Offset(0, []byte("A")).Offset(-1, []byte("B"))
+		assert.Error(t, s.WriteBatch("batch.bin", atomic, storage.WithAtomic()))
+		res, err = s.ReadAll("batch.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("0abcxyz"), res)
+
+		require.NoError(t, s.WriteBatch("batch.bin", storage.NewBatch().Offset(8, []byte("!")), storage.WithAtomic(), storage.WithSync()))
+		res, err = s.ReadAll("batch.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{'0', 'a', 'b', 'c', 'x', 'y', 'z', 0x00, '!'}, res)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, s.CreateOrOverride("delete.bin", []byte("ktsivkov")))
+		require.NoError(t, s.Delete("delete.bin"))
+
+		_, err := s.Info("delete.bin")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = s.ReadAll("delete.bin")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Error(t, s.Delete("delete.bin"))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		assert.Error(t, s.Append("missing.bin", []byte("a")))
+		assert.Error(t, s.Offset("missing.bin", 0, []byte("a")))
+		assert.Error(t, s.Replace("missing.bin", &storage.Partial{}, []byte("a")))
+		assert.Error(t, s.Sync("missing.bin"))
+		_, err := s.ReadPartials("missing.bin", []*storage.Partial{{OffsetFrom: 0, OffsetTo: 1}})
+		assert.Error(t, err)
+	})
+
+	t.Run("layers and list", func(t *testing.T) {
+		root, err := s.NewLayer("list")
+		require.NoError(t, err)
+		require.NoError(t, root.CreateOrOverride("b.bin", nil))
+		require.NoError(t, root.CreateOrOverride("a.bin", []byte("a")))
+		layer, err := root.NewLayer("c")
+		require.NoError(t, err)
+		require.NoError(t, layer.CreateOrOverride("nested.bin", []byte("nested")))
+
+		all, err := root.List()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a.bin", "b.bin", "c"}, all)
+
+		files, err := root.List(storage.IsFileFilter)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a.bin", "b.bin"}, files)
+
+		dirs, err := root.List(storage.IsDirFilter)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"c"}, dirs)
+
+		reopened, err := root.NewLayer("c")
+		require.NoError(t, err)
+		res, err := reopened.ReadAll("nested.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("nested"), res)
+	})
+
+	t.Run("exists", func(t *testing.T) {
+		root, err := s.NewLayer("exists")
+		require.NoError(t, err)
+		require.NoError(t, root.CreateOrOverride("file.bin", nil))
+		_, err = root.NewLayer("layer")
+		require.NoError(t, err)
+
+		for name, expected := range map[string]bool{"file.bin": true, "layer": true, "missing.bin": false} {
+			exists, err := root.Exists(name)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, exists, name)
+		}
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		root, err := s.NewLayer("rename")
+		require.NoError(t, err)
+		require.NoError(t, root.CreateOrOverride("from.bin", []byte("from")))
+		require.NoError(t, root.CreateOrOverride("to.bin", []byte("to")))
+		require.NoError(t, root.Rename("from.bin", "to.bin"))
+
+		exists, err := root.Exists("from.bin")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+		res, err := root.ReadAll("to.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("from"), res)
+
+		layer, err := root.NewLayer("a")
+		require.NoError(t, err)
+		require.NoError(t, layer.CreateOrOverride("nested.bin", []byte("nested")))
+		require.NoError(t, root.Rename("a", "b"))
+
+		layers, err := root.List(storage.IsDirFilter)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, layers)
+		renamed, err := root.NewLayer("b")
+		require.NoError(t, err)
+		res, err = renamed.ReadAll("nested.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("nested"), res)
+
+		assert.ErrorIs(t, root.Rename("missing.bin", "other.bin"), os.ErrNotExist)
+	})
+
+	t.Run("remove layer", func(t *testing.T) {
+		root, err := s.NewLayer("remove")
+		require.NoError(t, err)
+		layer, err := root.NewLayer("a")
+		require.NoError(t, err)
+		require.NoError(t, layer.CreateOrOverride("file.bin", []byte("file")))
+		nested, err := layer.NewLayer("b")
+		require.NoError(t, err)
+		require.NoError(t, nested.CreateOrOverride("nested.bin", []byte("nested")))
+		require.NoError(t, root.RemoveLayer("a"))
+
+		all, err := root.List()
+		assert.NoError(t, err)
+		assert.Empty(t, all)
+		assert.ErrorIs(t, root.RemoveLayer("a"), os.ErrNotExist)
+
+		recreated, err := root.NewLayer("a")
+		require.NoError(t, err)
+		files, err := recreated.List()
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+	})
+
+	t.Run("invalid layer path", func(t *testing.T) {
+		for _, path := range []string{"", ".", "..", "../../etc", "a/b", "/etc", ".hidden"} {
+			_, err := s.NewLayer(path)
+			assert.ErrorIs(t, err, storage.ErrInvalidLayerPath, path)
+		}
+	})
+	t.Run("lock", func(t *testing.T) {
+		layer, err := s.NewLayer("lock")
+		require.NoError(t, err)
+		reopened, err := s.NewLayer("lock")
+		require.NoError(t, err)
+
+		shared, err := layer.Lock(storage.LockShared)
+		require.NoError(t, err)
+		_, err = reopened.Lock(storage.LockExclusive)
+		var locked *storage.LockedError
+		assert.ErrorAs(t, err, &locked)
+		require.NoError(t, shared.Unlock())
+
+		exclusive, err := reopened.Lock(storage.LockExclusive)
+		require.NoError(t, err)
+		_, err = layer.Lock(storage.LockShared)
+		assert.ErrorAs(t, err, &locked)
+		require.NoError(t, exclusive.Unlock())
+
+		files, err := layer.List()
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+	})
+}
+
+func TestStorage_CreateOrOverride(t *testing.T) {
+	t.Run("success - readers see either the previous or the new contents", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+		previous, next := bytes.Repeat([]byte("a"), 1<<16), bytes.Repeat([]byte("b"), 1<<12)
+		require.NoError(t, s.CreateOrOverride("data.bin", previous))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 50; i++ {
+				payload := previous
+				if i%2 == 0 {
+					payload = next
+				}
+				assert.NoError(t, s.CreateOrOverride("data.bin", payload))
+			}
+		}()
+		for reading := true; reading; {
+			select {
+			case <-done:
+				reading = false
+			default:
+			}
+			res, err := s.ReadAll("data.bin")
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(previous, res) || bytes.Equal(next, res), "read mixed contents of [bytes=%d]", len(res))
+		}
+	})
+
+	t.Run("success - temporary files are hidden from list", func(t *testing.T) {
+		path := t.TempDir()
+		s, err := storage.New(path)
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("ktdb")))
+		// A crash during an atomic write leaves its temporary file behind
+		require.NoError(t, os.WriteFile(filepath.Join(path, ".data.bin.123.tmp"), []byte("kt"), 0644))
+
+		files, err := s.List()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"data.bin"}, files)
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ktdb"), res)
+	})
+
+	t.Run("success - synced writes survive reopening", func(t *testing.T) {
+		path := t.TempDir()
+		s, err := storage.New(path)
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", []byte("kt")))
+		require.NoError(t, s.Append("data.bin", []byte("db"), storage.WithSync()))
+		require.NoError(t, s.Close())
+
+		reopened, err := storage.New(path)
+		require.NoError(t, err)
+		defer func() { _ = reopened.Close() }()
+		res, err := reopened.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ktdb"), res)
+	})
+
+	t.Run("fail - failed rename leaves no temporary file behind", func(t *testing.T) {
+		path := t.TempDir()
+		s, err := storage.New(path)
+		require.NoError(t, err)
+		defer func() { _ = s.Close() }()
+		layer, err := s.NewLayer("layer")
+		require.NoError(t, err)
+		require.NoError(t, layer.CreateOrOverride("data.bin", []byte("ktdb")))
+
+		assert.Error(t, s.CreateOrOverride("layer", []byte("kt")))
+		entries, err := os.ReadDir(path)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			assert.False(t, strings.HasSuffix(entry.Name(), ".tmp"), entry.Name())
+		}
+		res, err := layer.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ktdb"), res)
+	})
+}
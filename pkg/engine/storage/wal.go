@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/sys"
+)
+
+const walChecksumSize = 4
+
+// walBatchFilename is the filename of the records framing a batch, their data holds the records of the batch.
+const walBatchFilename = ""
+
+// WAL is a redo log of physical writes. Every write is logged durably before it is applied to its file, so that after
+// a crash the files can be brought back to a consistent state by replaying the log.
+type WAL interface {
+	// Log durably appends the record to the log.
+	Log(record *Record) error
+	// LogBatch durably appends the records to the log with a single write as a single checksummed frame, after a
+	// crash in the middle of the write either all or none of the records are replayed.
+	LogBatch(records []*Record) error
+	// Replay applies all complete records of the log in order, a torn record at the end of the log is ignored. A record
+	// that fails to load before the end of the log fails the replay with a CorruptionError, the records before it are
+	// applied already.
+	Replay(apply func(record *Record) error) error
+	// Checkpoint flushes all files written since the last checkpoint to stable storage and truncates the log.
+	Checkpoint() error
+	// Size returns the current size of the log in bytes.
+	Size() (int64, error)
+}
+
+// Record describes the write of Data at Offset of the file Filename. Applying a record is idempotent.
+type Record struct {
+	Filename string
+	Offset   int64
+	Data     []byte
+	// Image marks the records holding whole blocks of the file, they are applied with WithOverwrite
+	Image bool
+}
+
+func (r *Record) Bytes() []byte {
+	var image byte
+	if r.Image {
+		image = 1
+	}
+	body := sys.ConcatSlices(sys.New([]byte(r.Filename)), sys.New(sys.Int64AsBytes(r.Offset)), sys.New(r.Data), sys.New([]byte{image}))
+	checksum := make([]byte, walChecksumSize)
+	binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(body))
+	return sys.New(sys.ConcatSlices(body, checksum))
+}
+
+func (r *Record) Load(payload []byte) error {
+	if int64(len(payload)) < walChecksumSize {
+		return errors.New("corrupted payload")
+	}
+	body, checksum := payload[:len(payload)-walChecksumSize], payload[len(payload)-walChecksumSize:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(checksum) {
+		return errors.New("checksum mismatch")
+	}
+
+	payloads, err := sys.ReadAll(body)
+	if err != nil {
+		return errors.Wrap(err, "deserialization failed")
+	}
+	// The payload of the record persists of a section for each field, the image flag was added later
+	if len(payloads) != 3 && len(payloads) != 4 {
+		return errors.New("corrupted payload")
+	}
+	if utf8.Valid(payloads[0]) == false {
+		return errors.New("could not load filename")
+	}
+	r.Filename = string(payloads[0])
+	r.Offset, err = sys.BytesAsInt64(payloads[1])
+	if err != nil {
+		return errors.Wrap(err, "could not load offset")
+	}
+	r.Data = payloads[2]
+	r.Image = len(payloads) == 4 && len(payloads[3]) == 1 && payloads[3][0] == 1
+	return nil
+}
+
+type walOptions struct {
+	keyProvider KeyProvider
+}
+
+// WALOption configures a log.
+type WALOption func(opts *walOptions)
+
+// WithWALEncryption encrypts every record of the log with AES-GCM under the key of the provider. The records are bound
+// to their offset within the log, a record that was tampered with or moved is treated like a corrupted record.
+func WithWALEncryption(keyProvider KeyProvider) WALOption {
+	return func(opts *walOptions) {
+		opts.keyProvider = keyProvider
+	}
+}
+
+// NewWAL opens the log stored in the given file of the storage, creating it if it does not exist yet.
+func NewWAL(storage Storage, filename string, opts ...WALOption) (WAL, error) {
+	options := &walOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	w := &wal{
+		storage:  storage,
+		filename: filename,
+		touched:  make(map[string]struct{}),
+	}
+	if options.keyProvider != nil {
+		var err error
+		if w.aead, err = newAEAD(options.keyProvider); err != nil {
+			return nil, errors.Wrapf(err, "%s could not create cipher", w.errorDescriptor())
+		}
+	}
+
+	if _, err := storage.Info(filename); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, errors.Wrapf(err, "%s could not read log info", w.errorDescriptor())
+		}
+		if err := storage.CreateOrOverride(filename, nil); err != nil {
+			return nil, errors.Wrapf(err, "%s could not create log", w.errorDescriptor())
+		}
+	}
+
+	return w, nil
+}
+
+type wal struct {
+	storage  Storage
+	filename string
+	// touched holds the files written since the last checkpoint
+	touched map[string]struct{}
+	// aead encrypts the records, it is nil for logs without encryption
+	aead cipher.AEAD
+}
+
+func (w *wal) Log(record *Record) error {
+	if err := w.append(record.Bytes()); err != nil {
+		return errors.Wrapf(err, "%s could not append record %s", w.errorDescriptor(), w.recordErrorDescriptor(record))
+	}
+	w.touched[record.Filename] = struct{}{}
+	return nil
+}
+
+func (w *wal) LogBatch(records []*Record) error {
+	payloads := make([][]byte, len(records))
+	for i, record := range records {
+		payloads[i] = record.Bytes()
+	}
+	frame := &Record{Filename: walBatchFilename, Data: sys.ConcatSlices(payloads...)}
+	if err := w.append(frame.Bytes()); err != nil {
+		return errors.Wrapf(err, "%s could not append %d record(s)", w.errorDescriptor(), len(records))
+	}
+	for _, record := range records {
+		w.touched[record.Filename] = struct{}{}
+	}
+	return nil
+}
+
+func (w *wal) Replay(apply func(record *Record) error) error {
+	payload, err := w.storage.ReadAll(w.filename)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not read log", w.errorDescriptor())
+	}
+
+	for offset := int64(0); offset < int64(len(payload)); {
+		recordPayload, consumed, err := sys.Read(payload[offset:])
+		if err != nil {
+			break // The last record was torn by a crash while it was being logged, hence it was never applied
+		}
+		record, err := w.load(offset, recordPayload)
+		if err != nil {
+			if offset+consumed == int64(len(payload)) {
+				break // The last record was torn within its declared size
+			}
+			// The later records were logged after this one was acknowledged, it was therefore complete once
+			return w.corruption(offset, err)
+		}
+		records := []*Record{record}
+		if record.Filename == walBatchFilename {
+			if records, err = w.batch(record); err != nil {
+				return w.corruption(offset, err)
+			}
+		}
+		for _, record := range records {
+			if err := apply(record); err != nil {
+				return errors.Wrapf(err, "%s could not apply record %s", w.errorDescriptor(), w.recordErrorDescriptor(record))
+			}
+			w.touched[record.Filename] = struct{}{}
+		}
+		offset += consumed
+	}
+
+	return nil
+}
+
+// append durably appends the payload of a record to the log, sealing it first if the log is encrypted.
+func (w *wal) append(payload []byte) error {
+	if w.aead != nil {
+		info, err := w.storage.Info(w.filename)
+		if err != nil {
+			return errors.Wrap(err, "could not read log info")
+		}
+		nonce := make([]byte, w.aead.NonceSize(), len(payload)+w.aead.NonceSize()+w.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return errors.Wrap(err, "could not generate nonce")
+		}
+		payload = sys.New(w.aead.Seal(nonce, nonce, payload, sys.Int64AsBytes(info.Size())))
+	}
+	return w.storage.Append(w.filename, payload, WithSync())
+}
+
+// load loads the record logged at the offset of the log, opening it first if the log is encrypted.
+func (w *wal) load(offset int64, payload []byte) (*Record, error) {
+	if w.aead != nil {
+		if len(payload) < w.aead.NonceSize() {
+			return nil, errors.New("truncated record")
+		}
+		nonce, ciphertext := payload[:w.aead.NonceSize()], payload[w.aead.NonceSize():]
+		plain, err := w.aead.Open(nil, nonce, ciphertext, sys.Int64AsBytes(offset))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decrypt record")
+		}
+		if payload, _, err = sys.Read(plain); err != nil {
+			return nil, errors.Wrap(err, "could not read record")
+		}
+	}
+	record := &Record{}
+	if err := record.Load(payload); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// batch returns the records of the batch framed by the record, the frame was checksummed as a whole so a record that
+// fails to load is a corruption rather than a torn write.
+func (w *wal) batch(frame *Record) ([]*Record, error) {
+	payloads, err := sys.ReadAll(frame.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read batch")
+	}
+	records := make([]*Record, len(payloads))
+	for i, payload := range payloads {
+		records[i] = &Record{}
+		if err := records[i].Load(payload); err != nil {
+			return nil, errors.Wrapf(err, "could not load record of batch [position=%d]", i)
+		}
+	}
+	return records, nil
+}
+
+// corruption reports the record logged at the offset of the log that failed to load although it is not the last one.
+func (w *wal) corruption(offset int64, err error) error {
+	return &CorruptionError{
+		Path:     w.storage.Path(),
+		Filename: w.filename,
+		Offset:   offset,
+		Err:      err,
+	}
+}
+
+func (w *wal) Checkpoint() error {
+	for filename := range w.touched {
+		if err := w.storage.Sync(filename); err != nil {
+			return errors.Wrapf(err, "%s could not sync file [filename=%s]", w.errorDescriptor(), filename)
+		}
+		delete(w.touched, filename)
+	}
+
+	if err := w.storage.CreateOrOverride(w.filename, nil); err != nil {
+		return errors.Wrapf(err, "%s could not truncate log", w.errorDescriptor())
+	}
+	return nil
+}
+
+func (w *wal) Size() (int64, error) {
+	info, err := w.storage.Info(w.filename)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s could not read log info", w.errorDescriptor())
+	}
+	return info.Size(), nil
+}
+
+func (w *wal) recordErrorDescriptor(record *Record) string {
+	return fmt.Sprintf("(record=[filename=%s, offset=%d, size=%d])", record.Filename, record.Offset, len(record.Data))
+}
+
+func (w *wal) errorDescriptor() string {
+	return fmt.Sprintf("(wal=[filename=%s])", w.filename)
+}
@@ -0,0 +1,175 @@
+package storage_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/engine/storage"
+)
+
+func TestWAL(t *testing.T) {
+	t.Run("success - replay applies logged records", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", make([]byte, 4)))
+
+		wal, err := storage.NewWAL(s, "wal.bin")
+		require.NoError(t, err)
+		require.NoError(t, wal.Log(&storage.Record{Filename: "data.bin", Offset: 1, Data: []byte("ab")}))
+		require.NoError(t, wal.LogBatch([]*storage.Record{
+			{Filename: "data.bin", Offset: 4, Data: []byte("c")},
+			{Filename: "data.bin", Offset: 5, Data: []byte("d")},
+		}))
+
+		reopened, err := storage.NewWAL(s, "wal.bin")
+		require.NoError(t, err)
+		err = reopened.Replay(func(record *storage.Record) error {
+			return s.Offset(record.Filename, record.Offset, record.Data)
+		})
+		assert.NoError(t, err)
+
+		res, err := s.ReadAll("data.bin")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x00, 'a', 'b', 0x00, 'c', 'd'}, res)
+	})
+
+	t.Run("success - torn record is ignored", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+
+		wal, err := storage.NewWAL(s, "wal.bin")
+		require.NoError(t, err)
+		require.NoError(t, wal.Log(&storage.Record{Filename: "data.bin", Offset: 0, Data: []byte("ab")}))
+		torn := (&storage.Record{Filename: "data.bin", Offset: 2, Data: []byte("cd")}).Bytes()
+		require.NoError(t, s.Append("wal.bin", torn[:len(torn)-1]))
+
+		var replayed []*storage.Record
+		err = wal.Replay(func(record *storage.Record) error {
+			replayed = append(replayed, record)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []*storage.Record{{Filename: "data.bin", Offset: 0, Data: []byte("ab")}}, replayed)
+	})
+
+	t.Run("success - torn batch is ignored as a whole", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+
+		wal, err := storage.NewWAL(s, "wal.bin")
+		require.NoError(t, err)
+		require.NoError(t, wal.Log(&storage.Record{Filename: "data.bin", Offset: 0, Data: []byte("ab")}))
+		require.NoError(t, wal.LogBatch([]*storage.Record{
+			{Filename: "data.bin", Offset: 2, Data: []byte("cd")},
+			{Filename: "data.bin", Offset: 4, Data: []byte("ef")},
+		}))
+		logged, err := s.ReadAll("wal.bin")
+		require.NoError(t, err)
+		// The write of the batch was torn within its last record
+		require.NoError(t, s.CreateOrOverride("wal.bin", logged[:len(logged)-8]))
+
+		var replayed []*storage.Record
+		err = wal.Replay(func(record *storage.Record) error {
+			replayed = append(replayed, record)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []*storage.Record{{Filename: "data.bin", Offset: 0, Data: []byte("ab")}}, replayed)
+	})
+
+	t.Run("success - corrupted last record is ignored", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+
+		wal, err := storage.NewWAL(s, "wal.bin")
+		require.NoError(t, err)
+		require.NoError(t, wal.Log(&storage.Record{Filename: "data.bin", Offset: 0, Data: []byte("ab")}))
+		require.NoError(t, wal.Log(&storage.Record{Filename: "data.bin", Offset: 2, Data: []byte("cd")}))
+		logged, err := s.ReadAll("wal.bin")
+		require.NoError(t, err)
+		logged[len(logged)-1] ^= 0xff
+		require.NoError(t, s.CreateOrOverride("wal.bin", logged))
+
+		var replayed []*storage.Record
+		err = wal.Replay(func(record *storage.Record) error {
+			replayed = append(replayed, record)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []*storage.Record{{Filename: "data.bin", Offset: 0, Data: []byte("ab")}}, replayed)
+	})
+
+	t.Run("fail - corrupted record in the middle of the log", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+
+		first := &storage.Record{Filename: "data.bin", Offset: 0, Data: []byte("ab")}
+		wal, err := storage.NewWAL(s, "wal.bin")
+		require.NoError(t, err)
+		require.NoError(t, wal.Log(first))
+		require.NoError(t, wal.Log(&storage.Record{Filename: "data.bin", Offset: 2, Data: []byte("cd")}))
+		require.NoError(t, wal.LogBatch([]*storage.Record{{Filename: "data.bin", Offset: 4, Data: []byte("ef")}}))
+		logged, err := s.ReadAll("wal.bin")
+		require.NoError(t, err)
+		second := int64(len(first.Bytes()))
+		logged[second+10] ^= 0xff
+		require.NoError(t, s.CreateOrOverride("wal.bin", logged))
+
+		var replayed []*storage.Record
+		err = wal.Replay(func(record *storage.Record) error {
+			replayed = append(replayed, record)
+			return nil
+		})
+		var corruption *storage.CorruptionError
+		require.ErrorAs(t, err, &corruption)
+		assert.Equal(t, "wal.bin", corruption.Filename)
+		assert.Equal(t, second, corruption.Offset)
+		assert.Equal(t, []*storage.Record{first}, replayed)
+	})
+
+	t.Run("success - encrypted log replays records it does not store in plain", func(t *testing.T) {
+		s := storage.NewMemory()
+		keyFile := filepath.Join(t.TempDir(), "key")
+		require.NoError(t, storage.CreateKeyFile(keyFile))
+
+		wal, err := storage.NewWAL(s, "wal.bin", storage.WithWALEncryption(storage.NewFileKeyProvider(keyFile)))
+		require.NoError(t, err)
+		first := &storage.Record{Filename: "data.bin", Offset: 0, Data: []byte("ktsivkov")}
+		require.NoError(t, wal.Log(first))
+		require.NoError(t, wal.LogBatch([]*storage.Record{{Filename: "data.bin", Offset: 8, Data: []byte("KTSIVKOV")}}))
+		logged, err := s.ReadAll("wal.bin")
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(logged, []byte("ktsivkov")))
+		// The write of the batch was torn within its authentication tag
+		require.NoError(t, s.CreateOrOverride("wal.bin", logged[:len(logged)-1]))
+
+		reopened, err := storage.NewWAL(s, "wal.bin", storage.WithWALEncryption(storage.NewFileKeyProvider(keyFile)))
+		require.NoError(t, err)
+		var replayed []*storage.Record
+		err = reopened.Replay(func(record *storage.Record) error {
+			replayed = append(replayed, record)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []*storage.Record{first}, replayed)
+	})
+
+	t.Run("success - checkpoint truncates the log", func(t *testing.T) {
+		s, err := storage.New(t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, s.CreateOrOverride("data.bin", nil))
+
+		wal, err := storage.NewWAL(s, "wal.bin")
+		require.NoError(t, err)
+		require.NoError(t, wal.Log(&storage.Record{Filename: "data.bin", Offset: 0, Data: []byte("ab")}))
+		require.NoError(t, wal.Checkpoint())
+
+		size, err := wal.Size()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), size)
+	})
+}
@@ -1,9 +1,7 @@
 package storage
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 
@@ -11,101 +9,267 @@ import (
 )
 
 type Writer interface {
+	// CreateOrOverride atomically replaces the whole file with the given data.
 	CreateOrOverride(filename string, data []byte) error
-	Append(filename string, data []byte) error
-	Offset(filename string, offset int64, data []byte) error
+	Append(filename string, data []byte, opts ...WriteOption) error
+	Offset(filename string, offset int64, data []byte, opts ...WriteOption) error
+	// Replace atomically replaces the given partial of the file with the given data.
 	Replace(filename string, partial *Partial, data []byte) error
+	// WriteBatch applies all writes of the batch in a single pass over the file, with WithAtomic either all or none
+	// of them are applied.
+	WriteBatch(filename string, batch *Batch, opts ...WriteOption) error
 	Delete(filename string) error
+	// Rename atomically moves the file or layer to the new name, an existing file of that name is replaced.
+	Rename(from string, to string) error
+	// Sync flushes the file contents to stable storage.
+	Sync(filename string) error
 }
 
 type writer struct {
-	path string
+	path     string
+	handles  *handlePool
+	readOnly bool
 }
 
 func (w *writer) CreateOrOverride(filename string, data []byte) error {
-	file, err := os.Create(w.pathToFile(filename))
-	if err != nil {
-		return errors.Wrapf(err, "%s could not open file", w.errorDescriptor(filename))
+	if w.readOnly {
+		return errors.Wrapf(ErrReadOnly, "%s could not write file", w.errorDescriptor(filename))
 	}
-
-	if _, err = file.Write(data); err != nil {
-		_ = file.Close()
-		return errors.Wrapf(err, "%s could not write to file", w.errorDescriptor(filename))
+	if err := w.writeAtomic(filename, data); err != nil {
+		return errors.Wrapf(err, "%s could not write file", w.errorDescriptor(filename))
 	}
-
-	return file.Close()
+	return nil
 }
 
-func (w *writer) Append(filename string, data []byte) error {
-	file, err := os.OpenFile(w.pathToFile(filename), os.O_APPEND|os.O_WRONLY, 0644)
+func (w *writer) Append(filename string, data []byte, opts ...WriteOption) error {
+	if w.readOnly {
+		return errors.Wrapf(ErrReadOnly, "%s could not write to file", w.errorDescriptor(filename))
+	}
+	h, err := w.handles.acquire(w.pathToFile(filename))
 	if err != nil {
 		return errors.Wrapf(err, "%s could not open file", w.errorDescriptor(filename))
 	}
 
-	if _, err = file.Write(data); err != nil {
-		_ = file.Close()
+	h.mu.Lock()
+	info, err := h.file.Stat()
+	if err == nil {
+		_, err = h.file.WriteAt(data, info.Size())
+	}
+	h.mu.Unlock()
+	if err != nil {
+		_ = w.handles.release(h)
 		return errors.Wrapf(err, "%s could not write to file", w.errorDescriptor(filename))
 	}
 
-	return file.Close()
+	if err := w.finish(h, newWriteOptions(opts)); err != nil {
+		return errors.Wrapf(err, "%s could not finish write", w.errorDescriptor(filename))
+	}
+	return nil
 }
 
-func (w *writer) Offset(filename string, offset int64, data []byte) error {
-	file, err := os.OpenFile(w.pathToFile(filename), os.O_WRONLY, 0644)
+func (w *writer) Offset(filename string, offset int64, data []byte, opts ...WriteOption) error {
+	if w.readOnly {
+		return errors.Wrapf(ErrReadOnly, "%s could not write to file", w.errorDescriptor(filename))
+	}
+	h, err := w.handles.acquire(w.pathToFile(filename))
 	if err != nil {
 		return errors.Wrapf(err, "%s could not open file", w.errorDescriptor(filename))
 	}
 
-	if _, err = file.WriteAt(data, offset); err != nil {
-		_ = file.Close()
+	if _, err = h.file.WriteAt(data, offset); err != nil {
+		_ = w.handles.release(h)
 		return errors.Wrapf(err, "%s could not write to file at offset [offset=%d]", w.errorDescriptor(filename), offset)
 	}
 
-	return file.Close()
+	if err := w.finish(h, newWriteOptions(opts)); err != nil {
+		return errors.Wrapf(err, "%s could not finish write at offset [offset=%d]", w.errorDescriptor(filename), offset)
+	}
+	return nil
 }
 
 func (w *writer) Replace(filename string, partial *Partial, data []byte) error {
-	file, err := os.Open(w.pathToFile(filename))
+	if w.readOnly {
+		return errors.Wrapf(ErrReadOnly, "%s could not write file", w.errorDescriptor(filename))
+	}
+	current, err := os.ReadFile(w.pathToFile(filename))
 	if err != nil {
-		return errors.Wrapf(err, "%s could not open file", w.errorDescriptor(filename))
+		return errors.Wrapf(err, "%s could not read file", w.errorDescriptor(filename))
 	}
 
-	var buffer bytes.Buffer
-	if _, err := io.CopyN(&buffer, file, partial.OffsetFrom); err != nil && err != io.EOF {
-		_ = file.Close()
-		return errors.Wrapf(err, "%s could not copy data to offset [fromOffset=%d]", w.errorDescriptor(filename), partial.OffsetFrom)
+	if err := w.writeAtomic(filename, replacePartial(current, partial, data)); err != nil {
+		return errors.Wrapf(err, "%s could not write file", w.errorDescriptor(filename))
 	}
+	return nil
+}
 
-	if _, err := buffer.Write(data); err != nil {
-		_ = file.Close()
-		return errors.Wrapf(err, "%s could not write the data into the buffer", w.errorDescriptor(filename))
+func (w *writer) WriteBatch(filename string, batch *Batch, opts ...WriteOption) error {
+	if w.readOnly {
+		return errors.Wrapf(ErrReadOnly, "%s could not write batch", w.errorDescriptor(filename))
 	}
 
-	if _, err := file.Seek(partial.OffsetTo, io.SeekStart); err != nil {
-		_ = file.Close()
-		return errors.Wrapf(err, "%s could not skip data until offset [toOffset=%d]", w.errorDescriptor(filename), partial.OffsetTo)
+	options := newWriteOptions(opts)
+	if options.atomic {
+		current, err := os.ReadFile(w.pathToFile(filename))
+		if err != nil {
+			return errors.Wrapf(err, "%s could not read file", w.errorDescriptor(filename))
+		}
+		data, err := batch.apply(current)
+		if err != nil {
+			return errors.Wrapf(err, "%s could not apply batch", w.errorDescriptor(filename))
+		}
+		if err := w.writeAtomic(filename, data); err != nil {
+			return errors.Wrapf(err, "%s could not write file", w.errorDescriptor(filename))
+		}
+		return nil
 	}
 
-	if _, err := io.Copy(&buffer, file); err != nil && err != io.EOF {
-		_ = file.Close()
-		return errors.Wrapf(err, "%s could not copy data after offset [toOffset=%d]", w.errorDescriptor(filename), partial.OffsetTo)
+	h, err := w.handles.acquire(w.pathToFile(filename))
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open file", w.errorDescriptor(filename))
 	}
 
-	if err := os.WriteFile(w.pathToFile(filename), buffer.Bytes(), 0644); err != nil {
-		_ = file.Close()
-		return errors.Wrapf(err, "%s could not write to file", w.errorDescriptor(filename))
+	h.mu.Lock()
+	err = w.writeResolved(h.file, batch)
+	h.mu.Unlock()
+	if err != nil {
+		_ = w.handles.release(h)
+		return errors.Wrapf(err, "%s could not write batch", w.errorDescriptor(filename))
 	}
 
-	return file.Close()
+	if err := w.finish(h, options); err != nil {
+		return errors.Wrapf(err, "%s could not finish batch", w.errorDescriptor(filename))
+	}
+	return nil
 }
 
 func (w *writer) Delete(filename string) error {
+	if w.readOnly {
+		return errors.Wrapf(ErrReadOnly, "%s could not delete file", w.errorDescriptor(filename))
+	}
+	if err := w.handles.invalidate(w.pathToFile(filename)); err != nil {
+		return errors.Wrapf(err, "%s could not close file", w.errorDescriptor(filename))
+	}
 	if err := os.Remove(w.pathToFile(filename)); err != nil {
 		return errors.Wrapf(err, "%s could not delete file", w.errorDescriptor(filename))
 	}
+	if err := syncDir(w.path); err != nil {
+		return errors.Wrapf(err, "%s could not sync directory", w.errorDescriptor(filename))
+	}
+	return nil
+}
+
+func (w *writer) Rename(from string, to string) error {
+	if w.readOnly {
+		return errors.Wrapf(ErrReadOnly, "%s could not rename file [to=%s]", w.errorDescriptor(from), to)
+	}
+
+	for _, name := range []string{from, to} {
+		if err := w.handles.invalidate(w.pathToFile(name)); err != nil {
+			return errors.Wrapf(err, "%s could not close file", w.errorDescriptor(name))
+		}
+		if err := w.handles.closePrefix(fmt.Sprintf("%s%c", w.pathToFile(name), filepath.Separator)); err != nil {
+			return errors.Wrapf(err, "%s could not close layer files", w.errorDescriptor(name))
+		}
+	}
+	if err := os.Rename(w.pathToFile(from), w.pathToFile(to)); err != nil {
+		return errors.Wrapf(err, "%s could not rename file [to=%s]", w.errorDescriptor(from), to)
+	}
+	if err := syncDir(w.path); err != nil {
+		return errors.Wrapf(err, "%s could not sync directory", w.errorDescriptor(from))
+	}
+	return nil
+}
+
+func (w *writer) Sync(filename string) error {
+	if w.readOnly {
+		return errors.Wrapf(ErrReadOnly, "%s could not sync file", w.errorDescriptor(filename))
+	}
+	h, err := w.handles.acquire(w.pathToFile(filename))
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open file", w.errorDescriptor(filename))
+	}
+
+	if err := w.finish(h, &writeOptions{sync: true}); err != nil {
+		return errors.Wrapf(err, "%s could not sync file", w.errorDescriptor(filename))
+	}
 	return nil
 }
 
+// writeAtomic writes the data into a temporary file next to the target, flushes it and renames it over the target,
+// so that a crash at any point leaves either the old or the new contents of the file behind, never a mix of both.
+func (w *writer) writeAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(w.path, tempFilePattern(filename))
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary file")
+	}
+
+	if err := w.writeTemp(tmp, data); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := w.handles.invalidate(w.pathToFile(filename)); err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "could not close file")
+	}
+	if err := os.Rename(tmp.Name(), w.pathToFile(filename)); err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrap(err, "could not rename temporary file")
+	}
+
+	if err := syncDir(w.path); err != nil {
+		return errors.Wrap(err, "could not sync directory")
+	}
+	return nil
+}
+
+func (w *writer) writeTemp(tmp *os.File, data []byte) error {
+	if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "could not set temporary file permissions")
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "could not write to temporary file")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return errors.Wrap(err, "could not sync temporary file")
+	}
+	return tmp.Close()
+}
+
+// writeResolved writes the coalesced writes of the batch, the caller must hold the lock of the handle of the file.
+func (w *writer) writeResolved(file *os.File, batch *Batch) error {
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "could not read file info")
+	}
+	writes, err := batch.resolve(info.Size())
+	if err != nil {
+		return err
+	}
+	for _, write := range writes {
+		if _, err := file.WriteAt(write.data, write.offset); err != nil {
+			return errors.Wrapf(err, "could not write at offset [offset=%d]", write.offset)
+		}
+	}
+	return nil
+}
+
+// finish syncs the file if requested and releases its handle.
+func (w *writer) finish(h *handle, opts *writeOptions) error {
+	if opts.sync {
+		if err := h.file.Sync(); err != nil {
+			_ = w.handles.release(h)
+			return errors.Wrap(err, "could not sync file")
+		}
+	}
+	return w.handles.release(h)
+}
+
 func (w *writer) pathToFile(filename string) string {
 	return fmt.Sprintf("%s%c%s", w.path, filepath.Separator, filename)
 }
@@ -113,3 +277,26 @@ func (w *writer) pathToFile(filename string) string {
 func (w *writer) errorDescriptor(filename string) string {
 	return fmt.Sprintf("(file=[filename=%s, path=%s])", filename, w.path)
 }
+
+// replacePartial returns a copy of data with the bytes between the partial offsets replaced by the given replacement.
+func replacePartial(data []byte, partial *Partial, replacement []byte) []byte {
+	size := int64(len(data))
+	from, to := min(partial.OffsetFrom, size), min(partial.OffsetTo, size)
+
+	res := make([]byte, 0, from+int64(len(replacement))+size-to)
+	res = append(res, data[:from]...)
+	res = append(res, replacement...)
+	return append(res, data[to:]...)
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"strings"
+)
+
+const tempFileSuffix = ".tmp"
+
+type WriteOption func(opts *writeOptions)
+
+type writeOptions struct {
+	sync      bool
+	atomic    bool
+	overwrite bool
+}
+
+// WithSync makes the write durable by flushing the file to stable storage before returning.
+func WithSync() WriteOption {
+	return func(opts *writeOptions) {
+		opts.sync = true
+	}
+}
+
+// WithAtomic makes a WriteBatch all-or-nothing by replacing the whole file atomically, it is ignored by other writes.
+func WithAtomic() WriteOption {
+	return func(opts *writeOptions) {
+		opts.atomic = true
+	}
+}
+
+// WithOverwrite makes an Offset replace the blocks it touches without reading them, the bytes of the blocks the data
+// does not cover are zeroed. Only the blocks before the block the data starts in are read, which are encoded again
+// when the data extends the file. It lets a log replay whole blocks over blocks torn by a crash, the data must
+// therefore start at the start of a block. It is ignored by storages that do not store their files in blocks.
+func WithOverwrite() WriteOption {
+	return func(opts *writeOptions) {
+		opts.overwrite = true
+	}
+}
+
+func newWriteOptions(opts []WriteOption) *writeOptions {
+	res := &writeOptions{}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+func tempFilePattern(filename string) string {
+	return "." + filename + ".*" + tempFileSuffix
+}
+
+// isTempFile reports whether the name belongs to a temporary file left behind by an atomic write.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, tempFileSuffix)
+}
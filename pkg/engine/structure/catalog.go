@@ -0,0 +1,286 @@
+package structure
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/identifier"
+	"ktdb/pkg/engine/storage"
+)
+
+// catalog caches the handles of the objects held by a parent object, so that every object is loaded once and its
+// handle is shared by all callers. Whether an object exists is always decided by the storage, so that the objects
+// created and deleted by other instances on the same storage are seen, the cache only saves loading them again.
+type catalog[T any] struct {
+	mu sync.Mutex
+	// storage is the storage of the parent object, holding a layer for every object
+	storage storage.Storage
+	kind    identifier.Kind
+	objects map[string]T
+	// closed is set once the parent object is dropped or renamed, the catalog fails with ErrNotFound from then on
+	closed bool
+}
+
+// closer is implemented by the handles that must be closed when their object is dropped or renamed.
+type closer interface {
+	// closeWith runs fn holding the object exclusively, the handle fails with ErrNotFound once fn succeeded.
+	closeWith(fn func() error) error
+}
+
+// loadFunc opens the object of the normalized name, creating its layer if it does not exist.
+type loadFunc[T any] func(name string) (T, error)
+
+func newCatalog[T any](s storage.Storage, kind identifier.Kind) *catalog[T] {
+	return &catalog[T]{
+		storage: s,
+		kind:    kind,
+		objects: make(map[string]T),
+	}
+}
+
+// list returns all objects ordered by name.
+func (c *catalog[T]) list(load loadFunc[T]) ([]T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	names, err := c.storage.List(storage.IsDirFilter)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list %s layers", c.kind)
+	}
+	sort.Strings(names)
+	listed := make(map[string]struct{}, len(names))
+	res := make([]T, len(names))
+	for i, name := range names {
+		if res[i], err = c.load(name, load); err != nil {
+			return nil, errors.Wrapf(err, "could not load %s", c.errorDescriptor(name))
+		}
+		listed[name] = struct{}{}
+	}
+	// The objects deleted by other instances are forgotten
+	for name := range c.objects {
+		if _, found := listed[name]; !found {
+			delete(c.objects, name)
+		}
+	}
+	return res, nil
+}
+
+// get returns the object of the name, it fails with ErrNotFound if there is none.
+func (c *catalog[T]) get(name string, load loadFunc[T]) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res T
+	if err := c.checkOpen(); err != nil {
+		return res, err
+	}
+	name, exists, err := c.lookup(name)
+	if err != nil {
+		return res, err
+	}
+	if !exists {
+		delete(c.objects, name) // It was deleted by another instance
+		return res, errors.Wrap(ErrNotFound, c.errorDescriptor(name))
+	}
+	return c.load(name, load)
+}
+
+// create creates the object of the name, it fails with ErrAlreadyExists if the name is taken. The object is only
+// created if there is none, unless mustCreate is set.
+func (c *catalog[T]) create(name string, mustCreate bool, load loadFunc[T], create loadFunc[T]) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res T
+	if err := c.checkOpen(); err != nil {
+		return res, err
+	}
+	name, exists, err := c.lookup(name)
+	if err != nil {
+		return res, err
+	}
+	if exists {
+		if mustCreate {
+			return res, errors.Wrap(ErrAlreadyExists, c.errorDescriptor(name))
+		}
+		return c.load(name, load)
+	}
+
+	res, err = create(name)
+	if err != nil {
+		return res, err
+	}
+	c.objects[name] = res
+	return res, nil
+}
+
+// rename moves the layer of the object to the new name, which must not be taken.
+func (c *catalog[T]) rename(from string, to string, load loadFunc[T]) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res T
+	if err := c.checkOpen(); err != nil {
+		return res, err
+	}
+	from, exists, err := c.lookup(from)
+	if err != nil {
+		return res, err
+	}
+	if !exists {
+		return res, errors.Wrap(ErrNotFound, c.errorDescriptor(from))
+	}
+	to, exists, err = c.lookup(to)
+	if err != nil {
+		return res, err
+	}
+	if exists {
+		return res, errors.Wrap(ErrAlreadyExists, c.errorDescriptor(to))
+	}
+
+	err = c.closeWith(from, func() error {
+		return c.storage.Rename(from, to)
+	})
+	delete(c.objects, from)
+	if err != nil {
+		return res, errors.Wrapf(err, "%s could not rename storage layer", c.errorDescriptor(from))
+	}
+	return c.load(to, load)
+}
+
+// drop removes the layer of the object of the name, it reports whether there was one.
+func (c *catalog[T]) drop(name string) (bool, error) {
+	return c.remove(name, nil)
+}
+
+// dropHandle drops the object of the name only if the handle is its cached handle, so that a handle that was
+// dropped or renamed never drops the object that took its name.
+func (c *catalog[T]) dropHandle(name string, handle T) (bool, error) {
+	return c.remove(name, handle)
+}
+
+// remove removes the layer of the object of the name, if the handle is not nil it must be the cached handle of the
+// object.
+func (c *catalog[T]) remove(name string, handle any) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.checkOpen(); err != nil {
+		return false, err
+	}
+
+	name, exists, err := c.lookup(name)
+	if err != nil || !exists {
+		return false, err
+	}
+	if object, found := c.objects[name]; handle != nil && (!found || any(object) != handle) {
+		return false, nil
+	}
+	err = c.closeWith(name, func() error {
+		return c.storage.RemoveLayer(name)
+	})
+	delete(c.objects, name)
+	if err != nil {
+		return false, errors.Wrapf(err, "%s could not remove storage layer", c.errorDescriptor(name))
+	}
+	return true, nil
+}
+
+// closeWith runs fn through the cached handle of the object of the name if it is a closer, the caller must hold the
+// lock.
+func (c *catalog[T]) closeWith(name string, fn func() error) error {
+	if object, found := c.objects[name]; found {
+		if handle, ok := any(object).(closer); ok {
+			return handle.closeWith(fn)
+		}
+	}
+	return fn()
+}
+
+// closeAll runs fn holding every cached object exclusively, once fn succeeds the handles of the objects and the
+// catalog are closed. It is how the handles of a parent object close the handles of the objects it holds.
+func (c *catalog[T]) closeAll(fn func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.objects))
+	for name := range c.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Every object is closed within the closing of the previous one, so that either all or none of them are closed
+	var closeFrom func(i int) error
+	closeFrom = func(i int) error {
+		if i < len(names) {
+			return c.closeWith(names[i], func() error { return closeFrom(i + 1) })
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		c.closed = true
+		clear(c.objects)
+		return nil
+	}
+	return closeFrom(0)
+}
+
+// checkOpen fails with ErrNotFound once the parent object is dropped or renamed, the caller must hold the lock.
+func (c *catalog[T]) checkOpen() error {
+	if c.closed {
+		return errors.Wrap(ErrNotFound, "parent object was dropped or renamed")
+	}
+	return nil
+}
+
+// lookup normalizes the name and reports whether the object exists, the caller must hold the lock. The returned name
+// is the name of the layer of the object, which is not folded for the layers created before the names were.
+func (c *catalog[T]) lookup(name string) (string, bool, error) {
+	name, err := identifier.Normalize(c.kind, name)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "invalid %s name", c.kind)
+	}
+	exists, err := c.storage.Exists(name)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "%s could not check existence", c.errorDescriptor(name))
+	}
+	if exists {
+		return name, true, nil
+	}
+	return c.legacyLayer(name)
+}
+
+// legacyLayer looks for a layer whose name folds to the normalized name, the caller must hold the lock.
+func (c *catalog[T]) legacyLayer(name string) (string, bool, error) {
+	layers, err := c.storage.List(storage.IsDirFilter)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "%s could not list %s layers", c.errorDescriptor(name), c.kind)
+	}
+	for _, layer := range layers {
+		if identifier.Fold(layer) == name {
+			return layer, true, nil
+		}
+	}
+	return name, false, nil
+}
+
+// load returns the cached object of the normalized name or loads it, the caller must hold the lock.
+func (c *catalog[T]) load(name string, load loadFunc[T]) (T, error) {
+	if object, found := c.objects[name]; found {
+		return object, nil
+	}
+	object, err := load(name)
+	if err != nil {
+		return object, err
+	}
+	c.objects[name] = object
+	return object, nil
+}
+
+func (c *catalog[T]) errorDescriptor(name string) string {
+	return fmt.Sprintf("(%s=[name=%s])", c.kind, name)
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/pkg/errors"
 
+	"ktdb/pkg/engine/identifier"
 	"ktdb/pkg/engine/storage"
 )
 
@@ -15,7 +16,11 @@ type Database interface {
 }
 
 type database struct {
+	options *options
+	// catalog is the catalog of the structure holding the database
+	catalog *catalog[Database]
 	storage storage.Storage
+	schemas *catalog[Schema]
 	name    string
 }
 
@@ -23,49 +28,83 @@ func (d *database) Name() string {
 	return d.name
 }
 
-func (d *database) List(ctx context.Context) ([]Schema, error) {
-	schemaNames, err := d.storage.List(storage.IsDirFilter)
+func (d *database) List(_ context.Context) ([]Schema, error) {
+	schemas, err := d.schemas.list(d.load)
 	if err != nil {
 		return nil, errors.Wrapf(err, "%s could not list schemas", d.errorDescriptor())
 	}
-	schemas := make([]Schema, len(schemaNames))
-	for i, schemaName := range schemaNames {
-		schemas[i], err = d.Get(ctx, schemaName)
-		if err != nil {
-			return nil, errors.Wrapf(err, "%s could not get schema", d.errorDescriptor())
-		}
-	}
 	return schemas, nil
 }
 
-func (d *database) Create(ctx context.Context, name string) (Schema, error) {
-	return d.load(ctx, name)
+func (d *database) Create(_ context.Context, name string) (Schema, error) {
+	sch, err := d.schemas.create(name, true, d.load, d.load)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not create schema", d.errorDescriptor())
+	}
+	return sch, nil
 }
 
-func (d *database) Get(ctx context.Context, name string) (Schema, error) {
-	return d.load(ctx, name)
+func (d *database) CreateIfNotExists(_ context.Context, name string) (Schema, error) {
+	sch, err := d.schemas.create(name, false, d.load, d.load)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not create schema", d.errorDescriptor())
+	}
+	return sch, nil
 }
 
-func (d *database) Delete(ctx context.Context) error {
-	schemas, err := d.List(ctx)
+func (d *database) Get(_ context.Context, name string) (Schema, error) {
+	sch, err := d.schemas.get(name, d.load)
 	if err != nil {
-		return errors.Wrapf(err, "%s could not list schemas", d.errorDescriptor())
+		return nil, errors.Wrapf(err, "%s could not get schema", d.errorDescriptor())
 	}
-	for _, item := range schemas {
-		if err := item.Delete(ctx); err != nil {
-			return errors.Wrapf(err, "%s could not delete schema", d.errorDescriptor())
-		}
+	return sch, nil
+}
+
+func (d *database) DropIfExists(_ context.Context, name string) error {
+	if _, err := d.schemas.drop(name); err != nil {
+		return errors.Wrapf(err, "%s could not drop schema", d.errorDescriptor())
 	}
 	return nil
 }
 
-func (d *database) load(_ context.Context, name string) (Schema, error) {
-	schemaStorage, err := d.storage.NewLayer(name)
+func (d *database) Rename(_ context.Context, from string, to string) (Schema, error) {
+	sch, err := d.schemas.rename(from, to, d.load)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not rename schema [from=%s, to=%s]", d.errorDescriptor(), from, to)
+	}
+	return sch, nil
+}
+
+func (d *database) Delete(_ context.Context) error {
+	dropped, err := d.catalog.dropHandle(d.name, d)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not delete database", d.errorDescriptor())
+	}
+	if !dropped {
+		return errors.Wrapf(ErrNotFound, "%s could not delete database", d.errorDescriptor())
+	}
+	return nil
+}
+
+// closeWith runs fn holding the database and its cached schemas exclusively, closing their handles if fn succeeds.
+func (d *database) closeWith(fn func() error) error {
+	return d.schemas.closeAll(fn)
+}
+
+// load opens the schema of the normalized name, creating its layer if it does not exist.
+func (d *database) load(name string) (Schema, error) {
+	tableStorage, err := d.storage.NewLayer(name)
 	if err != nil {
 		return nil, errors.Wrapf(err, "%s could not create storage layer", d.errorDescriptor())
 	}
 
-	return &schema{name: name, storage: schemaStorage}, nil
+	return &schema{
+		name:    name,
+		options: d.options,
+		catalog: d.schemas,
+		storage: tableStorage,
+		tables:  newCatalog[Table](tableStorage, identifier.KindTable),
+	}, nil
 }
 
 func (d *database) errorDescriptor() string {
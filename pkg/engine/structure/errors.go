@@ -0,0 +1,20 @@
+package structure
+
+import (
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned when getting an object that does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists is returned when creating an object under a name that is taken.
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrRowDeleted is returned when reading or deleting a deleted row.
+	ErrRowDeleted = errors.New("row deleted")
+	// ErrUnsupported is returned when using a feature the format of a table was created without.
+	ErrUnsupported = errors.New("unsupported by the table format")
+	// ErrNoKeyProvider is returned when creating or opening an encrypted table of a structure without WithKeyProvider.
+	ErrNoKeyProvider = errors.New("no key provider")
+	// ErrScanInvalidated is returned by a scan of a table that was vacuumed or altered since the scan started.
+	ErrScanInvalidated = errors.New("scan invalidated")
+)
@@ -4,7 +4,15 @@ import "context"
 
 type Processor[T any] interface {
 	List(ctx context.Context) ([]T, error)
+	// Create fails with ErrAlreadyExists if the name is taken.
 	Create(ctx context.Context, name string) (T, error)
+	// CreateIfNotExists returns the existing object of the name or creates it.
+	CreateIfNotExists(ctx context.Context, name string) (T, error)
+	// Get fails with ErrNotFound if there is no object of the name.
 	Get(ctx context.Context, name string) (T, error)
+	// Rename atomically moves the object with all of its contents to the new name, which must not be taken.
+	Rename(ctx context.Context, from string, to string) (T, error)
+	// DropIfExists deletes the object of the name if there is one.
+	DropIfExists(ctx context.Context, name string) error
 	Delete(ctx context.Context) error
 }
@@ -13,13 +13,26 @@ import (
 type Schema interface {
 	Name() string
 	List(ctx context.Context) ([]Table, error)
+	// Get fails with ErrNotFound if there is no table of the name.
 	Get(ctx context.Context, name string) (Table, error)
-	Create(ctx context.Context, name string, schema *row.Schema) (Table, error)
+	// Create fails with ErrAlreadyExists if the name is taken.
+	Create(ctx context.Context, name string, schema *row.Schema, opts ...TableOption) (Table, error)
+	// CreateIfNotExists returns the existing table of the name or creates it, the schema is ignored for an existing
+	// table.
+	CreateIfNotExists(ctx context.Context, name string, schema *row.Schema, opts ...TableOption) (Table, error)
+	// Rename atomically moves the table with all of its files to the new name, which must not be taken.
+	Rename(ctx context.Context, from string, to string) (Table, error)
+	// DropIfExists deletes the table of the name if there is one.
+	DropIfExists(ctx context.Context, name string) error
 	Delete(ctx context.Context) error
 }
 
 type schema struct {
+	options *options
+	// catalog is the catalog of the database holding the schema
+	catalog *catalog[Schema]
 	storage storage.Storage
+	tables  *catalog[Table]
 	name    string
 }
 
@@ -27,64 +40,108 @@ func (s *schema) Name() string {
 	return s.name
 }
 
-func (s *schema) List(ctx context.Context) ([]Table, error) {
-	tblNames, err := s.storage.List(storage.IsDirFilter)
+func (s *schema) List(_ context.Context) ([]Table, error) {
+	tables, err := s.tables.list(s.load)
 	if err != nil {
 		return nil, errors.Wrapf(err, "%s could not list tables", s.errorDescriptor())
 	}
-	schemas := make([]Table, len(tblNames))
-	for i, tblName := range tblNames {
-		schemas[i], err = s.Get(ctx, tblName)
-		if err != nil {
-			return nil, errors.Wrapf(err, "%s could not get table", s.errorDescriptor())
-		}
-	}
-	return schemas, nil
+	return tables, nil
 }
 
-func (s *schema) Create(_ context.Context, name string, schema *row.Schema) (Table, error) {
-	tableStorage, err := s.storage.NewLayer(name)
+func (s *schema) Create(_ context.Context, name string, schema *row.Schema, opts ...TableOption) (Table, error) {
+	tbl, err := s.tables.create(name, true, s.load, s.create(schema, opts))
 	if err != nil {
-		return nil, errors.Wrapf(err, "%s could not create storage layer", s.errorDescriptor())
+		return nil, errors.Wrapf(err, "%s could not create table", s.errorDescriptor())
 	}
+	return tbl, nil
+}
 
-	tbl := &table{storage: tableStorage, schema: schema, name: name}
-	if err := tbl.create(); err != nil {
+func (s *schema) CreateIfNotExists(_ context.Context, name string, schema *row.Schema, opts ...TableOption) (Table, error) {
+	tbl, err := s.tables.create(name, false, s.load, s.create(schema, opts))
+	if err != nil {
 		return nil, errors.Wrapf(err, "%s could not create table", s.errorDescriptor())
 	}
 	return tbl, nil
 }
 
 func (s *schema) Get(_ context.Context, name string) (Table, error) {
-	tableStorage, err := s.storage.NewLayer(name)
+	tbl, err := s.tables.get(name, s.load)
 	if err != nil {
-		return nil, errors.Wrapf(err, "%s could not create storage layer", s.errorDescriptor())
+		return nil, errors.Wrapf(err, "%s could not get table", s.errorDescriptor())
 	}
+	return tbl, nil
+}
 
-	tbl := &table{
-		storage: tableStorage,
-		schema:  nil,
-		name:    name,
+func (s *schema) DropIfExists(_ context.Context, name string) error {
+	if _, err := s.tables.drop(name); err != nil {
+		return errors.Wrapf(err, "%s could not drop table", s.errorDescriptor())
 	}
-	if err := tbl.load(); err != nil {
-		return nil, errors.Wrapf(err, "%s could not load table", s.errorDescriptor())
+	return nil
+}
+
+func (s *schema) Rename(_ context.Context, from string, to string) (Table, error) {
+	tbl, err := s.tables.rename(from, to, s.load)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not rename table [from=%s, to=%s]", s.errorDescriptor(), from, to)
 	}
 	return tbl, nil
 }
 
-func (s *schema) Delete(ctx context.Context) error {
-	tables, err := s.List(ctx)
+func (s *schema) Delete(_ context.Context) error {
+	dropped, err := s.catalog.dropHandle(s.name, s)
 	if err != nil {
-		return errors.Wrapf(err, "%s could not list tables", s.errorDescriptor())
+		return errors.Wrapf(err, "%s could not delete schema", s.errorDescriptor())
 	}
-	for _, item := range tables {
-		if err := item.Delete(ctx); err != nil {
-			return errors.Wrapf(err, "%s could not delete table", s.errorDescriptor())
-		}
+	if !dropped {
+		return errors.Wrapf(ErrNotFound, "%s could not delete schema", s.errorDescriptor())
 	}
 	return nil
 }
 
+// closeWith runs fn holding the schema and its cached tables exclusively, closing their handles if fn succeeds.
+func (s *schema) closeWith(fn func() error) error {
+	return s.tables.closeAll(fn)
+}
+
+// create returns the function creating a table of the row schema under a normalized name.
+func (s *schema) create(schema *row.Schema, opts []TableOption) loadFunc[Table] {
+	return func(name string) (Table, error) {
+		tableStorage, err := s.storage.NewLayer(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create storage layer")
+		}
+
+		tbl := &table{catalog: s.tables, storage: tableStorage, keys: s.options.keys, history: row.NewHistory(schema), name: name}
+		if err := tbl.create(opts); err != nil {
+			if removeErr := s.storage.RemoveLayer(name); removeErr != nil { // A half created table would take the name
+				return nil, errors.Wrapf(err, "could not remove storage layer (%s)", removeErr)
+			}
+			return nil, err
+		}
+		return tbl, nil
+	}
+}
+
+// load opens the existing table of the normalized name.
+func (s *schema) load(name string) (Table, error) {
+	tableStorage, err := s.storage.NewLayer(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create storage layer")
+	}
+
+	tbl := &table{
+		catalog: s.tables,
+		storage: tableStorage,
+		keys:    s.options.keys,
+		history: nil,
+		name:    name,
+	}
+	if err := tbl.load(); err != nil {
+		return nil, err
+	}
+	return tbl, nil
+}
+
 func (s *schema) errorDescriptor() string {
 	return fmt.Sprintf("(schema=[name=%s])", s.name)
 }
@@ -0,0 +1,394 @@
+package structure_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/column_types"
+	"ktdb/pkg/engine/grid/row"
+	"ktdb/pkg/engine/storage"
+	"ktdb/pkg/engine/structure"
+)
+
+func TestSchema(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("success - deleted table disappears", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+		require.NoError(t, tbl.Delete(ctx))
+
+		tables, err := f.schema.List(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, tables)
+		_, err = f.schema.Get(ctx, "users")
+		assert.Error(t, err)
+	})
+
+	t.Run("success - rename table", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		renamed, err := f.schema.Rename(ctx, "users", "people")
+		require.NoError(t, err)
+		assert.Equal(t, "people", renamed.Name())
+		r, err := renamed.Row(1)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(1), f.value(t, r))
+
+		tables, err := f.schema.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, tables, 1)
+		assert.Equal(t, "people", tables[0].Name())
+	})
+
+	t.Run("fail - rename to existing table", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		_, err = f.schema.Create(ctx, "people", f.rowSchema)
+		require.NoError(t, err)
+
+		_, err = f.schema.Rename(ctx, "users", "people")
+		assert.ErrorIs(t, err, structure.ErrAlreadyExists)
+	})
+
+	t.Run("fail - rename missing table", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Rename(ctx, "users", "people")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+	})
+
+	t.Run("success - create if not exists keeps the existing table", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		tbl, err = f.schema.CreateIfNotExists(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		total, err := tbl.TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), total)
+	})
+
+	t.Run("success - drop if exists", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+
+		require.NoError(t, f.schema.DropIfExists(ctx, "users"))
+		require.NoError(t, f.schema.DropIfExists(ctx, "users"))
+		_, err = f.schema.Get(ctx, "users")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+	})
+
+	t.Run("fail - create existing table", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		_, err = f.schema.Create(ctx, "Users", f.rowSchema)
+		assert.ErrorIs(t, err, structure.ErrAlreadyExists)
+		tbl, err = f.schema.Get(ctx, "users")
+		require.NoError(t, err)
+		total, err := tbl.TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), total)
+	})
+
+	t.Run("fail - get missing table", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Get(ctx, "users")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+	})
+}
+
+func TestSchema_Catalog(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("success - table handles are shared", func(t *testing.T) {
+		f := newFixture(t)
+		created, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+
+		tbl, err := f.schema.Get(ctx, "Users")
+		require.NoError(t, err)
+		assert.Same(t, created, tbl)
+		tables, err := f.schema.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, tables, 1)
+		assert.Same(t, created, tables[0])
+	})
+
+	t.Run("success - cached handles are not loaded again", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		_, err = f.schema.List(ctx)
+		require.NoError(t, err)
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpReadAll, Filename: "schema.bin"})
+		_, err = f.schema.Get(ctx, "users")
+		assert.NoError(t, err)
+		tables, err := f.schema.List(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, tables, 1)
+	})
+
+	t.Run("success - tables of another instance are seen", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.List(ctx)
+		require.NoError(t, err)
+		_, err = f.schema.Get(ctx, "users")
+		require.ErrorIs(t, err, structure.ErrNotFound)
+
+		other := f.reopen(t)
+		created, err := other.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, created.Append(f.row(t, 1)))
+
+		_, err = f.schema.Create(ctx, "users", f.rowSchema)
+		assert.ErrorIs(t, err, structure.ErrAlreadyExists)
+		tbl, err := f.schema.Get(ctx, "users")
+		require.NoError(t, err)
+		r, err := tbl.Row(1)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(1), f.value(t, r))
+		tables, err := f.schema.List(ctx)
+		require.NoError(t, err)
+		assert.Len(t, tables, 1)
+
+		require.NoError(t, other.DropIfExists(ctx, "users"))
+		_, err = f.schema.Get(ctx, "users")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		tables, err = f.schema.List(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, tables)
+	})
+
+	t.Run("success - drop and rename invalidate handles", func(t *testing.T) {
+		f := newFixture(t)
+		users, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		_, err = f.schema.Create(ctx, "orders", f.rowSchema)
+		require.NoError(t, err)
+		_, err = f.schema.List(ctx)
+		require.NoError(t, err)
+
+		people, err := f.schema.Rename(ctx, "users", "people")
+		require.NoError(t, err)
+		assert.NotSame(t, users, people)
+		require.NoError(t, f.schema.DropIfExists(ctx, "orders"))
+
+		_, err = f.schema.Get(ctx, "users")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		_, err = f.schema.Get(ctx, "orders")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		tables, err := f.schema.List(ctx)
+		require.NoError(t, err)
+		require.Len(t, tables, 1)
+		assert.Same(t, people, tables[0])
+	})
+
+	t.Run("fail - dropped and renamed handles are closed", func(t *testing.T) {
+		f := newFixture(t)
+		users, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, users.Append(f.row(t, 1)))
+		orders, err := f.schema.Create(ctx, "orders", f.rowSchema)
+		require.NoError(t, err)
+		scanner, err := orders.Scan(ctx, structure.ScanOptions{})
+		require.NoError(t, err)
+
+		people, err := f.schema.Rename(ctx, "users", "people")
+		require.NoError(t, err)
+		require.NoError(t, f.schema.DropIfExists(ctx, "orders"))
+
+		assert.ErrorIs(t, users.Append(f.row(t, 2)), structure.ErrNotFound)
+		_, err = users.Row(1)
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		assert.ErrorIs(t, orders.Append(f.row(t, 1)), structure.ErrNotFound)
+		_, err = orders.TotalRows()
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		assert.False(t, scanner.Next())
+		assert.ErrorIs(t, scanner.Err(), structure.ErrNotFound)
+		total, err := people.TotalRows()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), total)
+	})
+
+	t.Run("fail - renamed handle does not delete the table taking its name", func(t *testing.T) {
+		f := newFixture(t)
+		users, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		_, err = f.schema.Rename(ctx, "users", "people")
+		require.NoError(t, err)
+		_, err = f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+
+		assert.ErrorIs(t, users.Delete(ctx), structure.ErrNotFound)
+		tables, err := f.schema.List(ctx)
+		require.NoError(t, err)
+		assert.Len(t, tables, 2)
+	})
+
+	t.Run("fail - renamed schema and database handles do not delete the objects taking their names", func(t *testing.T) {
+		st, err := structure.New(storage.NewMemory())
+		require.NoError(t, err)
+		db, err := st.Create(ctx, "db")
+		require.NoError(t, err)
+		sch, err := db.Create(ctx, "sch")
+		require.NoError(t, err)
+
+		_, err = db.Rename(ctx, "sch", "archive")
+		require.NoError(t, err)
+		_, err = db.Create(ctx, "sch")
+		require.NoError(t, err)
+		assert.ErrorIs(t, sch.Delete(ctx), structure.ErrNotFound)
+		schemas, err := db.List(ctx)
+		require.NoError(t, err)
+		assert.Len(t, schemas, 2)
+
+		_, err = st.Rename(ctx, "db", "old")
+		require.NoError(t, err)
+		_, err = st.Create(ctx, "db")
+		require.NoError(t, err)
+		assert.ErrorIs(t, db.Delete(ctx), structure.ErrNotFound)
+		databases, err := st.List(ctx)
+		require.NoError(t, err)
+		assert.Len(t, databases, 2)
+	})
+
+	t.Run("fail - table handles are closed with their schema and database", func(t *testing.T) {
+		f := newFixture(t)
+		st, err := structure.New(storage.NewMemory())
+		require.NoError(t, err)
+		db, err := st.Create(ctx, "db")
+		require.NoError(t, err)
+		dropped, err := db.Create(ctx, "dropped")
+		require.NoError(t, err)
+		orders, err := dropped.Create(ctx, "orders", f.rowSchema)
+		require.NoError(t, err)
+		renamed, err := db.Create(ctx, "renamed")
+		require.NoError(t, err)
+		users, err := renamed.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, users.Append(f.row(t, 1)))
+
+		require.NoError(t, db.DropIfExists(ctx, "dropped"))
+		assert.ErrorIs(t, orders.Append(f.row(t, 1)), structure.ErrNotFound)
+		_, err = dropped.Get(ctx, "orders")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+
+		_, err = st.Rename(ctx, "db", "archive")
+		require.NoError(t, err)
+		_, err = users.Row(1)
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		_, err = renamed.List(ctx)
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		_, err = db.Get(ctx, "renamed")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+
+		archive, err := st.Get(ctx, "archive")
+		require.NoError(t, err)
+		sch, err := archive.Get(ctx, "renamed")
+		require.NoError(t, err)
+		tbl, err := sch.Get(ctx, "users")
+		require.NoError(t, err)
+		total, err := tbl.TotalRows()
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), total)
+	})
+
+	t.Run("fail - failed create leaves the name free", func(t *testing.T) {
+		f := newFixture(t)
+		f.faulty.Inject(storage.Fault{Op: storage.OpCreateOrOverride, Filename: "wal.bin", Nth: 1})
+		_, err := f.schema.Create(ctx, "users", f.rowSchema)
+		assert.ErrorIs(t, err, storage.ErrInjected)
+
+		_, err = f.schema.Create(ctx, "users", f.rowSchema)
+		assert.NoError(t, err)
+	})
+}
+
+func TestStructure(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("success - get does not create the database", func(t *testing.T) {
+		s, err := structure.New(storage.NewMemory())
+		require.NoError(t, err)
+
+		_, err = s.Get(ctx, "db")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		dbs, err := s.List(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, dbs)
+	})
+
+	t.Run("success - create if not exists and drop if exists", func(t *testing.T) {
+		s, err := structure.New(storage.NewMemory())
+		require.NoError(t, err)
+		db, err := s.Create(ctx, "db")
+		require.NoError(t, err)
+		_, err = db.Create(ctx, "sch")
+		require.NoError(t, err)
+
+		_, err = s.Create(ctx, "db")
+		assert.ErrorIs(t, err, structure.ErrAlreadyExists)
+		db, err = s.CreateIfNotExists(ctx, "db")
+		require.NoError(t, err)
+		_, err = db.Get(ctx, "sch")
+		assert.NoError(t, err)
+
+		require.NoError(t, s.DropIfExists(ctx, "db"))
+		require.NoError(t, s.DropIfExists(ctx, "db"))
+		_, err = s.Get(ctx, "db")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+	})
+
+	t.Run("success - tables are read and written through the buffer pool", func(t *testing.T) {
+		f := newFixture(t)
+		memory := storage.NewMemory()
+		pool, err := storage.NewBufferPool(4096, 64)
+		require.NoError(t, err)
+		s, err := structure.New(memory, structure.WithBufferPool(pool))
+		require.NoError(t, err)
+		db, err := s.Create(ctx, "db")
+		require.NoError(t, err)
+		sch, err := db.Create(ctx, "sch")
+		require.NoError(t, err)
+		tbl, err := sch.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 1), f.row(t, 2)}))
+		require.NoError(t, tbl.Set(1, f.row(t, 3)))
+
+		for range 2 {
+			r, err := tbl.Row(1)
+			require.NoError(t, err)
+			assert.Equal(t, column_types.Int(3), f.value(t, r))
+		}
+		assert.Positive(t, pool.Stats().Hits)
+
+		require.NoError(t, pool.Flush())
+		unbuffered, err := structure.New(memory)
+		require.NoError(t, err)
+		db, err = unbuffered.Get(ctx, "db")
+		require.NoError(t, err)
+		sch, err = db.Get(ctx, "sch")
+		require.NoError(t, err)
+		tbl, err = sch.Get(ctx, "users")
+		require.NoError(t, err)
+		r, err := tbl.Row(1)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(3), f.value(t, r))
+	})
+}
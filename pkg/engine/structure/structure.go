@@ -5,42 +5,106 @@ import (
 
 	"github.com/pkg/errors"
 
+	"ktdb/pkg/engine/identifier"
 	"ktdb/pkg/engine/storage"
 )
 
 type Structure Processor[Database]
 
-func New(storage storage.Storage) (Structure, error) {
+type options struct {
+	pool *storage.BufferPool
+	keys storage.KeyProvider
+}
+
+// Option configures the storage stack the structure builds on top of the given storage.
+type Option func(opts *options)
+
+// WithBufferPool reads and writes the files of all databases through the pages of the pool, see storage.NewBuffered.
+// The writes of the rows are buffered until their pages are evicted, the pool is flushed or the tables checkpoint
+// their logs, the logs themselves are written through. The pool can be shared by several structures.
+func WithBufferPool(pool *storage.BufferPool) Option {
+	return func(opts *options) {
+		opts.pool = pool
+	}
+}
+
+// WithKeyProvider supplies the key the tables created WithEncryption are encrypted with, it is required to create and
+// to open them.
+func WithKeyProvider(keys storage.KeyProvider) Option {
+	return func(opts *options) {
+		opts.keys = keys
+	}
+}
+
+// New returns the structure of the databases held by the storage. The handles of the databases, schemas and tables
+// are cached and shared, all changes to them must therefore go through the returned structure.
+func New(s storage.Storage, opts ...Option) (Structure, error) {
+	options := &options{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.pool != nil {
+		s = storage.NewBuffered(s, options.pool)
+	}
+
 	return &structure{
-		storage: storage,
+		options:   options,
+		storage:   s,
+		databases: newCatalog[Database](s, identifier.KindDatabase),
 	}, nil
 }
 
 type structure struct {
-	storage storage.Storage
+	options   *options
+	storage   storage.Storage
+	databases *catalog[Database]
 }
 
-func (s *structure) List(ctx context.Context) ([]Database, error) {
-	databaseNames, err := s.storage.List(storage.IsDirFilter)
+func (s *structure) List(_ context.Context) ([]Database, error) {
+	dbs, err := s.databases.list(s.load)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not list databases")
 	}
-	dbs := make([]Database, len(databaseNames))
-	for i, dbName := range databaseNames {
-		dbs[i], err = s.Get(ctx, dbName)
-		if err != nil {
-			return nil, errors.Wrap(err, "could not get database")
-		}
-	}
 	return dbs, nil
 }
 
-func (s *structure) Create(ctx context.Context, name string) (Database, error) {
-	return s.load(ctx, name)
+func (s *structure) Create(_ context.Context, name string) (Database, error) {
+	db, err := s.databases.create(name, true, s.load, s.load)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create database")
+	}
+	return db, nil
 }
 
-func (s *structure) Get(ctx context.Context, name string) (Database, error) {
-	return s.load(ctx, name)
+func (s *structure) CreateIfNotExists(_ context.Context, name string) (Database, error) {
+	db, err := s.databases.create(name, false, s.load, s.load)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create database")
+	}
+	return db, nil
+}
+
+func (s *structure) Get(_ context.Context, name string) (Database, error) {
+	db, err := s.databases.get(name, s.load)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get database")
+	}
+	return db, nil
+}
+
+func (s *structure) DropIfExists(_ context.Context, name string) error {
+	if _, err := s.databases.drop(name); err != nil {
+		return errors.Wrap(err, "could not drop database")
+	}
+	return nil
+}
+
+func (s *structure) Rename(_ context.Context, from string, to string) (Database, error) {
+	db, err := s.databases.rename(from, to, s.load)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not rename database [from=%s, to=%s]", from, to)
+	}
+	return db, nil
 }
 
 func (s *structure) Delete(ctx context.Context) error {
@@ -56,11 +120,18 @@ func (s *structure) Delete(ctx context.Context) error {
 	return nil
 }
 
-func (s *structure) load(_ context.Context, name string) (Database, error) {
+// load opens the database of the normalized name, creating its layer if it does not exist.
+func (s *structure) load(name string) (Database, error) {
 	schemaStorage, err := s.storage.NewLayer(name)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create storage layer")
 	}
 
-	return &database{name: name, storage: schemaStorage}, nil
+	return &database{
+		name:    name,
+		options: s.options,
+		catalog: s.databases,
+		storage: schemaStorage,
+		schemas: newCatalog[Schema](schemaStorage, identifier.KindSchema),
+	}, nil
 }
@@ -3,30 +3,97 @@ package structure
 import (
 	"context"
 	"fmt"
+	"os"
+	"slices"
+	"sync"
 
 	"github.com/pkg/errors"
 
+	"ktdb/pkg/engine/grid/column"
 	"ktdb/pkg/engine/grid/row"
 	"ktdb/pkg/engine/storage"
 )
 
 const tblDataFile = "data.bin"
+
+// tblDataFileFormat is the name of the data files of the generations after the first one.
+const tblDataFileFormat = "data.%d.bin"
 const tblSchemaFile = "schema.bin"
 
+// tblSchemaFileFormat is the name of the schema files of the generations after the first one.
+const tblSchemaFileFormat = "schema.%d.bin"
+const tblWalFile = "wal.bin"
+
+// tblWalCheckpointSize is the size of the write-ahead log after which it gets checkpointed.
+const tblWalCheckpointSize = 1 << 20
+
+// Table is safe for concurrent use. The reads run concurrently with each other while the writes, the alters and the
+// vacuums run one at a time and exclude the reads, so a read observes either all or none of a write. A scan only
+// holds the table while reading its next row and reads the rows in chunks, the writes made during a scan are seen
+// by the chunks read after them. The tables of different processes sharing the data directory are coordinated
+// through Lock instead.
 type Table interface {
 	Name() string
 	Schema() *row.Schema
+	// Row returns a copy of the row owned by the caller, it fails with ErrRowDeleted if the row was deleted.
 	Row(id int64) (row.Row, error)
+	// Set writes the row, reviving it if it was deleted. The rows skipped when setting a row past the end of the
+	// table are deleted.
 	Set(id int64, r row.Row) error
+	// SetMany sets the rows by their ids with a single write of the log and the data file.
+	SetMany(rows map[int64]row.Row) error
+	// Append writes the row to the lowest deleted row, or past the end of the table if there is none. The first call
+	// of Append, AppendMany, DeleteRow, LiveRows or Vacuum after the table is opened reads the header of every row to
+	// find the deleted ones, holding the table exclusively for the time it takes.
 	Append(r row.Row) error
+	// AppendMany appends the rows in order with a single write of the log and the data file.
+	AppendMany(rows []row.Row) error
+	// DeleteRow marks the row as deleted, its slot is reused by the next append. It fails with ErrUnsupported for
+	// tables created before rows could be deleted, until they are vacuumed or upgraded.
+	DeleteRow(id int64) error
+	// TotalRows returns the number of rows including the deleted ones, it is the highest row id.
 	TotalRows() (int64, error)
+	// LiveRows returns the number of rows that are not deleted.
+	LiveRows() (int64, error)
+	// Scan iterates over the live rows in the range of the options, reading them in chunks. The rows appended after
+	// the scan started are not included unless the range ends past them. The scan fails with ErrScanInvalidated once
+	// the table is vacuumed or altered.
+	Scan(ctx context.Context, opts ScanOptions) (Scanner, error)
+	// Vacuum compacts the table by rewriting its live rows without the deleted ones in between, which changes their
+	// ids. The rows are migrated to the latest version of the schema. It is safe to interrupt at any point.
+	Vacuum(ctx context.Context, opts ...VacuumOption) (*VacuumResult, error)
+	// Alter changes the columns of the table, validating the new columns against the processor. Renaming columns and
+	// adding columns that fit into the bytes reserved by WithReservedBytes only add a version to the schema, the rows
+	// are upgraded to it on read. The other changes rewrite the rows. It is safe to interrupt at any point.
+	Alter(ctx context.Context, processor column.Processor, changes ...AlterChange) error
+	// Lock takes an advisory lock on the table, processes sharing the data directory coordinate through it by taking
+	// storage.LockShared to read and storage.LockExclusive to write. Tables are never locked implicitly.
+	Lock(mode storage.LockMode) (storage.FileLock, error)
 	Delete(ctx context.Context) error
 }
 
 type table struct {
+	// mu is held shared by the reads and exclusively by the writes of the table
+	mu sync.RWMutex
+	// catalog is the catalog of the schema holding the table
+	catalog *catalog[Table]
 	storage storage.Storage
-	// schema is set by load
-	schema *row.Schema
+	// keys encrypts the files of the tables with tblFeatureEncryption, it is nil without WithKeyProvider
+	keys storage.KeyProvider
+	// files is the storage of the data and schema files, it is set by load and create
+	files storage.Storage
+	// wal is set by load and create
+	wal storage.WAL
+	// meta is set by load and create
+	meta *tableMeta
+	// history holds the versions of the schema, it is set by load and create
+	history *row.History
+	// free is nil until the deleted rows are first needed
+	free *freeRows
+	// imaged holds the blocks of the data file logged whole since the last checkpoint
+	imaged map[int64]struct{}
+	// closed is set once the table is dropped or renamed, the handle fails with ErrNotFound from then on
+	closed bool
 	name   string
 }
 
@@ -35,91 +102,528 @@ func (t *table) Name() string {
 }
 
 func (t *table) TotalRows() (int64, error) {
-	info, err := t.storage.Info(tblDataFile)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	return t.totalRows()
+}
+
+func (t *table) totalRows() (int64, error) {
+	info, err := t.files.Info(t.meta.dataFile())
 	if err != nil {
-		return 0, errors.Wrapf(err, "%s could not read data file info", t.errorDescriptor())
+		return 0, errors.Wrapf(t.annotate(err), "%s could not read data file info", t.errorDescriptor())
 	}
 
-	return info.Size() / t.schema.ByteSize(), nil
+	return (info.Size() - t.meta.dataOffset()) / t.slotSize(), nil
+}
+
+// LiveRows holds the table exclusively, the first call finds the deleted rows.
+func (t *table) LiveRows() (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	if !t.hasRowHeaders() {
+		return t.totalRows()
+	}
+	free, err := t.freeRows()
+	if err != nil {
+		return 0, err
+	}
+	return free.total - int64(len(free.ids)), nil
 }
 
 func (t *table) Schema() *row.Schema {
-	return t.schema
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.history.Latest()
 }
 
 func (t *table) Row(id int64) (row.Row, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOpen(); err != nil {
+		return nil, err
+	}
+
 	if id < 1 {
 		return nil, errors.Errorf("%s invalid row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
 	}
 
-	rowBytes, err := t.storage.ReadPartials(tblDataFile, []*storage.Partial{
+	rowBytes, err := t.files.ReadPartials(t.meta.dataFile(), []*storage.Partial{
 		{
-			OffsetFrom: t.schema.ByteSize() * (id - 1),
-			OffsetTo:   t.schema.ByteSize() * id,
+			OffsetFrom: t.offset(id),
+			OffsetTo:   t.offset(id + 1),
 		},
 	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "%s could not read row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+		return nil, errors.Wrapf(t.annotate(err), "%s could not read row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
 	}
 
-	return rowBytes[0], nil
+	if t.hasRowHeaders() && rowBytes[0][0] != tblRowLive {
+		return nil, errors.Wrapf(ErrRowDeleted, "%s could not read row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+	}
+	r, err := t.row(rowBytes[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not read row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+	}
+	return r, nil
 }
 
 func (t *table) Set(id int64, r row.Row) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+
 	if id < 1 {
 		return errors.Errorf("%s invalid row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
 	}
-	if err := t.storage.Offset(tblDataFile, t.schema.ByteSize()*(id-1), r); err != nil {
-		return errors.Wrapf(err, "%s could not set row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+	if err := t.writeRows([]int64{id}, []row.Row{r}); err != nil {
+		return errors.Wrapf(t.annotate(err), "%s could not set row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+	}
+	return nil
+}
+
+func (t *table) SetMany(rows map[int64]row.Row) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+
+	ids := make([]int64, 0, len(rows))
+	for id := range rows {
+		if id < 1 {
+			return errors.Errorf("%s invalid row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	sorted := make([]row.Row, len(ids))
+	for i, id := range ids {
+		sorted[i] = rows[id]
+	}
+	if err := t.writeRows(ids, sorted); err != nil {
+		return errors.Wrapf(t.annotate(err), "%s could not set %d row(s)", t.errorDescriptor(), len(rows))
 	}
 	return nil
 }
 
 func (t *table) Append(r row.Row) error {
-	if err := t.storage.Append(tblDataFile, r); err != nil {
-		return errors.Wrapf(err, "%s could not append row", t.errorDescriptor())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+
+	ids, err := t.appendIDs(1)
+	if err != nil {
+		return err
+	}
+	if err := t.writeRows(ids, []row.Row{r}); err != nil {
+		return errors.Wrapf(t.annotate(err), "%s could not append row", t.errorDescriptor())
 	}
 	return nil
 }
 
+func (t *table) AppendMany(rows []row.Row) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+
+	ids, err := t.appendIDs(len(rows))
+	if err != nil {
+		return err
+	}
+	if err := t.writeRows(ids, rows); err != nil {
+		return errors.Wrapf(t.annotate(err), "%s could not append %d row(s)", t.errorDescriptor(), len(rows))
+	}
+	return nil
+}
+
+func (t *table) DeleteRow(id int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+
+	if !t.hasRowHeaders() {
+		return errors.Wrapf(ErrUnsupported, "%s could not delete row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+	}
+	free, err := t.freeRows()
+	if err != nil {
+		return err
+	}
+	if id < 1 || id > free.total {
+		return errors.Errorf("%s invalid row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+	}
+	if free.isDead(id) {
+		return errors.Wrapf(ErrRowDeleted, "%s could not delete row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+	}
+
+	record := &storage.Record{Filename: t.meta.dataFile(), Offset: t.offset(id), Data: []byte{tblRowDead}}
+	if err := t.write(record); err != nil {
+		t.free = nil
+		return errors.Wrapf(t.annotate(err), "%s could not delete row %s", t.errorDescriptor(), t.rowErrorDescriptor(id))
+	}
+	free.dead(id)
+	return nil
+}
+
+func (t *table) Lock(mode storage.LockMode) (storage.FileLock, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	lock, err := t.storage.Lock(mode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s could not lock table", t.errorDescriptor())
+	}
+	return lock, nil
+}
+
+// Delete drops the table through the catalog, which holds the table exclusively while removing it.
 func (t *table) Delete(_ context.Context) error {
-	if err := t.storage.Delete(tblDataFile); err != nil {
-		return errors.Wrapf(err, "%s could not delete data file", t.errorDescriptor())
+	dropped, err := t.catalog.dropHandle(t.name, t)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not delete table", t.errorDescriptor())
+	}
+	if !dropped {
+		return errors.Wrapf(ErrNotFound, "%s could not delete table", t.errorDescriptor())
+	}
+	return nil
+}
+
+// closeWith runs fn holding the table exclusively and closes the handle if fn succeeds.
+func (t *table) closeWith(fn func() error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := fn(); err != nil {
+		return err
+	}
+	t.closed = true
+	return nil
+}
+
+// checkOpen fails with ErrNotFound once the table is dropped or renamed, the caller must hold the lock.
+func (t *table) checkOpen() error {
+	if t.closed {
+		return errors.Wrapf(ErrNotFound, "%s table was dropped or renamed", t.errorDescriptor())
+	}
+	return nil
+}
+
+// write logs the writes of the records before applying them to the data file as a single batch.
+func (t *table) write(records ...*storage.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	images, err := t.blockImages(records)
+	if err != nil {
+		return errors.Wrap(err, "could not read blocks")
 	}
-	if err := t.storage.Delete(tblSchemaFile); err != nil {
-		return errors.Wrapf(err, "%s could not delete schema file", t.errorDescriptor())
+	if err := t.wal.LogBatch(append(images, records...)); err != nil {
+		return errors.Wrap(err, "could not log writes")
+	}
+	for _, image := range images {
+		for block := image.Offset / t.meta.blockSize; block*t.meta.blockSize < image.Offset+int64(len(image.Data)); block++ {
+			t.imaged[block] = struct{}{}
+		}
+	}
+	batch := storage.NewBatch()
+	for _, record := range records {
+		batch.Offset(record.Offset, record.Data)
+	}
+	if err := t.files.WriteBatch(t.meta.dataFile(), batch); err != nil {
+		return errors.Wrapf(err, "could not write %d record(s)", len(records))
+	}
+
+	walSize, err := t.wal.Size()
+	if err != nil {
+		return errors.Wrap(err, "could not read wal size")
+	}
+	if walSize >= tblWalCheckpointSize {
+		if err := t.checkpoint(); err != nil {
+			return errors.Wrap(err, "could not checkpoint wal")
+		}
+	}
+	return nil
+}
+
+// blockImages returns the records holding the whole blocks of the data file the records are the first to touch since
+// the last checkpoint, as they are once the records are applied. A crash while a block is rewritten may tear the
+// whole block, not only the bytes of the records, so the log replays the images over the blocks without reading them.
+func (t *table) blockImages(records []*storage.Record) ([]*storage.Record, error) {
+	if !t.meta.Has(tblFeatureChecksums) && !t.meta.Has(tblFeatureCompression) && !t.meta.Has(tblFeatureEncryption) {
+		return nil, nil
+	}
+	info, err := t.files.Info(t.meta.dataFile())
+	if err != nil {
+		return nil, err
+	}
+	size, end := info.Size(), info.Size()
+	var blocks []int64
+	for _, record := range records {
+		recordEnd := record.Offset + int64(len(record.Data))
+		end = max(end, recordEnd)
+		for block := min(record.Offset, size) / t.meta.blockSize; block*t.meta.blockSize < recordEnd; block++ {
+			if _, ok := t.imaged[block]; !ok {
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	if last := (size - 1) / t.meta.blockSize; end > size && size > 0 {
+		// The previous last block is encoded again once the file grows past it
+		if _, ok := t.imaged[last]; !ok {
+			blocks = append(blocks, last)
+		}
+	}
+	slices.Sort(blocks)
+	blocks = slices.Compact(blocks)
+
+	var images []*storage.Record
+	for len(blocks) > 0 {
+		run := 1 // The consecutive blocks are logged as a single image
+		for run < len(blocks) && blocks[run] == blocks[0]+int64(run) {
+			run++
+		}
+		from, to := blocks[0]*t.meta.blockSize, min((blocks[0]+int64(run))*t.meta.blockSize, end)
+		blocks = blocks[run:]
+
+		image := make([]byte, to-from)
+		if from < size {
+			existing, err := t.files.ReadPartials(t.meta.dataFile(), []*storage.Partial{{OffsetFrom: from, OffsetTo: min(to, size)}})
+			if err != nil {
+				return nil, err
+			}
+			copy(image, existing[0])
+		}
+		for _, record := range records {
+			recordEnd := record.Offset + int64(len(record.Data))
+			if record.Offset < to && recordEnd > from {
+				copy(image[max(record.Offset-from, 0):], record.Data[max(from-record.Offset, 0):min(recordEnd, to)-record.Offset])
+			}
+		}
+		images = append(images, &storage.Record{Filename: t.meta.dataFile(), Offset: from, Data: image, Image: true})
+	}
+	return images, nil
+}
+
+// checkpoint flushes the data file and checkpoints the write-ahead log, the blocks touched next are logged whole
+// again. The data file is flushed through the files storage, which persists what it keeps in memory.
+func (t *table) checkpoint() error {
+	if err := t.files.Sync(t.meta.dataFile()); err != nil {
+		return errors.Wrap(err, "could not sync data file")
+	}
+	t.imaged = make(map[int64]struct{})
+	return t.wal.Checkpoint()
+}
+
+// writeRows writes the rows to the given ids with a single write.
+func (t *table) writeRows(ids []int64, rows []row.Row) error {
+	records := make([]*storage.Record, len(ids))
+	for i, id := range ids {
+		if rowSize := int64(len(rows[i])); rowSize != t.history.Latest().ByteSize() {
+			return errors.Errorf("%s expected row of size [bytes=%d], got [bytes=%d]", t.rowErrorDescriptor(id), t.history.Latest().ByteSize(), rowSize)
+		}
+		records[i] = t.record(id, rows[i])
+	}
+	if err := t.write(records...); err != nil {
+		t.free = nil // The free rows are found again from whatever made it to the data file
+		return err
+	}
+	if t.free != nil {
+		for _, id := range ids {
+			t.free.live(id)
+		}
+	}
+	return nil
+}
+
+// appendIDs returns the ids the given number of appended rows are written to.
+func (t *table) appendIDs(n int) ([]int64, error) {
+	if t.hasRowHeaders() {
+		free, err := t.freeRows()
+		if err != nil {
+			return nil, err
+		}
+		return free.next(n), nil
+	}
+
+	total, err := t.totalRows()
+	if err != nil {
+		return nil, err
+	}
+	return (&freeRows{total: total}).next(n), nil
+}
+
+func (t *table) record(id int64, r row.Row) *storage.Record {
+	data := t.meta.slot(t.history.Version(), r)
+	return &storage.Record{Filename: t.meta.dataFile(), Offset: t.offset(id), Data: data}
+}
+
+// recover replays the write-ahead log onto the data file and checkpoints it. The block images overwrite the blocks
+// without reading them, the blocks torn by a crash are therefore repaired before the other records read them. A
+// corrupted log is not checkpointed, so that the records following the corruption are not lost. Nothing is written
+// when the log is empty or the storage is read-only. A read-only table sees the writes checkpointed by the writer,
+// the log left behind by a writer is replayed by the next one.
+func (t *table) recover() error {
+	t.imaged = make(map[int64]struct{})
+	size, err := t.wal.Size()
+	if err != nil {
+		return errors.Wrap(err, "could not read wal size")
+	}
+	if size == 0 || storage.IsReadOnly(t.storage) {
+		return nil
+	}
+
+	err = t.wal.Replay(func(record *storage.Record) error {
+		if record.Image {
+			return t.files.Offset(record.Filename, record.Offset, record.Data, storage.WithOverwrite())
+		}
+		return t.files.Offset(record.Filename, record.Offset, record.Data)
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not replay wal")
+	}
+	if err := t.checkpoint(); err != nil {
+		return errors.Wrap(err, "could not checkpoint wal")
 	}
 	return nil
 }
 
 func (t *table) load() error {
-	schemaPayload, err := t.storage.ReadAll(tblSchemaFile)
+	var err error
+	t.meta, err = t.loadMeta()
+	if err != nil {
+		return errors.Wrapf(err, "%s could not load meta", t.errorDescriptor())
+	}
+	t.files, err = t.meta.storage(t.storage, t.keys)
 	if err != nil {
-		return errors.Wrapf(err, "%s could not read schema", t.errorDescriptor())
+		return errors.Wrapf(err, "%s could not create files storage", t.errorDescriptor())
 	}
 
-	t.schema = &row.Schema{}
-	if err := t.schema.Load(schemaPayload); err != nil {
+	schemaPayload, err := t.files.ReadAll(t.meta.schemaFile())
+	if err != nil {
+		return errors.Wrapf(t.annotate(err), "%s could not read schema", t.errorDescriptor())
+	}
+
+	t.history, err = t.meta.loadSchema(schemaPayload)
+	if err != nil {
 		return errors.Wrapf(err, "%s could not load schema", t.errorDescriptor())
 	}
 
+	t.wal, err = t.meta.wal(t.storage, t.keys)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open wal", t.errorDescriptor())
+	}
+	if err := t.recover(); err != nil {
+		return errors.Wrapf(t.annotate(err), "%s could not recover", t.errorDescriptor())
+	}
+	// The header is only checked once the log repaired the blocks torn by a crash
+	if err := t.checkDataHeader(); err != nil {
+		return errors.Wrapf(t.annotate(err), "%s invalid data file", t.errorDescriptor())
+	}
+	if storage.IsReadOnly(t.storage) {
+		return nil
+	}
+	if err := t.removeStaleFiles(); err != nil {
+		return errors.Wrapf(err, "%s could not remove stale files", t.errorDescriptor())
+	}
+
 	return nil
 }
 
-func (t *table) create() error {
-	schemaPayload, err := t.schema.Bytes()
+func (t *table) create(opts []TableOption) error {
+	t.meta = newTableMeta(t.history.Latest(), opts)
+	if err := t.storage.CreateOrOverride(tblMetaFile, t.meta.Bytes()); err != nil {
+		return errors.Wrapf(err, "%s could not create meta file", t.errorDescriptor())
+	}
+	files, err := t.meta.storage(t.storage, t.keys)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not create files storage", t.errorDescriptor())
+	}
+	t.files = files
+
+	schemaPayload, err := t.meta.schemaBytes(t.history)
 	if err != nil {
 		return errors.Wrapf(err, "%s could not get schema bytes", t.errorDescriptor())
 	}
-	if err := t.storage.CreateOrOverride(tblSchemaFile, schemaPayload); err != nil {
+	if err := t.files.CreateOrOverride(t.meta.schemaFile(), schemaPayload); err != nil {
 		return errors.Wrapf(err, "%s could not create schema file", t.errorDescriptor())
 	}
-	if err := t.storage.CreateOrOverride(tblDataFile, nil); err != nil {
+	if err := t.files.CreateOrOverride(t.meta.dataFile(), t.meta.header(tblFileData)); err != nil {
 		return errors.Wrapf(err, "%s could not create data file", t.errorDescriptor())
 	}
+	if err := t.storage.CreateOrOverride(tblWalFile, nil); err != nil {
+		return errors.Wrapf(err, "%s could not create wal file", t.errorDescriptor())
+	}
+
+	t.wal, err = t.meta.wal(t.storage, t.keys)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not open wal", t.errorDescriptor())
+	}
+	t.imaged = make(map[int64]struct{})
 	return nil
 }
 
+// loadMeta returns the meta of the table, tables without a meta file have no features enabled.
+func (t *table) loadMeta() (*tableMeta, error) {
+	meta := &tableMeta{}
+	if _, err := t.storage.Info(tblMetaFile); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return meta, nil
+		}
+		return nil, errors.Wrap(err, "could not read meta file info")
+	}
+
+	payload, err := t.storage.ReadAll(tblMetaFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read meta file")
+	}
+	if err := meta.Load(payload); err != nil {
+		return nil, errors.Wrap(err, "could not load meta file")
+	}
+	return meta, nil
+}
+
+// checkDataHeader verifies the header of the data file.
+func (t *table) checkDataHeader() error {
+	if t.meta.dataOffset() == 0 {
+		return nil
+	}
+	header, err := t.files.ReadPartials(t.meta.dataFile(), []*storage.Partial{{OffsetFrom: 0, OffsetTo: t.meta.dataOffset()}})
+	if err != nil {
+		return errors.Wrap(err, "could not read header")
+	}
+	_, err = t.meta.checkHeader(tblFileData, header[0])
+	return err
+}
+
+// annotate attaches the name of the table to the corruption errors reported by its storage.
+func (t *table) annotate(err error) error {
+	var corruption *storage.CorruptionError
+	if errors.As(err, &corruption) {
+		corruption.Table = t.name
+	}
+	return err
+}
+
 func (t *table) rowErrorDescriptor(id int64) string {
 	return fmt.Sprintf("(row=[id=%d])", id)
 }
@@ -0,0 +1,358 @@
+package structure
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/grid/column"
+	"ktdb/pkg/engine/grid/row"
+	"ktdb/pkg/engine/identifier"
+	"ktdb/pkg/engine/storage"
+)
+
+// AlterChange is a change of the columns of a table, the changes of an alter are applied in order.
+type AlterChange func(a *alteration) error
+
+// alteration holds the columns of a table while it is altered.
+type alteration struct {
+	columns []*alteredColumn
+}
+
+type alteredColumn struct {
+	schema *column.Schema
+	// source is the position of the column in the schema before the alter, it is -1 for added columns
+	source int
+}
+
+// AddColumn adds the column after the existing ones, the existing rows get its default. Columns that are not
+// nullable must have a default.
+func AddColumn(colSchema *column.Schema) AlterChange {
+	return func(a *alteration) error {
+		if colSchema == nil {
+			return errors.New("column is not defined")
+		}
+		added := *colSchema
+		if err := a.normalize(&added.Name); err != nil {
+			return err
+		}
+		if a.find(added.Name) >= 0 {
+			return errors.Errorf("%s already exists", columnErrorDescriptor(added.Name))
+		}
+		if !added.Nullable && len(added.Default) == 0 {
+			return errors.Errorf("%s is not nullable and has no default", columnErrorDescriptor(added.Name))
+		}
+		a.columns = append(a.columns, &alteredColumn{schema: &added, source: -1})
+		return nil
+	}
+}
+
+// DropColumn drops the column, the last column of a table cannot be dropped.
+func DropColumn(name string) AlterChange {
+	return func(a *alteration) error {
+		i, err := a.column(name)
+		if err != nil {
+			return err
+		}
+		if len(a.columns) == 1 {
+			return errors.Errorf("%s could not drop the last column", columnErrorDescriptor(a.columns[i].schema.Name))
+		}
+		a.columns = append(a.columns[:i], a.columns[i+1:]...)
+		return nil
+	}
+}
+
+// RenameColumn renames the column, it does not rewrite the rows.
+func RenameColumn(from string, to string) AlterChange {
+	return func(a *alteration) error {
+		i, err := a.column(from)
+		if err != nil {
+			return err
+		}
+		if err := a.normalize(&to); err != nil {
+			return err
+		}
+		if j := a.find(to); j >= 0 && j != i {
+			return errors.Errorf("%s already exists", columnErrorDescriptor(to))
+		}
+		a.columns[i].schema.Name = to
+		return nil
+	}
+}
+
+// ResizeColumn changes the size of the column, the alter fails if a value of the existing rows does not fit.
+func ResizeColumn(name string, size int64) AlterChange {
+	return func(a *alteration) error {
+		i, err := a.column(name)
+		if err != nil {
+			return err
+		}
+		if size < 1 {
+			return errors.Errorf("%s invalid size [size=%d]", columnErrorDescriptor(a.columns[i].schema.Name), size)
+		}
+		a.columns[i].schema.Size = size
+		return nil
+	}
+}
+
+// Alter applies the changes to the columns of the table. Renaming columns and appending columns that fit into the
+// room left in the slots of the rows only add a version to the schema, the rows are upgraded to it on read. The other
+// changes rewrite every row into the new layout, the schema and data file of the new layout are then swapped in by
+// atomically replacing the meta file. The ids of the rows are kept. An interrupted alter leaves the table as it was.
+func (t *table) Alter(ctx context.Context, processor column.Processor, changes ...AlterChange) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
+
+	a := &alteration{}
+	for i, colSchema := range t.history.Latest().ColumnSchemas() {
+		a.columns = append(a.columns, &alteredColumn{schema: colSchema, source: i})
+	}
+	for i, change := range changes {
+		if err := change(a); err != nil {
+			return errors.Wrapf(err, "%s invalid change [position=%d]", t.errorDescriptor(), i)
+		}
+	}
+	schema, err := a.schema(processor)
+	if err != nil {
+		return errors.Wrapf(err, "%s invalid alter", t.errorDescriptor())
+	}
+
+	if err := t.checkpoint(); err != nil {
+		return errors.Wrapf(err, "%s could not checkpoint wal", t.errorDescriptor())
+	}
+
+	previous := *t.meta
+	next := *t.meta
+	next.schemaGeneration++
+	history, rewrite := t.evolve(a, schema)
+	if rewrite {
+		next.generation++
+		if t.hasRowVersions() && schema.ByteSize() > next.rowCapacity {
+			next.rowCapacity = schema.ByteSize() + tblRowReservedBytes
+		}
+		if err := t.rewrite(ctx, processor, &next, schema, a); err != nil {
+			if removeErr := t.removeFile(next.dataFile()); removeErr != nil { // Otherwise it is removed on load
+				return errors.Wrapf(err, "%s could not rewrite data file, could not remove it (%s)", t.errorDescriptor(), removeErr)
+			}
+			return errors.Wrapf(t.annotate(err), "%s could not rewrite data file", t.errorDescriptor())
+		}
+	}
+
+	if err := t.swap(&next, history); err != nil {
+		return err
+	}
+	if err := t.files.Delete(previous.schemaFile()); err != nil {
+		return errors.Wrapf(err, "%s could not delete previous schema file", t.errorDescriptor())
+	}
+	if rewrite {
+		if err := t.files.Delete(previous.dataFile()); err != nil {
+			return errors.Wrapf(err, "%s could not delete previous data file", t.errorDescriptor())
+		}
+	}
+	return nil
+}
+
+// evolve returns the history with the altered schema, it reports whether the rows have to be rewritten into the
+// layout of the schema, which then is the only version of the history.
+func (t *table) evolve(a *alteration, schema *row.Schema) (*row.History, bool) {
+	latest := t.history.Latest()
+	if !a.appendsColumns(latest) {
+		return row.NewHistory(schema), true
+	}
+	if schema.ByteSize() != latest.ByteSize() && (!t.hasRowVersions() || schema.ByteSize() > t.meta.rowCapacity) {
+		return row.NewHistory(schema), true
+	}
+	history, err := t.history.Evolve(schema)
+	if err != nil { // The history is full
+		return row.NewHistory(schema), true
+	}
+	return history, false
+}
+
+// swap writes the schema file of the history and swaps it in with the meta by atomically replacing the meta file.
+func (t *table) swap(meta *tableMeta, history *row.History) error {
+	schemaPayload, err := meta.schemaBytes(history)
+	if err != nil {
+		return errors.Wrapf(err, "%s could not get schema bytes", t.errorDescriptor())
+	}
+	if err := t.files.CreateOrOverride(meta.schemaFile(), schemaPayload); err != nil {
+		return errors.Wrapf(err, "%s could not create schema file", t.errorDescriptor())
+	}
+	// A failed write of the meta file may still have replaced it, the new files are therefore left for load to sort
+	// out
+	if err := t.storage.CreateOrOverride(tblMetaFile, meta.Bytes()); err != nil {
+		return errors.Wrapf(err, "%s could not swap schema", t.errorDescriptor())
+	}
+	t.meta = meta
+	t.history = history
+	return nil
+}
+
+// rewrite writes every row in the layout of the schema into the data file of the meta in chunks, the deleted rows
+// stay deleted.
+func (t *table) rewrite(ctx context.Context, processor column.Processor, meta *tableMeta, schema *row.Schema, a *alteration) error {
+	filename := meta.dataFile()
+	if err := t.files.CreateOrOverride(filename, meta.header(tblFileData)); err != nil {
+		return errors.Wrap(err, "could not create data file")
+	}
+	total, err := t.totalRows()
+	if err != nil {
+		return err
+	}
+	defaults, err := a.defaults(processor)
+	if err != nil {
+		return err
+	}
+
+	slotSize := meta.slotSize(schema)
+	for first := int64(0); first < total; first += tblRowScanSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		last := min(first+tblRowScanSize, total)
+		chunk, err := t.files.ReadPartials(t.meta.dataFile(), []*storage.Partial{
+			{OffsetFrom: t.offset(first + 1), OffsetTo: t.offset(last + 1)},
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not read rows")
+		}
+
+		rewritten := make([]byte, 0, (last-first)*slotSize)
+		for i := int64(0); i < last-first; i++ {
+			slot := chunk[0][i*t.slotSize() : (i+1)*t.slotSize()]
+			if t.hasRowHeaders() && slot[0] != tblRowLive {
+				rewritten = append(rewritten, make([]byte, slotSize)...)
+				continue
+			}
+
+			r, err := t.rewriteRow(processor, schema, a, defaults, slot)
+			if err != nil {
+				return errors.Wrapf(err, "could not rewrite %s", t.rowErrorDescriptor(first+i+1))
+			}
+			rewritten = append(rewritten, meta.slot(0, r)...)
+		}
+		if err := t.files.Append(filename, rewritten); err != nil {
+			return errors.Wrap(err, "could not write rows")
+		}
+	}
+
+	if err := t.files.Sync(filename); err != nil {
+		return errors.Wrap(err, "could not sync data file")
+	}
+	return nil
+}
+
+func (t *table) rewriteRow(processor column.Processor, schema *row.Schema, a *alteration, defaults []column.Column, slot []byte) (row.Row, error) {
+	r, err := t.row(slot)
+	if err != nil {
+		return nil, err
+	}
+	cols, err := t.history.Latest().Columns(processor, r)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode row")
+	}
+	rewritten := make([]column.Column, len(a.columns))
+	for i, altered := range a.columns {
+		if altered.source < 0 {
+			rewritten[i] = defaults[i]
+		} else {
+			rewritten[i] = cols[altered.source]
+		}
+	}
+	return schema.Row(rewritten)
+}
+
+// schema returns the row schema of the altered columns, validating them against the processor.
+func (a *alteration) schema(processor column.Processor) (*row.Schema, error) {
+	rowProcessor, err := row.NewProcessor(processor)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create row processor")
+	}
+	colSchemas := make([]*column.Schema, len(a.columns))
+	for i, altered := range a.columns {
+		if _, err := processor.TypeProcessor(altered.schema.Type); err != nil {
+			return nil, errors.Wrapf(err, "%s unsupported type", columnErrorDescriptor(altered.schema.Name))
+		}
+		colSchemas[i] = altered.schema
+	}
+	if _, err := a.defaults(processor); err != nil {
+		return nil, err
+	}
+	return rowProcessor.New(colSchemas)
+}
+
+// defaults returns the default values of the added columns by their position, the other columns have none.
+func (a *alteration) defaults(processor column.Processor) ([]column.Column, error) {
+	res := make([]column.Column, len(a.columns))
+	for i, altered := range a.columns {
+		if altered.source >= 0 || len(altered.schema.Default) == 0 {
+			continue
+		}
+		if size := int64(len(altered.schema.Default)); size != altered.schema.PayloadSize() {
+			return nil, errors.Errorf("%s invalid default of size [bytes=%d]", columnErrorDescriptor(altered.schema.Name), size)
+		}
+		col, err := altered.schema.Column(processor, altered.schema.Default)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s invalid default", columnErrorDescriptor(altered.schema.Name))
+		}
+		res[i] = col
+	}
+	return res, nil
+}
+
+// appendsColumns reports whether the columns keep the layout of the schema, only renamed or followed by added ones.
+func (a *alteration) appendsColumns(schema *row.Schema) bool {
+	previous := schema.ColumnSchemas()
+	if len(a.columns) < len(previous) {
+		return false
+	}
+	for i, altered := range a.columns {
+		if i < len(previous) && (altered.source != i || altered.schema.Size != previous[i].Size) {
+			return false
+		}
+		if i >= len(previous) && altered.source >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// column returns the position of the column of the name, it fails if there is none.
+func (a *alteration) column(name string) (int, error) {
+	if err := a.normalize(&name); err != nil {
+		return 0, err
+	}
+	i := a.find(name)
+	if i < 0 {
+		return 0, errors.Wrap(ErrNotFound, columnErrorDescriptor(name))
+	}
+	return i, nil
+}
+
+// find returns the position of the column of the normalized name, it is -1 if there is none.
+func (a *alteration) find(name string) int {
+	for i, altered := range a.columns {
+		if altered.schema.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (a *alteration) normalize(name *string) error {
+	normalized, err := identifier.Normalize(identifier.KindColumn, *name)
+	if err != nil {
+		return errors.Wrap(err, "invalid column name")
+	}
+	*name = normalized
+	return nil
+}
+
+func columnErrorDescriptor(name string) string {
+	return fmt.Sprintf("(column=[name=%s])", name)
+}
@@ -0,0 +1,102 @@
+package structure
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// tblFileMagic opens the schema and data files of the tables with tblFeatureFileHeaders.
+var tblFileMagic = []byte("KTDB")
+
+// tblFormatVersion is the version of the format of the table files, it is stored in the meta file and in the headers
+// of the schema and data files and covers the log too. The tables of newer versions are not read.
+const tblFormatVersion = 1
+
+// tblFileHeaderSize is the size of the header of the table files, it is followed by the payload of the file.
+const tblFileHeaderSize = 16
+
+type tableFileKind uint16
+
+const (
+	tblFileSchema tableFileKind = iota + 1
+	tblFileData
+)
+
+func (k tableFileKind) String() string {
+	switch k {
+	case tblFileSchema:
+		return "schema"
+	case tblFileData:
+		return "data"
+	default:
+		return "unknown"
+	}
+}
+
+// fileHeader opens the table files, it is laid out the same on every architecture:
+//
+//	magic (4 bytes) | format version (2 bytes) | kind (2 bytes) | features (8 bytes)
+type fileHeader struct {
+	version  uint16
+	kind     tableFileKind
+	features tableFeature
+}
+
+func (h *fileHeader) Bytes() []byte {
+	res := make([]byte, 0, tblFileHeaderSize)
+	res = append(res, tblFileMagic...)
+	res = binary.LittleEndian.AppendUint16(res, h.version)
+	res = binary.LittleEndian.AppendUint16(res, uint16(h.kind))
+	return binary.LittleEndian.AppendUint64(res, uint64(h.features))
+}
+
+func (h *fileHeader) Load(payload []byte) error {
+	if len(payload) < tblFileHeaderSize || !bytes.Equal(payload[:len(tblFileMagic)], tblFileMagic) {
+		return errors.New("missing file header")
+	}
+	payload = payload[len(tblFileMagic):]
+	h.version = binary.LittleEndian.Uint16(payload)
+	h.kind = tableFileKind(binary.LittleEndian.Uint16(payload[2:]))
+	h.features = tableFeature(binary.LittleEndian.Uint64(payload[4:]))
+	return nil
+}
+
+// header returns the header of the table files of the kind, it is nil for the tables without tblFeatureFileHeaders.
+func (m *tableMeta) header(kind tableFileKind) []byte {
+	if !m.Has(tblFeatureFileHeaders) {
+		return nil
+	}
+	return (&fileHeader{version: tblFormatVersion, kind: kind, features: m.features}).Bytes()
+}
+
+// checkHeader verifies the header the payload of the table file of the kind starts with and returns the payload
+// without it.
+func (m *tableMeta) checkHeader(kind tableFileKind, payload []byte) ([]byte, error) {
+	if !m.Has(tblFeatureFileHeaders) {
+		return payload, nil
+	}
+	h := &fileHeader{}
+	if err := h.Load(payload); err != nil {
+		return nil, err
+	}
+	if h.version > tblFormatVersion {
+		return nil, errors.Wrapf(ErrUnsupported, "file format [version=%d] is newer than the supported one [version=%d]", h.version, tblFormatVersion)
+	}
+	if h.kind != kind {
+		return nil, errors.Errorf("expected %s file, got %s file", kind, h.kind)
+	}
+	if h.features != m.features {
+		return nil, errors.Errorf("file features [features=%d] do not match the table [features=%d]", h.features, m.features)
+	}
+	return payload[tblFileHeaderSize:], nil
+}
+
+// dataOffset returns the offset of the first row in the data file.
+func (m *tableMeta) dataOffset() int64 {
+	if m.Has(tblFeatureFileHeaders) {
+		return tblFileHeaderSize
+	}
+	return 0
+}
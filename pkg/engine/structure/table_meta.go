@@ -0,0 +1,248 @@
+package structure
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/grid/row"
+	"ktdb/pkg/engine/storage"
+	"ktdb/pkg/sys"
+)
+
+const tblMetaFile = "meta.bin"
+
+// tblBlockSize is the size of the blocks the table files are stored in by the block based features.
+const tblBlockSize = 4096
+
+type tableFeature int64
+
+const (
+	// tblFeatureChecksums stores the table files in checksummed blocks
+	tblFeatureChecksums tableFeature = 1 << iota
+	// tblFeatureCompression stores the table files in compressed blocks
+	tblFeatureCompression
+	// tblFeatureRowHeaders prefixes every row with a header marking whether it is live or deleted
+	tblFeatureRowHeaders
+	// tblFeatureRowVersions tags every row header with the version of the schema the row was written with, the rows
+	// are stored in slots of a fixed capacity that leaves room for the columns added later
+	tblFeatureRowVersions
+	// tblFeatureFileHeaders opens the schema and data files with a fileHeader
+	tblFeatureFileHeaders
+	// tblFeatureEncryption stores the table files in encrypted blocks and encrypts the records of the log, the blocks
+	// are authenticated so the files are stored without checksums
+	tblFeatureEncryption
+)
+
+// tblRowReservedBytes is the default room left in the slots of the rows for the columns added later.
+const tblRowReservedBytes = 16
+
+// TableOption configures how a table is stored, it can only be set when the table is created.
+type TableOption func(meta *tableMeta)
+
+// WithCompression stores the files of the table compressed.
+func WithCompression() TableOption {
+	return func(meta *tableMeta) {
+		meta.features |= tblFeatureCompression
+	}
+}
+
+// WithEncryption stores the files and the log of the table encrypted with the key of the structure, see
+// WithKeyProvider. The table can only be opened with the same key.
+func WithEncryption() TableOption {
+	return func(meta *tableMeta) {
+		meta.features = meta.features&^tblFeatureChecksums | tblFeatureEncryption
+	}
+}
+
+// WithReservedBytes sets the room left in the slots of the rows, adding columns that fit into it does not rewrite
+// the rows.
+func WithReservedBytes(n int64) TableOption {
+	return func(meta *tableMeta) {
+		meta.reserved = max(n, 0)
+	}
+}
+
+// tableMeta describes how the files of a table are stored, tables created before it was introduced have none.
+type tableMeta struct {
+	features  tableFeature
+	blockSize int64
+	// generation is the generation of the data file, it is bumped whenever the data file is swapped for a new one
+	generation int64
+	// schemaGeneration is the generation of the schema file, it is bumped whenever the table is altered
+	schemaGeneration int64
+	// rowCapacity is the size of the slots of the rows without their header, it is only set with
+	// tblFeatureRowVersions
+	rowCapacity int64
+	// reserved is the room left in the slots of the rows of a created table, it is not stored
+	reserved int64
+}
+
+func newTableMeta(schema *row.Schema, opts []TableOption) *tableMeta {
+	meta := &tableMeta{
+		features:  tblFeatureChecksums | tblFeatureRowHeaders | tblFeatureRowVersions | tblFeatureFileHeaders,
+		blockSize: tblBlockSize,
+		reserved:  tblRowReservedBytes,
+	}
+	for _, opt := range opts {
+		opt(meta)
+	}
+	meta.rowCapacity = schema.ByteSize() + meta.reserved
+	return meta
+}
+
+func (m *tableMeta) Bytes() []byte {
+	return sys.ConcatSlices(
+		sys.New(sys.Int64AsBytes(int64(m.features))),
+		sys.New(sys.Int64AsBytes(m.blockSize)),
+		sys.New(sys.Int64AsBytes(m.generation)),
+		sys.New(sys.Int64AsBytes(m.schemaGeneration)),
+		sys.New(sys.Int64AsBytes(m.rowCapacity)),
+		sys.New(sys.Int64AsBytes(tblFormatVersion)),
+	)
+}
+
+func (m *tableMeta) Load(payload []byte) error {
+	payloads, err := sys.ReadAll(payload)
+	if err != nil {
+		return errors.Wrap(err, "deserialization failed")
+	}
+	// The payload of the table meta persists of a section for each field followed by the format version, the
+	// generations, the row capacity and the version were added later
+	if len(payloads) < 2 || len(payloads) > 6 {
+		return errors.New("corrupted payload")
+	}
+	features, err := sys.BytesAsInt64(payloads[0])
+	if err != nil {
+		return errors.Wrap(err, "could not load features")
+	}
+	m.features = tableFeature(features)
+	m.blockSize, err = sys.BytesAsInt64(payloads[1])
+	if err != nil {
+		return errors.Wrap(err, "could not load block size")
+	}
+	m.generation, m.schemaGeneration, m.rowCapacity = 0, 0, 0
+	if len(payloads) >= 3 {
+		if m.generation, err = sys.BytesAsInt64(payloads[2]); err != nil {
+			return errors.Wrap(err, "could not load generation")
+		}
+	}
+	if len(payloads) >= 4 {
+		if m.schemaGeneration, err = sys.BytesAsInt64(payloads[3]); err != nil {
+			return errors.Wrap(err, "could not load schema generation")
+		}
+	}
+	if len(payloads) >= 5 {
+		if m.rowCapacity, err = sys.BytesAsInt64(payloads[4]); err != nil {
+			return errors.Wrap(err, "could not load row capacity")
+		}
+	}
+	if len(payloads) == 6 {
+		version, err := sys.BytesAsInt64(payloads[5])
+		if err != nil {
+			return errors.Wrap(err, "could not load format version")
+		}
+		if version > tblFormatVersion {
+			return errors.Wrapf(ErrUnsupported, "table format [version=%d] is newer than the supported one [version=%d]", version, tblFormatVersion)
+		}
+	}
+	return nil
+}
+
+// dataFile returns the name of the data file of the current generation.
+func (m *tableMeta) dataFile() string {
+	if m.generation == 0 {
+		return tblDataFile
+	}
+	return fmt.Sprintf(tblDataFileFormat, m.generation)
+}
+
+// schemaFile returns the name of the schema file of the current generation.
+func (m *tableMeta) schemaFile() string {
+	if m.schemaGeneration == 0 {
+		return tblSchemaFile
+	}
+	return fmt.Sprintf(tblSchemaFileFormat, m.schemaGeneration)
+}
+
+// schemaBytes returns the payload of the schema file, only the tables with tblFeatureRowVersions keep the history
+// of the schema.
+func (m *tableMeta) schemaBytes(history *row.History) ([]byte, error) {
+	var payload []byte
+	var err error
+	if m.Has(tblFeatureRowVersions) {
+		payload, err = history.Bytes()
+	} else {
+		payload, err = history.Latest().Bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sys.ConcatSlices(m.header(tblFileSchema), payload), nil
+}
+
+func (m *tableMeta) loadSchema(payload []byte) (*row.History, error) {
+	payload, err := m.checkHeader(tblFileSchema, payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid schema file")
+	}
+	if m.Has(tblFeatureRowVersions) {
+		history := &row.History{}
+		if err := history.Load(payload); err != nil {
+			return nil, err
+		}
+		return history, nil
+	}
+
+	schema := &row.Schema{}
+	if err := schema.Load(payload); err != nil {
+		return nil, err
+	}
+	return row.NewHistory(schema), nil
+}
+
+func (m *tableMeta) Has(feature tableFeature) bool {
+	return m.features&feature != 0
+}
+
+// storage returns the storage the table files are accessed through.
+func (m *tableMeta) storage(tableStorage storage.Storage, keys storage.KeyProvider) (storage.Storage, error) {
+	res := tableStorage
+	if m.Has(tblFeatureEncryption) {
+		if keys == nil {
+			return nil, errors.Wrap(ErrNoKeyProvider, "could not create encrypted storage")
+		}
+		var err error
+		res, err = storage.NewEncrypted(res, m.blockSize, keys)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create encrypted storage")
+		}
+	}
+	if m.Has(tblFeatureChecksums) {
+		var err error
+		res, err = storage.NewChecksummed(res, m.blockSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create checksummed storage")
+		}
+	}
+	if m.Has(tblFeatureCompression) {
+		var err error
+		res, err = storage.NewCompressed(res, m.blockSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create compressed storage")
+		}
+	}
+	return res, nil
+}
+
+// wal opens the write-ahead log of the table, its records are encrypted with tblFeatureEncryption.
+func (m *tableMeta) wal(tableStorage storage.Storage, keys storage.KeyProvider) (storage.WAL, error) {
+	var opts []storage.WALOption
+	if m.Has(tblFeatureEncryption) {
+		if keys == nil {
+			return nil, errors.Wrap(ErrNoKeyProvider, "could not create encrypted wal")
+		}
+		opts = append(opts, storage.WithWALEncryption(keys))
+	}
+	return storage.NewWAL(tableStorage, tblWalFile, opts...)
+}
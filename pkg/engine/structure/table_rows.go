@@ -0,0 +1,181 @@
+package structure
+
+import (
+	"encoding/binary"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/grid/row"
+	"ktdb/pkg/engine/storage"
+)
+
+// tblRowHeaderSize is the size of the header in front of every row of the tables with tblFeatureRowHeaders.
+const tblRowHeaderSize = 1
+
+// tblRowVersionSize is the size of the schema version tag following the header with tblFeatureRowVersions.
+const tblRowVersionSize = 2
+
+const (
+	// tblRowDead marks a deleted row, the rows of the gaps left by setting rows past the end of a table are dead too
+	tblRowDead byte = iota
+	tblRowLive
+)
+
+// tblRowScanSize is the number of rows whose headers are read at once when looking for deleted rows.
+const tblRowScanSize = 1024
+
+// freeRows tracks the deleted rows of a table, their slots are reused by the next appends.
+type freeRows struct {
+	// total is the number of row slots of the data file
+	total int64
+	// ids holds the ids of the deleted rows in ascending order
+	ids []int64
+}
+
+// next returns the ids the given number of appended rows are written to, the lowest free ones come first.
+func (f *freeRows) next(n int) []int64 {
+	res := make([]int64, n)
+	for i := range res {
+		if i < len(f.ids) {
+			res[i] = f.ids[i]
+		} else {
+			res[i] = f.total + int64(i-len(f.ids)) + 1
+		}
+	}
+	return res
+}
+
+// live records a write of a live row.
+func (f *freeRows) live(id int64) {
+	for gap := f.total + 1; gap < id; gap++ {
+		f.ids = append(f.ids, gap)
+	}
+	f.total = max(f.total, id)
+	if i, found := slices.BinarySearch(f.ids, id); found {
+		f.ids = slices.Delete(f.ids, i, i+1)
+	}
+}
+
+// dead records the deletion of a row.
+func (f *freeRows) dead(id int64) {
+	if i, found := slices.BinarySearch(f.ids, id); !found {
+		f.ids = slices.Insert(f.ids, i, id)
+	}
+}
+
+func (f *freeRows) isDead(id int64) bool {
+	_, found := slices.BinarySearch(f.ids, id)
+	return found
+}
+
+// freeRows returns the deleted rows of the table, they are found by reading the row headers on first use.
+func (t *table) freeRows() (*freeRows, error) {
+	if t.free != nil {
+		return t.free, nil
+	}
+
+	total, err := t.totalRows()
+	if err != nil {
+		return nil, err
+	}
+	free := &freeRows{total: total}
+	for first := int64(0); first < total; first += tblRowScanSize {
+		last := min(first+tblRowScanSize, total)
+		chunk, err := t.files.ReadPartials(t.meta.dataFile(), []*storage.Partial{
+			{OffsetFrom: t.offset(first + 1), OffsetTo: t.offset(last + 1)},
+		})
+		if err != nil {
+			return nil, errors.Wrapf(t.annotate(err), "%s could not read row headers", t.errorDescriptor())
+		}
+		for i := int64(0); i < last-first; i++ {
+			if chunk[0][i*t.slotSize()] != tblRowLive {
+				free.ids = append(free.ids, first+i+1)
+			}
+		}
+	}
+	t.free = free
+	return free, nil
+}
+
+// hasRowHeaders reports whether the rows of the table carry a header, only those tables support deleting rows.
+func (t *table) hasRowHeaders() bool {
+	return t.meta.Has(tblFeatureRowHeaders)
+}
+
+func (t *table) hasRowVersions() bool {
+	return t.meta.Has(tblFeatureRowVersions)
+}
+
+// slotSize returns the size a row takes in the data file.
+func (t *table) slotSize() int64 {
+	return t.meta.slotSize(t.history.Latest())
+}
+
+// offset returns the offset of the slot of the row in the data file.
+func (t *table) offset(id int64) int64 {
+	return t.meta.dataOffset() + t.slotSize()*(id-1)
+}
+
+// row returns the row held by the slot of a live row in the layout of the latest schema version. The row is a copy
+// owned by the caller, the slot may point into a read-only mapping of the data file.
+func (t *table) row(slot []byte) (row.Row, error) {
+	if !t.hasRowHeaders() {
+		return slices.Clone(slot), nil
+	}
+	if !t.hasRowVersions() {
+		return slices.Clone(slot[tblRowHeaderSize:]), nil
+	}
+
+	version := int(binary.LittleEndian.Uint16(slot[tblRowHeaderSize:]))
+	schema, err := t.history.Schema(version)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not find schema of row")
+	}
+	headerSize := t.meta.headerSize()
+	return t.history.Upgrade(version, slices.Clone(slot[headerSize:headerSize+schema.ByteSize()]))
+}
+
+func (m *tableMeta) headerSize() int64 {
+	switch {
+	case m.Has(tblFeatureRowVersions):
+		return tblRowHeaderSize + tblRowVersionSize
+	case m.Has(tblFeatureRowHeaders):
+		return tblRowHeaderSize
+	default:
+		return 0
+	}
+}
+
+// slotSize returns the size the rows of the schema take in the data file.
+func (m *tableMeta) slotSize(schema *row.Schema) int64 {
+	if m.Has(tblFeatureRowVersions) {
+		return m.headerSize() + m.rowCapacity
+	}
+	return m.headerSize() + schema.ByteSize()
+}
+
+// upgradeRows switches the meta to the layout of the rows of the tables created now, the rows gain a header and a
+// version tag and their slots the room of tblRowReservedBytes past the schema.
+func (m *tableMeta) upgradeRows(schema *row.Schema) {
+	if !m.Has(tblFeatureRowVersions) {
+		m.rowCapacity = schema.ByteSize() + tblRowReservedBytes
+	}
+	m.features |= tblFeatureRowHeaders | tblFeatureRowVersions
+}
+
+// slot returns the slot of the live row written with the schema version.
+func (m *tableMeta) slot(version int, r row.Row) []byte {
+	if !m.Has(tblFeatureRowHeaders) {
+		return r
+	}
+	if !m.Has(tblFeatureRowVersions) {
+		return append([]byte{tblRowLive}, r...)
+	}
+
+	res := make([]byte, m.headerSize()+m.rowCapacity)
+	res[0] = tblRowLive
+	binary.LittleEndian.PutUint16(res[tblRowHeaderSize:], uint16(version))
+	copy(res[m.headerSize():], r)
+	return res
+}
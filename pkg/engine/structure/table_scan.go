@@ -0,0 +1,180 @@
+package structure
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/grid/column"
+	"ktdb/pkg/engine/grid/row"
+	"ktdb/pkg/engine/storage"
+)
+
+// ScanOptions configures a scan of a table.
+type ScanOptions struct {
+	// Start is the id of the first row to scan, it defaults to the first row of the table
+	Start int64
+	// End is the id of the last row to scan, it defaults to the last row of the table when the scan starts. An End
+	// past the last row includes the rows appended during the scan up to it
+	End int64
+	// ChunkRows is the number of rows read at once, it defaults to tblRowScanSize
+	ChunkRows int64
+	// Processor decodes the columns of the scanned rows, the rows are not decoded without one
+	Processor column.Processor
+}
+
+// Scanner iterates over the live rows of a table in ascending order of their ids, the deleted rows are skipped.
+//
+//	for scanner.Next() {
+//		id, r := scanner.ID(), scanner.Row()
+//	}
+//	if err := scanner.Err(); err != nil {
+type Scanner interface {
+	// Next advances to the next row, it returns false once there are no more rows or the scan failed.
+	Next() bool
+	ID() int64
+	// Row returns the current row, it is a copy owned by the caller.
+	Row() row.Row
+	// Columns returns the decoded columns of the current row, it is nil if the scan has no processor.
+	Columns() []column.Column
+	// Err returns the error that ended the scan, including the error of the canceled context.
+	Err() error
+}
+
+type scanner struct {
+	ctx   context.Context
+	table *table
+	// meta is the meta of the table when the scan started, it is replaced by the vacuums and alters
+	meta *tableMeta
+	opts ScanOptions
+	// chunk holds the slots of the rows from chunkStart on
+	chunk      []byte
+	chunkStart int64
+	// next is the id of the row to be returned by the next call of Next
+	next int64
+	// total is the number of rows of the table last seen, it is read again once the scan gets past it
+	total   int64
+	id      int64
+	row     row.Row
+	columns []column.Column
+	err     error
+}
+
+func (t *table) Scan(ctx context.Context, opts ScanOptions) (Scanner, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if err := t.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	total, err := t.totalRows()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Start == 0 {
+		opts.Start = 1
+	}
+	if opts.End == 0 {
+		opts.End = total
+	}
+	if opts.ChunkRows == 0 {
+		opts.ChunkRows = tblRowScanSize
+	}
+	if opts.Start < 1 || opts.End < opts.Start-1 || opts.ChunkRows < 1 {
+		return nil, errors.Errorf("%s invalid scan [start=%d, end=%d, chunkRows=%d]", t.errorDescriptor(), opts.Start, opts.End, opts.ChunkRows)
+	}
+
+	return &scanner{ctx: ctx, table: t, meta: t.meta, opts: opts, next: opts.Start, total: total}, nil
+}
+
+func (s *scanner) Next() bool {
+	s.row, s.columns = nil, nil
+	if s.err != nil {
+		return false
+	}
+	s.table.mu.RLock()
+	defer s.table.mu.RUnlock()
+	if err := s.table.checkOpen(); err != nil {
+		s.err = err
+		return false
+	}
+	if s.table.meta != s.meta {
+		s.err = errors.Wrapf(ErrScanInvalidated, "%s could not scan %s", s.table.errorDescriptor(), s.table.rowErrorDescriptor(s.next))
+		return false
+	}
+
+	for ; s.next <= s.opts.End; s.next++ {
+		if err := s.ctx.Err(); err != nil {
+			s.err = err
+			return false
+		}
+		if s.next > s.total {
+			total, err := s.table.totalRows()
+			if err != nil {
+				s.err = errors.Wrapf(err, "%s could not scan %s", s.table.errorDescriptor(), s.table.rowErrorDescriptor(s.next))
+				return false
+			}
+			if s.total = total; s.next > s.total {
+				return false
+			}
+		}
+		slot, err := s.slot(s.next)
+		if err != nil {
+			s.err = errors.Wrapf(s.table.annotate(err), "%s could not scan %s", s.table.errorDescriptor(), s.table.rowErrorDescriptor(s.next))
+			return false
+		}
+		if s.table.hasRowHeaders() && slot[0] != tblRowLive {
+			continue
+		}
+		r, err := s.table.row(slot)
+		if err != nil {
+			s.err = errors.Wrapf(err, "%s could not scan %s", s.table.errorDescriptor(), s.table.rowErrorDescriptor(s.next))
+			return false
+		}
+
+		if s.opts.Processor != nil {
+			if s.columns, err = s.table.history.Latest().Columns(s.opts.Processor, r); err != nil {
+				s.err = errors.Wrapf(err, "%s could not decode %s", s.table.errorDescriptor(), s.table.rowErrorDescriptor(s.next))
+				return false
+			}
+		}
+		s.id, s.row = s.next, r
+		s.next++
+		return true
+	}
+	return false
+}
+
+func (s *scanner) ID() int64 {
+	return s.id
+}
+
+func (s *scanner) Row() row.Row {
+	return s.row
+}
+
+func (s *scanner) Columns() []column.Column {
+	return s.columns
+}
+
+func (s *scanner) Err() error {
+	return s.err
+}
+
+// slot returns the slot of the row, reading the chunk starting at the row if it is not held already.
+func (s *scanner) slot(id int64) ([]byte, error) {
+	size := s.table.slotSize()
+	if offset := (id - s.chunkStart) * size; s.chunk != nil && id >= s.chunkStart && offset+size <= int64(len(s.chunk)) {
+		return s.chunk[offset : offset+size], nil
+	}
+
+	last := min(id+s.opts.ChunkRows-1, s.opts.End, s.total)
+	chunk, err := s.table.files.ReadPartials(s.table.meta.dataFile(), []*storage.Partial{
+		{OffsetFrom: s.table.offset(id), OffsetTo: s.table.offset(last + 1)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.chunk, s.chunkStart = chunk[0], id
+	return s.chunk[:size], nil
+}
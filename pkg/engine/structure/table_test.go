@@ -0,0 +1,1237 @@
+package structure_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ktdb/pkg/column_types"
+	"ktdb/pkg/engine/grid/column"
+	"ktdb/pkg/engine/grid/row"
+	"ktdb/pkg/engine/storage"
+	"ktdb/pkg/engine/structure"
+	"ktdb/pkg/sys"
+)
+
+type fixture struct {
+	faulty *storage.Faulty
+	// opts are the options of the structure, they are kept by reopen
+	opts []structure.Option
+	// schema shares its handles, see reopen for a fresh one
+	schema          structure.Schema
+	rowSchema       *row.Schema
+	columnProcessor column.Processor
+}
+
+func newFixture(t *testing.T, opts ...structure.Option) *fixture {
+	ctx := context.Background()
+	faulty := storage.NewFaulty(storage.NewMemory())
+	s, err := structure.New(faulty, opts...)
+	require.NoError(t, err)
+	db, err := s.Create(ctx, "db")
+	require.NoError(t, err)
+	sch, err := db.Create(ctx, "sch")
+	require.NoError(t, err)
+
+	columnProcessor, err := column.NewProcessor([]column.TypeProcessor{&column_types.IntProcessor{}})
+	require.NoError(t, err)
+	rowProcessor, err := row.NewProcessor(columnProcessor)
+	require.NoError(t, err)
+	rowSchema, err := rowProcessor.New([]*column.Schema{{Name: "id", Type: column_types.TypeInt, Size: 8}})
+	require.NoError(t, err)
+
+	return &fixture{faulty: faulty, opts: opts, schema: sch, rowSchema: rowSchema, columnProcessor: columnProcessor}
+}
+
+// reopen returns the schema as seen by a new process, without any of the cached handles. The options replace the
+// options of the fixture if given.
+func (f *fixture) reopen(t *testing.T, opts ...structure.Option) structure.Schema {
+	ctx := context.Background()
+	if len(opts) == 0 {
+		opts = f.opts
+	}
+	s, err := structure.New(f.faulty, opts...)
+	require.NoError(t, err)
+	db, err := s.Get(ctx, "db")
+	require.NoError(t, err)
+	sch, err := db.Get(ctx, "sch")
+	require.NoError(t, err)
+	return sch
+}
+
+// reopenTable returns the table as seen by a new process.
+func (f *fixture) reopenTable(t *testing.T, name string) structure.Table {
+	tbl, err := f.reopen(t).Get(context.Background(), name)
+	require.NoError(t, err)
+	return tbl
+}
+
+// tableLayer returns the storage layer holding the files of the table.
+func (f *fixture) tableLayer(t *testing.T, name string) storage.Storage {
+	layer := storage.Storage(f.faulty)
+	for _, path := range []string{"db", "sch", name} {
+		var err error
+		layer, err = layer.NewLayer(path)
+		require.NoError(t, err)
+	}
+	return layer
+}
+
+// usersTable creates the table users holding the rows 1 to rows, with the value of every row being its id, and
+// deletes the given rows.
+func (f *fixture) usersTable(t *testing.T, rows int, deleted ...int64) structure.Table {
+	tbl, err := f.schema.Create(context.Background(), "users", f.rowSchema)
+	require.NoError(t, err)
+	appended := make([]row.Row, rows)
+	for i := range appended {
+		appended[i] = f.row(t, i+1)
+	}
+	require.NoError(t, tbl.AppendMany(appended))
+	for _, id := range deleted {
+		require.NoError(t, tbl.DeleteRow(id))
+	}
+	return tbl
+}
+
+func (f *fixture) row(t *testing.T, value int) row.Row {
+	r, err := f.rowSchema.Row([]column.Column{column_types.Int(value)})
+	require.NoError(t, err)
+	return r
+}
+
+func (f *fixture) value(t *testing.T, r row.Row) column.Column {
+	cols, err := f.rowSchema.Columns(f.columnProcessor, r)
+	require.NoError(t, err)
+	return cols[0]
+}
+
+func TestTable_Faults(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("success - logged write is recovered after a failed data write", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpOffset, Filename: "data.bin", Nth: 1})
+		assert.ErrorIs(t, tbl.Append(f.row(t, 7)), storage.ErrInjected)
+
+		reopened, err := f.reopen(t).Get(ctx, "users")
+		require.NoError(t, err)
+		total, err := reopened.TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), total)
+		r, err := reopened.Row(1)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(7), f.value(t, r))
+	})
+
+	t.Run("success - block torn by a failed data write is repaired from the log", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		// Rewriting the block stops past the previous row, leaving its checksum overwritten
+		f.faulty.Inject(storage.Fault{Op: storage.OpOffset, Filename: "data.bin", Nth: 1, Action: storage.FaultShortWrite, Bytes: 48})
+		assert.ErrorIs(t, tbl.Append(f.row(t, 2)), storage.ErrInjected)
+
+		reopened := f.reopenTable(t, "users")
+		total, err := reopened.TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), total)
+		for id, value := range map[int64]int{1: 1, 2: 2} {
+			r, err := reopened.Row(id)
+			require.NoError(t, err)
+			assert.Equal(t, column_types.Int(value), f.value(t, r))
+		}
+	})
+
+	t.Run("success - compressed table is recovered from the log", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema, structure.WithCompression())
+		require.NoError(t, err)
+		for i := range 300 { // Enough rows to compact the frames
+			require.NoError(t, tbl.Append(f.row(t, i)))
+		}
+		require.NoError(t, tbl.Set(1, f.row(t, 42)))
+
+		reopened := f.reopenTable(t, "users")
+		total, err := reopened.TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(300), total)
+		for id, value := range map[int64]int{1: 42, 2: 1, 300: 299} {
+			r, err := reopened.Row(id)
+			require.NoError(t, err)
+			assert.Equal(t, column_types.Int(value), f.value(t, r))
+		}
+	})
+
+	t.Run("success - torn log record is discarded", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpAppend, Filename: "wal.bin", Nth: 1, Action: storage.FaultShortWrite, Bytes: 5})
+		assert.ErrorIs(t, tbl.Append(f.row(t, 2)), storage.ErrInjected)
+
+		reopened, err := f.reopen(t).Get(ctx, "users")
+		require.NoError(t, err)
+		total, err := reopened.TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), total)
+
+		require.NoError(t, reopened.Append(f.row(t, 3)))
+		r, err := reopened.Row(2)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(3), f.value(t, r))
+	})
+
+	t.Run("fail - corrupted log record followed by others keeps the log", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+		require.NoError(t, tbl.Append(f.row(t, 2)))
+
+		layer := f.tableLayer(t, "users")
+		logged, err := layer.ReadAll("wal.bin")
+		require.NoError(t, err)
+		corrupted := append([]byte(nil), logged...)
+		corrupted[20] ^= 0xff
+		require.NoError(t, layer.CreateOrOverride("wal.bin", corrupted))
+
+		_, err = f.reopen(t).Get(ctx, "users")
+		var corruption *storage.CorruptionError
+		require.ErrorAs(t, err, &corruption)
+		assert.Equal(t, "users", corruption.Table)
+		assert.Equal(t, "wal.bin", corruption.Filename)
+		kept, err := layer.ReadAll("wal.bin")
+		require.NoError(t, err)
+		assert.Equal(t, corrupted, kept)
+	})
+
+	t.Run("fail - corrupted row", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpReadPartials, Filename: "data.bin", Action: storage.FaultCorrupt})
+		_, err = tbl.Row(1)
+		var corruption *storage.CorruptionError
+		require.ErrorAs(t, err, &corruption)
+		assert.Equal(t, "users", corruption.Table)
+	})
+
+	t.Run("fail - corrupted schema", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpReadAll, Filename: "schema.bin", Action: storage.FaultCorrupt})
+		_, err = f.reopen(t).Get(ctx, "users")
+		var corruption *storage.CorruptionError
+		assert.ErrorAs(t, err, &corruption)
+	})
+
+	t.Run("fail - unreadable schema", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpReadAll, Filename: "schema.bin"})
+		_, err = f.reopen(t).Get(ctx, "users")
+		assert.ErrorIs(t, err, storage.ErrInjected)
+	})
+}
+
+func TestTable_Encryption(t *testing.T) {
+	ctx := context.Background()
+	keyProvider := func(t *testing.T) storage.KeyProvider {
+		keyFile := filepath.Join(t.TempDir(), "key")
+		require.NoError(t, storage.CreateKeyFile(keyFile))
+		return storage.NewFileKeyProvider(keyFile)
+	}
+	// marker is a value whose bytes are looked for in the stored files
+	const marker = 0x1122334455667788
+
+	t.Run("success - rows are not stored in plain, with and without compression", func(t *testing.T) {
+		f := newFixture(t, structure.WithKeyProvider(keyProvider(t)))
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema, structure.WithEncryption())
+		require.NoError(t, err)
+		compressed, err := f.schema.Create(ctx, "orders", f.rowSchema, structure.WithEncryption(), structure.WithCompression())
+		require.NoError(t, err)
+		for i := range 300 { // Enough rows to span several blocks
+			require.NoError(t, compressed.Append(f.row(t, marker+i)))
+			require.NoError(t, tbl.Append(f.row(t, marker+i)))
+		}
+
+		for _, name := range []string{"users", "orders"} {
+			layer := f.tableLayer(t, name)
+			for _, filename := range []string{"data.bin", "wal.bin"} {
+				stored, err := layer.ReadAll(filename)
+				require.NoError(t, err)
+				assert.False(t, bytes.Contains(stored, sys.Int64AsBytes(marker)), filename)
+			}
+			reopened := f.reopenTable(t, name)
+			total, err := reopened.TotalRows()
+			require.NoError(t, err)
+			assert.Equal(t, int64(300), total)
+			r, err := reopened.Row(300)
+			require.NoError(t, err)
+			assert.Equal(t, column_types.Int(marker+299), f.value(t, r))
+		}
+	})
+
+	t.Run("success - encrypted table is recovered from the log", func(t *testing.T) {
+		f := newFixture(t, structure.WithKeyProvider(keyProvider(t)))
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema, structure.WithEncryption())
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpOffset, Filename: "data.bin", Nth: 1, Action: storage.FaultShortWrite, Bytes: 8})
+		assert.ErrorIs(t, tbl.Append(f.row(t, 2)), storage.ErrInjected)
+
+		reopened := f.reopenTable(t, "users")
+		for id, value := range map[int64]int{1: 1, 2: 2} {
+			r, err := reopened.Row(id)
+			require.NoError(t, err)
+			assert.Equal(t, column_types.Int(value), f.value(t, r))
+		}
+	})
+
+	t.Run("fail - encrypted table without key provider", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Create(ctx, "users", f.rowSchema, structure.WithEncryption())
+		assert.ErrorIs(t, err, structure.ErrNoKeyProvider)
+		_, err = f.schema.Get(ctx, "users")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+
+		f = newFixture(t, structure.WithKeyProvider(keyProvider(t)))
+		_, err = f.schema.Create(ctx, "users", f.rowSchema, structure.WithEncryption())
+		require.NoError(t, err)
+		_, err = f.reopen(t, structure.WithKeyProvider(nil)).Get(ctx, "users")
+		assert.ErrorIs(t, err, structure.ErrNoKeyProvider)
+	})
+
+	t.Run("fail - encrypted table with another key", func(t *testing.T) {
+		f := newFixture(t, structure.WithKeyProvider(keyProvider(t)))
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema, structure.WithEncryption())
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		_, err = f.reopen(t, structure.WithKeyProvider(keyProvider(t))).Get(ctx, "users")
+		var corruption *storage.CorruptionError
+		assert.ErrorAs(t, err, &corruption)
+	})
+}
+
+func TestTable_ReadOnly(t *testing.T) {
+	ctx := context.Background()
+	writes := []storage.Op{
+		storage.OpCreateOrOverride, storage.OpAppend, storage.OpOffset, storage.OpReplace, storage.OpWriteBatch,
+		storage.OpDelete, storage.OpRename, storage.OpRemoveLayer, storage.OpSync,
+	}
+
+	t.Run("success - existing table is read from a read-only directory without writing", func(t *testing.T) {
+		f := newFixture(t) // Only provides the schema of the rows
+		dir := t.TempDir()
+		open := func(s storage.Storage) structure.Schema {
+			st, err := structure.New(s)
+			require.NoError(t, err)
+			db, err := st.CreateIfNotExists(ctx, "db")
+			require.NoError(t, err)
+			sch, err := db.CreateIfNotExists(ctx, "sch")
+			require.NoError(t, err)
+			return sch
+		}
+
+		s, err := storage.New(dir)
+		require.NoError(t, err)
+		sch := open(s)
+		for name, opts := range map[string][]structure.TableOption{"users": nil, "orders": {structure.WithCompression()}} {
+			tbl, err := sch.Create(ctx, name, f.rowSchema, opts...)
+			require.NoError(t, err)
+			require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 1), f.row(t, 2)}))
+		}
+		require.NoError(t, s.Close())
+		// The next writer replays and checkpoints the log left behind
+		s, err = storage.New(dir)
+		require.NoError(t, err)
+		for _, name := range []string{"users", "orders"} {
+			_, err := open(s).Get(ctx, name)
+			require.NoError(t, err)
+		}
+		require.NoError(t, s.Close())
+
+		require.NoError(t, filepath.WalkDir(dir, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chmod(path, 0555)
+		}))
+		t.Cleanup(func() {
+			_ = filepath.WalkDir(dir, func(path string, _ fs.DirEntry, _ error) error {
+				return os.Chmod(path, 0755)
+			})
+		})
+
+		readOnly, err := storage.NewReadOnly(dir)
+		require.NoError(t, err)
+		instrumented := storage.NewInstrumented(readOnly)
+		sch = open(instrumented)
+		for _, name := range []string{"users", "orders"} {
+			tbl, err := sch.Get(ctx, name)
+			require.NoError(t, err)
+			total, err := tbl.TotalRows()
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), total)
+			r, err := tbl.Row(2)
+			require.NoError(t, err)
+			assert.Equal(t, column_types.Int(2), f.value(t, r))
+		}
+		for _, op := range writes {
+			assert.Zero(t, instrumented.Snapshot().Total(op).Calls, op)
+		}
+
+		tbl, err := sch.Get(ctx, "users")
+		require.NoError(t, err)
+		assert.ErrorIs(t, tbl.Append(f.row(t, 3)), storage.ErrReadOnly)
+	})
+}
+
+func TestTable_DeleteRow(t *testing.T) {
+	ctx := context.Background()
+
+	// legacyTable returns a table created before rows could be deleted, named legacy
+	legacyTable := func(t *testing.T, f *fixture) structure.Table {
+		layer := f.tableLayer(t, "legacy")
+		schemaPayload, err := f.rowSchema.Bytes()
+		require.NoError(t, err)
+		require.NoError(t, layer.CreateOrOverride("schema.bin", schemaPayload))
+		require.NoError(t, layer.CreateOrOverride("data.bin", nil))
+		require.NoError(t, layer.CreateOrOverride("wal.bin", nil))
+		return f.reopenTable(t, "legacy")
+	}
+
+	t.Run("success - deleted row slot is reused", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 1), f.row(t, 2), f.row(t, 3)}))
+		require.NoError(t, tbl.DeleteRow(2))
+
+		_, err = tbl.Row(2)
+		assert.ErrorIs(t, err, structure.ErrRowDeleted)
+		total, err := tbl.TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), total)
+		live, err := tbl.LiveRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), live)
+
+		require.NoError(t, tbl.Append(f.row(t, 4)))
+		r, err := tbl.Row(2)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(4), f.value(t, r))
+		live, err = tbl.LiveRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), live)
+	})
+
+	t.Run("success - deleted rows are found after reopening", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 1), f.row(t, 2), f.row(t, 3)}))
+		require.NoError(t, tbl.DeleteRow(1))
+		require.NoError(t, tbl.DeleteRow(3))
+
+		reopened, err := f.reopen(t).Get(ctx, "users")
+		require.NoError(t, err)
+		live, err := reopened.LiveRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), live)
+
+		require.NoError(t, reopened.AppendMany([]row.Row{f.row(t, 4), f.row(t, 5), f.row(t, 6)}))
+		for id, expected := range map[int64]int{1: 4, 2: 2, 3: 5, 4: 6} {
+			r, err := reopened.Row(id)
+			require.NoError(t, err)
+			assert.Equal(t, column_types.Int(expected), f.value(t, r))
+		}
+	})
+
+	t.Run("success - rows skipped by a set are deleted", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Set(3, f.row(t, 3)))
+
+		_, err = tbl.Row(1)
+		assert.ErrorIs(t, err, structure.ErrRowDeleted)
+		live, err := tbl.LiveRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), live)
+
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+		r, err := tbl.Row(1)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(1), f.value(t, r))
+	})
+
+	t.Run("fail - row already deleted", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+		require.NoError(t, tbl.DeleteRow(1))
+
+		assert.ErrorIs(t, tbl.DeleteRow(1), structure.ErrRowDeleted)
+		assert.Error(t, tbl.DeleteRow(2))
+	})
+
+	t.Run("fail - table without row headers", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := legacyTable(t, f)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+		assert.ErrorIs(t, tbl.DeleteRow(1), structure.ErrUnsupported)
+		live, err := tbl.LiveRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), live)
+	})
+
+	t.Run("success - vacuum adds row headers", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := legacyTable(t, f)
+		require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 1), f.row(t, 2)}))
+
+		_, err := tbl.Vacuum(ctx)
+		require.NoError(t, err)
+		require.NoError(t, tbl.DeleteRow(1))
+
+		tbl = f.reopenTable(t, "legacy")
+		_, err = tbl.Row(1)
+		assert.ErrorIs(t, err, structure.ErrRowDeleted)
+		r, err := tbl.Row(2)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(2), f.value(t, r))
+		live, err := tbl.LiveRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), live)
+	})
+}
+
+func TestTable_Vacuum(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("success - live rows are compacted", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 4, 1, 3)
+
+		res, err := tbl.Vacuum(ctx, structure.WithRowRemap())
+		require.NoError(t, err)
+		assert.Equal(t, map[int64]int64{2: 1, 4: 2}, res.Remap)
+		assert.Positive(t, res.ReclaimedBytes)
+
+		for _, reopened := range []structure.Table{tbl, f.reopenTable(t, "users")} {
+			total, err := reopened.TotalRows()
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2), total)
+			for id, expected := range map[int64]int{1: 2, 2: 4} {
+				r, err := reopened.Row(id)
+				require.NoError(t, err)
+				assert.Equal(t, column_types.Int(expected), f.value(t, r))
+			}
+		}
+
+		require.NoError(t, tbl.Append(f.row(t, 5)))
+		r, err := tbl.Row(3)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(5), f.value(t, r))
+	})
+
+	t.Run("success - nothing to reclaim", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 1), f.row(t, 2)}))
+
+		res, err := tbl.Vacuum(ctx, structure.WithRowRemap())
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), res.ReclaimedBytes)
+		assert.Equal(t, map[int64]int64{1: 1, 2: 2}, res.Remap)
+	})
+
+	t.Run("fail - interrupted vacuum leaves the table unchanged", func(t *testing.T) {
+		f := newFixture(t)
+		f.usersTable(t, 4, 1, 3)
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpCreateOrOverride, Filename: "meta.bin", Nth: 1})
+		tbl, err := f.reopen(t).Get(ctx, "users")
+		require.NoError(t, err)
+		_, err = tbl.Vacuum(ctx)
+		assert.ErrorIs(t, err, storage.ErrInjected)
+		exists, err := f.tableLayer(t, "users").Exists("data.1.bin")
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		reopened := f.reopenTable(t, "users")
+		total, err := reopened.TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), total)
+		r, err := reopened.Row(4)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(4), f.value(t, r))
+		exists, err = f.tableLayer(t, "users").Exists("data.1.bin")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("fail - canceled context", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 4, 1, 3)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := tbl.Vacuum(canceled)
+		assert.ErrorIs(t, err, context.Canceled)
+		live, err := tbl.LiveRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), live)
+		exists, err := f.tableLayer(t, "users").Exists("data.1.bin")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
+
+func TestTable_Scan(t *testing.T) {
+	ctx := context.Background()
+
+	scan := func(t *testing.T, scanner structure.Scanner) map[int64]column.Column {
+		res := make(map[int64]column.Column)
+		for scanner.Next() {
+			require.Len(t, scanner.Columns(), 1)
+			res[scanner.ID()] = scanner.Columns()[0]
+		}
+		return res
+	}
+
+	t.Run("success - live rows are scanned across chunks", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 5, 3)
+
+		scanner, err := tbl.Scan(ctx, structure.ScanOptions{ChunkRows: 2, Processor: f.columnProcessor})
+		require.NoError(t, err)
+		assert.Equal(t, map[int64]column.Column{
+			1: column_types.Int(1), 2: column_types.Int(2), 4: column_types.Int(4), 5: column_types.Int(5),
+		}, scan(t, scanner))
+		assert.NoError(t, scanner.Err())
+	})
+
+	t.Run("success - rows are owned by the caller", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 5, 3)
+
+		r, err := tbl.Row(1)
+		require.NoError(t, err)
+		copy(r, f.row(t, 42))
+		scanner, err := tbl.Scan(ctx, structure.ScanOptions{Processor: f.columnProcessor})
+		require.NoError(t, err)
+		require.True(t, scanner.Next())
+		copy(scanner.Row(), f.row(t, 42))
+		require.True(t, scanner.Next())
+
+		r, err = tbl.Row(1)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(1), f.value(t, r))
+	})
+
+	t.Run("success - range of rows", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 5, 3)
+
+		scanner, err := tbl.Scan(ctx, structure.ScanOptions{Start: 2, End: 4, Processor: f.columnProcessor})
+		require.NoError(t, err)
+		assert.Equal(t, map[int64]column.Column{2: column_types.Int(2), 4: column_types.Int(4)}, scan(t, scanner))
+		assert.NoError(t, scanner.Err())
+
+		scanner, err = tbl.Scan(ctx, structure.ScanOptions{Start: 5, End: 10})
+		require.NoError(t, err)
+		require.True(t, scanner.Next())
+		assert.Equal(t, int64(5), scanner.ID())
+		assert.Equal(t, column_types.Int(5), f.value(t, scanner.Row()))
+		assert.Nil(t, scanner.Columns())
+		assert.False(t, scanner.Next())
+		assert.NoError(t, scanner.Err())
+	})
+
+	t.Run("success - rows appended during the scan are included up to the end", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 2)
+
+		bounded, err := tbl.Scan(ctx, structure.ScanOptions{End: 3, Processor: f.columnProcessor})
+		require.NoError(t, err)
+		defaulted, err := tbl.Scan(ctx, structure.ScanOptions{Processor: f.columnProcessor})
+		require.NoError(t, err)
+		require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 3), f.row(t, 4)}))
+
+		assert.Equal(t, map[int64]column.Column{
+			1: column_types.Int(1), 2: column_types.Int(2), 3: column_types.Int(3),
+		}, scan(t, bounded))
+		assert.NoError(t, bounded.Err())
+		assert.Equal(t, map[int64]column.Column{1: column_types.Int(1), 2: column_types.Int(2)}, scan(t, defaulted))
+		assert.NoError(t, defaulted.Err())
+	})
+
+	t.Run("success - empty table", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+
+		scanner, err := tbl.Scan(ctx, structure.ScanOptions{})
+		require.NoError(t, err)
+		assert.False(t, scanner.Next())
+		assert.NoError(t, scanner.Err())
+	})
+
+	t.Run("fail - invalid range", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 5, 3)
+
+		_, err := tbl.Scan(ctx, structure.ScanOptions{Start: 4, End: 2})
+		assert.Error(t, err)
+		_, err = tbl.Scan(ctx, structure.ScanOptions{Start: -1})
+		assert.Error(t, err)
+	})
+
+	t.Run("fail - canceled context", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 5, 3)
+
+		canceled, cancel := context.WithCancel(ctx)
+		scanner, err := tbl.Scan(canceled, structure.ScanOptions{})
+		require.NoError(t, err)
+		require.True(t, scanner.Next())
+		cancel()
+		assert.False(t, scanner.Next())
+		assert.ErrorIs(t, scanner.Err(), context.Canceled)
+		assert.False(t, scanner.Next())
+	})
+
+	t.Run("fail - read error", func(t *testing.T) {
+		f := newFixture(t)
+		f.usersTable(t, 5, 3)
+
+		tbl := f.reopenTable(t, "users")
+		f.faulty.Inject(storage.Fault{Op: storage.OpReadPartials, Filename: "data.bin", Nth: 1})
+		scanner, err := tbl.Scan(ctx, structure.ScanOptions{ChunkRows: 2})
+		require.NoError(t, err)
+		assert.False(t, scanner.Next())
+		assert.ErrorIs(t, scanner.Err(), storage.ErrInjected)
+	})
+}
+
+func TestTable_Alter(t *testing.T) {
+	ctx := context.Background()
+
+	columns := func(t *testing.T, f *fixture, tbl structure.Table, id int64) []column.Column {
+		r, err := tbl.Row(id)
+		require.NoError(t, err)
+		cols, err := tbl.Schema().Columns(f.columnProcessor, r)
+		require.NoError(t, err)
+		return cols
+	}
+	defaultValue := func(t *testing.T, colSchema *column.Schema, value int) []byte {
+		res, err := colSchema.ColumnBytes(column_types.Int(value))
+		require.NoError(t, err)
+		return res
+	}
+
+	t.Run("success - columns are added", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 3, 2)
+
+		score := &column.Schema{Name: "Score", Type: column_types.TypeInt, Size: 8}
+		score.Default = defaultValue(t, score, 7)
+		err := tbl.Alter(ctx, f.columnProcessor,
+			structure.AddColumn(&column.Schema{Name: "age", Type: column_types.TypeInt, Size: 4, Nullable: true}),
+			structure.AddColumn(score),
+		)
+		require.NoError(t, err)
+
+		for _, reopened := range []structure.Table{tbl, f.reopenTable(t, "users")} {
+			assert.Equal(t, []column.Column{column_types.Int(1), nil, column_types.Int(7)}, columns(t, f, reopened, 1))
+			assert.Equal(t, []column.Column{column_types.Int(3), nil, column_types.Int(7)}, columns(t, f, reopened, 3))
+			_, err = reopened.Row(2)
+			assert.ErrorIs(t, err, structure.ErrRowDeleted)
+			assert.Equal(t, "score", reopened.Schema().ColumnSchemas()[2].Name)
+		}
+
+		r, err := tbl.Schema().Row([]column.Column{column_types.Int(4), column_types.Int(40), column_types.Int(8)})
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(r))
+		assert.Equal(t, []column.Column{column_types.Int(4), column_types.Int(40), column_types.Int(8)}, columns(t, f, tbl, 2))
+		files, err := f.tableLayer(t, "users").List(storage.IsFileFilter)
+		require.NoError(t, err)
+		assert.Subset(t, files, []string{"data.bin", "schema.1.bin"})
+		assert.NotContains(t, files, "schema.bin")
+	})
+
+	t.Run("success - columns exceeding the reserved bytes rewrite the rows", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema, structure.WithReservedBytes(4))
+		require.NoError(t, err)
+		require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 1), f.row(t, 2)}))
+		require.NoError(t, tbl.DeleteRow(1))
+
+		err = tbl.Alter(ctx, f.columnProcessor, structure.AddColumn(&column.Schema{Name: "age", Type: column_types.TypeInt, Size: 8, Nullable: true}))
+		require.NoError(t, err)
+		reopened := f.reopenTable(t, "users")
+		assert.Equal(t, []column.Column{column_types.Int(2), nil}, columns(t, f, reopened, 2))
+		_, err = reopened.Row(1)
+		assert.ErrorIs(t, err, structure.ErrRowDeleted)
+		files, err := f.tableLayer(t, "users").List(storage.IsFileFilter)
+		require.NoError(t, err)
+		assert.Subset(t, files, []string{"data.1.bin", "schema.1.bin"})
+		assert.NotContains(t, files, "data.bin")
+	})
+
+	t.Run("success - vacuum migrates the rows to the latest version", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 3, 2)
+		age := &column.Schema{Name: "age", Type: column_types.TypeInt, Size: 4}
+		age.Default = defaultValue(t, age, 30)
+		require.NoError(t, tbl.Alter(ctx, f.columnProcessor, structure.AddColumn(age)))
+		r, err := tbl.Schema().Row([]column.Column{column_types.Int(4), column_types.Int(40)})
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(r))
+
+		_, err = tbl.Vacuum(ctx)
+		require.NoError(t, err)
+		reopened := f.reopenTable(t, "users")
+		assert.Equal(t, []column.Column{column_types.Int(1), column_types.Int(30)}, columns(t, f, reopened, 1))
+		assert.Equal(t, []column.Column{column_types.Int(4), column_types.Int(40)}, columns(t, f, reopened, 2))
+		assert.Equal(t, []column.Column{column_types.Int(3), column_types.Int(30)}, columns(t, f, reopened, 3))
+		files, err := f.tableLayer(t, "users").List(storage.IsFileFilter)
+		require.NoError(t, err)
+		assert.Subset(t, files, []string{"data.1.bin", "schema.2.bin"})
+		assert.NotContains(t, files, "schema.1.bin")
+
+		// Migrated rows take the latest version, a following alter upgrades them like any other
+		require.NoError(t, reopened.Alter(ctx, f.columnProcessor, structure.AddColumn(&column.Schema{Name: "note", Type: column_types.TypeInt, Size: 2, Nullable: true})))
+		assert.Equal(t, []column.Column{column_types.Int(3), column_types.Int(30), nil}, columns(t, f, reopened, 3))
+	})
+
+	t.Run("success - columns are dropped and resized", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 3, 2)
+		require.NoError(t, tbl.Alter(ctx, f.columnProcessor,
+			structure.AddColumn(&column.Schema{Name: "age", Type: column_types.TypeInt, Size: 8, Nullable: true}),
+		))
+
+		require.NoError(t, tbl.Alter(ctx, f.columnProcessor, structure.DropColumn("ID"), structure.ResizeColumn("age", 2)))
+		assert.Equal(t, []column.Column{nil}, columns(t, f, tbl, 3))
+		assert.Equal(t, int64(3), tbl.Schema().ByteSize())
+		total, err := f.reopenTable(t, "users").TotalRows()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), total)
+	})
+
+	t.Run("success - renaming only replaces the schema", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 3, 2)
+
+		require.NoError(t, tbl.Alter(ctx, f.columnProcessor, structure.RenameColumn("id", "user_id")))
+		reopened := f.reopenTable(t, "users")
+		assert.Equal(t, "user_id", reopened.Schema().ColumnSchemas()[0].Name)
+		assert.Equal(t, []column.Column{column_types.Int(3)}, columns(t, f, reopened, 3))
+		files, err := f.tableLayer(t, "users").List(storage.IsFileFilter)
+		require.NoError(t, err)
+		assert.Contains(t, files, "data.bin")
+		assert.Contains(t, files, "schema.1.bin")
+		assert.NotContains(t, files, "schema.bin")
+	})
+
+	t.Run("fail - invalid changes", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 3, 2)
+
+		err := tbl.Alter(ctx, f.columnProcessor, structure.DropColumn("missing"))
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+		err = tbl.Alter(ctx, f.columnProcessor, structure.AddColumn(&column.Schema{Name: "id", Type: column_types.TypeInt, Size: 8, Nullable: true}))
+		assert.Error(t, err)
+		err = tbl.Alter(ctx, f.columnProcessor, structure.AddColumn(&column.Schema{Name: "age", Type: column_types.TypeInt, Size: 8}))
+		assert.Error(t, err)
+		err = tbl.Alter(ctx, f.columnProcessor, structure.AddColumn(&column.Schema{Name: "name", Type: column_types.TypeVarchar, Size: 8, Nullable: true}))
+		assert.Error(t, err)
+		err = tbl.Alter(ctx, f.columnProcessor, structure.AddColumn(&column.Schema{Name: "age", Type: column_types.TypeInt, Size: 8, Default: []byte{1}}))
+		assert.Error(t, err)
+		err = tbl.Alter(ctx, f.columnProcessor, structure.DropColumn("id"))
+		assert.Error(t, err)
+		err = tbl.Alter(ctx, f.columnProcessor, structure.RenameColumn("id", "Id"), structure.ResizeColumn("id", 0))
+		assert.Error(t, err)
+		assert.Equal(t, f.rowSchema, tbl.Schema())
+	})
+
+	t.Run("fail - value does not fit the resized column", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 3, 2)
+		require.NoError(t, tbl.Append(f.row(t, 1<<20)))
+
+		err := tbl.Alter(ctx, f.columnProcessor, structure.ResizeColumn("id", 2))
+		assert.Error(t, err)
+		assert.Equal(t, []column.Column{column_types.Int(1 << 20)}, columns(t, f, f.reopenTable(t, "users"), 2))
+		exists, err := f.tableLayer(t, "users").Exists("data.1.bin")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("fail - meta file write is not swapped in", func(t *testing.T) {
+		f := newFixture(t)
+		f.usersTable(t, 3, 2)
+
+		f.faulty.Inject(storage.Fault{Op: storage.OpCreateOrOverride, Filename: "meta.bin", Nth: 1})
+		tbl := f.reopenTable(t, "users")
+		err := tbl.Alter(ctx, f.columnProcessor, structure.ResizeColumn("id", 4))
+		assert.ErrorIs(t, err, storage.ErrInjected)
+
+		reopened := f.reopenTable(t, "users")
+		assert.Equal(t, int64(8), reopened.Schema().ByteSize())
+		assert.Equal(t, []column.Column{column_types.Int(3)}, columns(t, f, reopened, 3))
+		files, err := f.tableLayer(t, "users").List(storage.IsFileFilter)
+		require.NoError(t, err)
+		assert.NotContains(t, files, "data.1.bin")
+		assert.NotContains(t, files, "schema.1.bin")
+	})
+
+	t.Run("fail - canceled context", func(t *testing.T) {
+		f := newFixture(t)
+		tbl := f.usersTable(t, 3, 2)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		err := tbl.Alter(canceled, f.columnProcessor, structure.ResizeColumn("id", 4))
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, []column.Column{column_types.Int(3)}, columns(t, f, tbl, 3))
+	})
+}
+
+func TestUpgrade(t *testing.T) {
+	ctx := context.Background()
+
+	// legacyNew and legacyInt encode like the hosts with 4 byte ints did
+	legacyNew := func(b []byte) []byte {
+		return append(binary.LittleEndian.AppendUint32(nil, uint32(len(b))), b...)
+	}
+	legacyInt := func(i int64) []byte {
+		return binary.LittleEndian.AppendUint32(nil, uint32(i))
+	}
+	legacyLayer := func(t *testing.T, f *fixture, name string, files map[string][]byte) storage.Storage {
+		layer := f.tableLayer(t, name)
+		for filename, payload := range files {
+			require.NoError(t, layer.CreateOrOverride(filename, payload))
+		}
+		return layer
+	}
+	legacyTable := func(t *testing.T, f *fixture, files map[string][]byte) storage.Storage {
+		return legacyLayer(t, f, "legacy", files)
+	}
+	assertUpgraded := func(t *testing.T, f *fixture, layer storage.Storage) {
+		files, err := layer.List(storage.IsFileFilter)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"meta.bin", "wal.bin", "data.1.bin", "schema.1.bin"}, files)
+		header, err := layer.ReadPartials("data.1.bin", []*storage.Partial{{OffsetFrom: 0, OffsetTo: 4}})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("KTDB"), header[0])
+	}
+
+	t.Run("success - table without meta file", func(t *testing.T) {
+		f := newFixture(t)
+		schemaPayload, err := f.rowSchema.Bytes()
+		require.NoError(t, err)
+		layer := legacyTable(t, f, map[string][]byte{
+			"schema.bin": schemaPayload,
+			"data.bin":   sys.ConcatSlices(f.row(t, 1), f.row(t, 2)),
+			"wal.bin":    nil,
+		})
+
+		require.NoError(t, structure.Upgrade(ctx, f.faulty))
+		assertUpgraded(t, f, layer)
+		tbl := f.reopenTable(t, "legacy")
+		require.NoError(t, tbl.Append(f.row(t, 3)))
+		for id := int64(1); id <= 3; id++ {
+			r, err := f.reopenTable(t, "legacy").Row(id)
+			require.NoError(t, err)
+			assert.Equal(t, column_types.Int(id), f.value(t, r))
+		}
+		require.NoError(t, tbl.DeleteRow(2))
+		_, err = f.reopenTable(t, "legacy").Row(2)
+		assert.ErrorIs(t, err, structure.ErrRowDeleted)
+	})
+
+	t.Run("success - table written with 4 byte ints", func(t *testing.T) {
+		f := newFixture(t)
+		colSchema := sys.ConcatSlices(
+			legacyNew([]byte(column_types.TypeInt)), legacyNew(nil), legacyNew([]byte("id")), legacyNew(legacyInt(8)), legacyNew([]byte{0}),
+		)
+		layer := legacyTable(t, f, map[string][]byte{
+			// The table has row headers, the third feature
+			"meta.bin":   sys.ConcatSlices(legacyNew(legacyInt(1<<2)), legacyNew(legacyInt(4096))),
+			"schema.bin": sys.ConcatSlices(legacyNew(legacyInt(8)), legacyNew(colSchema)),
+			"data.bin":   sys.ConcatSlices([]byte{1}, f.row(t, 1), []byte{0}, f.row(t, 2), []byte{1}, f.row(t, 3)),
+			"wal.bin":    nil,
+		})
+
+		require.NoError(t, structure.Upgrade(ctx, f.faulty, structure.WithLegacyIntByteSize(4)))
+		assertUpgraded(t, f, layer)
+		tbl := f.reopenTable(t, "legacy")
+		assert.Equal(t, f.rowSchema.ByteSize(), tbl.Schema().ByteSize())
+		assert.Equal(t, "id", tbl.Schema().ColumnSchemas()[0].Name)
+		r, err := tbl.Row(3)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(3), f.value(t, r))
+		_, err = tbl.Row(2)
+		assert.ErrorIs(t, err, structure.ErrRowDeleted)
+	})
+
+	t.Run("success - names stored before they were folded are normalized", func(t *testing.T) {
+		f := newFixture(t)
+		colSchema, err := (&column.Schema{Name: "Name", Type: column_types.TypeInt, Size: 8, Nullable: true}).Bytes()
+		require.NoError(t, err)
+		legacyLayer(t, f, "Legacy", map[string][]byte{
+			"schema.bin": sys.ConcatSlices(sys.New(sys.Int64AsBytes(9)), sys.New(colSchema)),
+			"data.bin":   nil,
+			"wal.bin":    nil,
+		})
+		require.NoError(t, structure.Upgrade(ctx, f.faulty))
+
+		tbl := f.reopenTable(t, "legacy")
+		assert.Equal(t, "name", tbl.Schema().ColumnSchemas()[0].Name)
+		rowProcessor, err := row.NewProcessor(f.columnProcessor)
+		require.NoError(t, err)
+		cols, err := rowProcessor.Prepare(tbl.Schema(), map[string]column.Column{"NAME": column_types.Int(1)})
+		require.NoError(t, err)
+		assert.Equal(t, []column.Column{column_types.Int(1)}, cols)
+		_, err = rowProcessor.Prepare(tbl.Schema(), map[string]column.Column{"name": column_types.Int(1), "Name": column_types.Int(2)})
+		assert.ErrorContains(t, err, "(row=[column_name=name]) is given more than once")
+
+		require.NoError(t, f.reopen(t).DropIfExists(ctx, "LEGACY"))
+		_, err = f.reopen(t).Get(ctx, "legacy")
+		assert.ErrorIs(t, err, structure.ErrNotFound)
+	})
+
+	t.Run("success - tables in the current format are left as they are", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Append(f.row(t, 1)))
+
+		require.NoError(t, structure.Upgrade(ctx, f.faulty))
+		files, err := f.tableLayer(t, "users").List(storage.IsFileFilter)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"meta.bin", "wal.bin", "data.bin", "schema.bin"}, files)
+		r, err := f.reopenTable(t, "users").Row(1)
+		require.NoError(t, err)
+		assert.Equal(t, column_types.Int(1), f.value(t, r))
+	})
+
+	t.Run("fail - table of a newer format", func(t *testing.T) {
+		f := newFixture(t)
+		_, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		layer := f.tableLayer(t, "users")
+		meta, err := layer.ReadAll("meta.bin")
+		require.NoError(t, err)
+		// The format version is the last section of the meta file
+		binary.LittleEndian.PutUint64(meta[len(meta)-8:], 2)
+		require.NoError(t, layer.CreateOrOverride("meta.bin", meta))
+
+		assert.ErrorIs(t, structure.Upgrade(ctx, f.faulty), structure.ErrUnsupported)
+		_, err = f.reopen(t).Get(ctx, "users")
+		assert.ErrorIs(t, err, structure.ErrUnsupported)
+	})
+
+	t.Run("fail - wal written with 4 byte ints", func(t *testing.T) {
+		f := newFixture(t)
+		schemaPayload := sys.ConcatSlices(legacyNew(legacyInt(0)))
+		layer := legacyTable(t, f, map[string][]byte{
+			"schema.bin": schemaPayload,
+			"data.bin":   nil,
+			"wal.bin":    []byte{1},
+		})
+
+		err := structure.Upgrade(ctx, f.faulty, structure.WithLegacyIntByteSize(4))
+		assert.ErrorIs(t, err, structure.ErrUnsupported)
+		exists, err := layer.Exists("schema.bin")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("fail - invalid int byte size", func(t *testing.T) {
+		f := newFixture(t)
+		assert.Error(t, structure.Upgrade(ctx, f.faulty, structure.WithLegacyIntByteSize(3)))
+	})
+}
+
+func TestTable_Concurrency(t *testing.T) {
+	ctx := context.Background()
+	const workers, rowsPerWorker = 8, 50
+	// The rows are built before the workers start, which must not call require
+
+	// run runs the function on every worker and waits for all of them
+	run := func(fn func(worker int)) {
+		var wg sync.WaitGroup
+		for worker := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fn(worker)
+			}()
+		}
+		wg.Wait()
+	}
+
+	t.Run("success - concurrent appends take distinct rows", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		rows := make([]row.Row, workers*rowsPerWorker)
+		for i := range rows {
+			rows[i] = f.row(t, i)
+		}
+
+		run(func(worker int) {
+			for i := range rowsPerWorker {
+				assert.NoError(t, tbl.Append(rows[worker*rowsPerWorker+i]))
+			}
+		})
+
+		total, err := tbl.TotalRows()
+		require.NoError(t, err)
+		require.Equal(t, int64(workers*rowsPerWorker), total)
+		seen := make(map[column.Column]struct{})
+		for id := int64(1); id <= total; id++ {
+			r, err := tbl.Row(id)
+			require.NoError(t, err)
+			seen[f.value(t, r)] = struct{}{}
+		}
+		assert.Len(t, seen, workers*rowsPerWorker)
+	})
+
+	t.Run("success - reads never observe half written rows", func(t *testing.T) {
+		f := newFixture(t)
+		rowProcessor, err := row.NewProcessor(f.columnProcessor)
+		require.NoError(t, err)
+		rowSchema, err := rowProcessor.New([]*column.Schema{
+			{Name: "a", Type: column_types.TypeInt, Size: 8},
+			{Name: "b", Type: column_types.TypeInt, Size: 8},
+		})
+		require.NoError(t, err)
+		tbl, err := f.schema.Create(ctx, "pairs", rowSchema)
+		require.NoError(t, err)
+		pair := func(value int) row.Row {
+			r, err := rowSchema.Row([]column.Column{column_types.Int(value), column_types.Int(value)})
+			require.NoError(t, err)
+			return r
+		}
+		require.NoError(t, tbl.AppendMany([]row.Row{pair(0), pair(0), pair(0)}))
+		pairs := make([]row.Row, workers*rowsPerWorker)
+		for i := range pairs {
+			pairs[i] = pair(i)
+		}
+
+		run(func(worker int) {
+			for i := range rowsPerWorker {
+				if worker%2 == 0 {
+					assert.NoError(t, tbl.Set(int64(i%3)+1, pairs[worker*rowsPerWorker+i]))
+					continue
+				}
+				r, err := tbl.Row(int64(i%3) + 1)
+				if !assert.NoError(t, err) {
+					continue
+				}
+				cols, err := tbl.Schema().Columns(f.columnProcessor, r)
+				if assert.NoError(t, err) {
+					assert.Equal(t, cols[0], cols[1])
+				}
+			}
+		})
+	})
+
+	t.Run("success - scans run alongside writes", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		require.NoError(t, tbl.AppendMany([]row.Row{f.row(t, 1), f.row(t, 2), f.row(t, 3), f.row(t, 4)}))
+		rows := make([]row.Row, rowsPerWorker)
+		for i := range rows {
+			rows[i] = f.row(t, i)
+		}
+
+		run(func(worker int) {
+			for i := range rowsPerWorker {
+				if worker%2 == 0 {
+					assert.NoError(t, tbl.Append(rows[i]))
+					continue
+				}
+				scanner, err := tbl.Scan(ctx, structure.ScanOptions{ChunkRows: 2, Processor: f.columnProcessor})
+				if !assert.NoError(t, err) {
+					continue
+				}
+				for scanner.Next() {
+					assert.Len(t, scanner.Columns(), 1)
+				}
+				assert.NoError(t, scanner.Err())
+			}
+		})
+	})
+
+	t.Run("success - deletes and vacuums run alongside reads", func(t *testing.T) {
+		f := newFixture(t)
+		tbl, err := f.schema.Create(ctx, "users", f.rowSchema)
+		require.NoError(t, err)
+		rows := make([]row.Row, workers*rowsPerWorker)
+		for i := range rows {
+			rows[i] = f.row(t, i)
+		}
+		require.NoError(t, tbl.AppendMany(rows))
+
+		var deleted atomic.Int64
+		run(func(worker int) {
+			for i := range rowsPerWorker {
+				switch worker % 4 {
+				case 0:
+					_, err := tbl.Vacuum(ctx)
+					assert.NoError(t, err)
+				case 1:
+					if err := tbl.DeleteRow(1); !errors.Is(err, structure.ErrRowDeleted) && assert.NoError(t, err) {
+						deleted.Add(1)
+					}
+					assert.NoError(t, tbl.Append(rows[i]))
+				default:
+					live, err := tbl.LiveRows()
+					assert.NoError(t, err)
+					total, err := tbl.TotalRows()
+					assert.NoError(t, err)
+					assert.LessOrEqual(t, live, total)
+				}
+			}
+		})
+
+		live, err := tbl.LiveRows()
+		require.NoError(t, err)
+		assert.Equal(t, int64(workers*rowsPerWorker)+2*rowsPerWorker-deleted.Load(), live)
+	})
+}
@@ -0,0 +1,197 @@
+package structure
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/grid/row"
+	"ktdb/pkg/engine/storage"
+)
+
+// tblDataFilePattern matches the names of the data files of all generations.
+var tblDataFilePattern = regexp.MustCompile(`^data(\.[0-9]+)?\.bin$`)
+
+// tblSchemaFilePattern matches the names of the schema files of all generations.
+var tblSchemaFilePattern = regexp.MustCompile(`^schema(\.[0-9]+)?\.bin$`)
+
+// VacuumResult describes the outcome of compacting a table.
+type VacuumResult struct {
+	// ReclaimedBytes is the number of bytes the data file shrank by
+	ReclaimedBytes int64
+	// Remap maps the old id of every live row to its new id, it is only set if requested by WithRowRemap
+	Remap map[int64]int64
+}
+
+type vacuumOptions struct {
+	remap bool
+}
+
+// VacuumOption configures the compaction of a table.
+type VacuumOption func(opts *vacuumOptions)
+
+// WithRowRemap requests the mapping of the old to the new row ids, for rebuilding whatever refers to the rows by id.
+func WithRowRemap() VacuumOption {
+	return func(opts *vacuumOptions) {
+		opts.remap = true
+	}
+}
+
+// Vacuum rewrites the live rows in order into a data file of the next generation and swaps it in by atomically
+// replacing the meta file. The rows written with older versions of the schema are migrated to the latest one, which
+// becomes the only version, and the rows of the tables created before rows could be deleted or versioned are
+// migrated to the current layout of the rows. An interrupted vacuum leaves the table as it was, the unfinished data
+// file is removed when the table is loaded.
+func (t *table) Vacuum(ctx context.Context, opts ...VacuumOption) (*VacuumResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	options := &vacuumOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if err := t.checkpoint(); err != nil {
+		return nil, errors.Wrapf(err, "%s could not checkpoint wal", t.errorDescriptor())
+	}
+	total, err := t.totalRows()
+	if err != nil {
+		return nil, err
+	}
+	res := &VacuumResult{}
+	if options.remap {
+		res.Remap = make(map[int64]int64)
+	}
+
+	free := &freeRows{total: total}
+	if t.hasRowHeaders() {
+		if free, err = t.freeRows(); err != nil {
+			return nil, err
+		}
+	}
+	upgrade := !t.meta.Has(tblFeatureRowHeaders) || !t.meta.Has(tblFeatureRowVersions)
+	if len(free.ids) == 0 && t.history.Version() == 0 && !upgrade {
+		for id := int64(1); options.remap && id <= total; id++ {
+			res.Remap[id] = id
+		}
+		return res, nil
+	}
+
+	previous := *t.meta
+	next := *t.meta
+	next.generation++
+	next.schemaGeneration++
+	if upgrade {
+		next.upgradeRows(t.history.Latest())
+	}
+	if err := t.compact(ctx, &next, total, free, res); err != nil {
+		if removeErr := t.removeFile(next.dataFile()); removeErr != nil { // Otherwise it is removed on load
+			return nil, errors.Wrapf(err, "%s could not compact data file, could not remove it (%s)", t.errorDescriptor(), removeErr)
+		}
+		return nil, errors.Wrapf(t.annotate(err), "%s could not compact data file", t.errorDescriptor())
+	}
+	if err := t.swap(&next, row.NewHistory(t.history.Latest())); err != nil {
+		return nil, err
+	}
+	t.free = &freeRows{total: total - int64(len(free.ids))}
+	if err := t.files.Delete(previous.dataFile()); err != nil {
+		return nil, errors.Wrapf(err, "%s could not delete previous data file", t.errorDescriptor())
+	}
+	if err := t.files.Delete(previous.schemaFile()); err != nil {
+		return nil, errors.Wrapf(err, "%s could not delete previous schema file", t.errorDescriptor())
+	}
+
+	return res, nil
+}
+
+// compact writes the live rows in the layout of the latest schema version into the data file of the meta in chunks,
+// the new ids of the rows are recorded into the remap of the result if it has one.
+func (t *table) compact(ctx context.Context, meta *tableMeta, total int64, free *freeRows, res *VacuumResult) error {
+	filename := meta.dataFile()
+	if err := t.files.CreateOrOverride(filename, meta.header(tblFileData)); err != nil {
+		return errors.Wrap(err, "could not create data file")
+	}
+
+	next := int64(1)
+	for first := int64(0); first < total; first += tblRowScanSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		last := min(first+tblRowScanSize, total)
+		chunk, err := t.files.ReadPartials(t.meta.dataFile(), []*storage.Partial{
+			{OffsetFrom: t.offset(first + 1), OffsetTo: t.offset(last + 1)},
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not read rows")
+		}
+
+		live := make([]byte, 0, len(chunk[0]))
+		for i := int64(0); i < last-first; i++ {
+			if free.isDead(first + i + 1) {
+				continue
+			}
+			r, err := t.row(chunk[0][i*t.slotSize() : (i+1)*t.slotSize()])
+			if err != nil {
+				return errors.Wrapf(err, "could not migrate %s", t.rowErrorDescriptor(first+i+1))
+			}
+			live = append(live, meta.slot(0, r)...)
+			if res.Remap != nil {
+				res.Remap[first+i+1] = next
+			}
+			next++
+		}
+		if err := t.files.Append(filename, live); err != nil {
+			return errors.Wrap(err, "could not write rows")
+		}
+	}
+
+	if err := t.files.Sync(filename); err != nil {
+		return errors.Wrap(err, "could not sync data file")
+	}
+
+	previousInfo, err := t.files.Info(t.meta.dataFile())
+	if err != nil {
+		return errors.Wrap(err, "could not read data file info")
+	}
+	info, err := t.files.Info(filename)
+	if err != nil {
+		return errors.Wrap(err, "could not read compacted data file info")
+	}
+	res.ReclaimedBytes = previousInfo.Size() - info.Size()
+	return nil
+}
+
+// removeStaleFiles removes the data and schema files of the other generations left behind by an interrupted vacuum
+// or alter.
+func (t *table) removeStaleFiles() error {
+	files, err := t.files.List(storage.IsFileFilter)
+	if err != nil {
+		return errors.Wrap(err, "could not list files")
+	}
+	for _, filename := range files {
+		stale := tblDataFilePattern.MatchString(filename) && filename != t.meta.dataFile() ||
+			tblSchemaFilePattern.MatchString(filename) && filename != t.meta.schemaFile()
+		if stale {
+			if err := t.removeFile(filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *table) removeFile(filename string) error {
+	exists, err := t.files.Exists(filename)
+	if err != nil || !exists {
+		return err
+	}
+	if err := t.files.Delete(filename); err != nil {
+		return errors.Wrapf(err, "could not delete file [filename=%s]", filename)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package structure
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"ktdb/pkg/engine/storage"
+	"ktdb/pkg/sys"
+)
+
+// tblUpgradeChunkSize is the number of bytes of the data file copied at once by an upgrade.
+const tblUpgradeChunkSize = 1 << 20
+
+type upgradeOptions struct {
+	intByteSize int64
+}
+
+// UpgradeOption configures the upgrade of the table files.
+type UpgradeOption func(opts *upgradeOptions)
+
+// WithLegacyIntByteSize sets the size of the integers the files were encoded with, which was the size of an int on
+// the host that wrote them. It defaults to the 8 bytes of the 64 bit hosts.
+//
+// The log and the index of the compressed files of hosts with smaller ints cannot be upgraded, the upgrade fails
+// with ErrUnsupported for the tables with a log that was not replayed yet or with compression, before it changes any
+// of their files. Their logs are replayed by opening and closing the tables on the host that wrote them, and their
+// rows are decompressed by copying them into a table created without compression on that host.
+func WithLegacyIntByteSize(size int64) UpgradeOption {
+	return func(opts *upgradeOptions) {
+		opts.intByteSize = size
+	}
+}
+
+// Upgrade rewrites the files of every table held by the storage into the current format, it must run before the
+// storage is opened by New. The rows of the tables created before rows could be deleted or versioned are migrated
+// to the current layout of the rows on the way. The tables already in the current format are left as they are, the
+// layout of their rows is migrated by Vacuum. Every table is swapped to
+// the current format by atomically replacing its meta file, an interrupted upgrade can therefore be run again.
+func Upgrade(ctx context.Context, s storage.Storage, opts ...UpgradeOption) error {
+	options := &upgradeOptions{intByteSize: sys.Int64ByteSize}
+	for _, opt := range opts {
+		opt(options)
+	}
+	switch options.intByteSize {
+	case 2, 4, 8:
+	default:
+		return errors.Errorf("invalid legacy int byte size [size=%d]", options.intByteSize)
+	}
+
+	return eachLayer(s, func(db string, dbStorage storage.Storage) error {
+		return eachLayer(dbStorage, func(sch string, schStorage storage.Storage) error {
+			return eachLayer(schStorage, func(name string, tableStorage storage.Storage) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				t := &table{storage: tableStorage, name: fmt.Sprintf("%s.%s.%s", db, sch, name)}
+				if err := t.upgrade(ctx, options); err != nil {
+					return errors.Wrapf(err, "%s could not upgrade table", t.errorDescriptor())
+				}
+				return nil
+			})
+		})
+	})
+}
+
+func eachLayer(s storage.Storage, fn func(name string, layer storage.Storage) error) error {
+	names, err := s.List(storage.IsDirFilter)
+	if err != nil {
+		return errors.Wrap(err, "could not list layers")
+	}
+	for _, name := range names {
+		layer, err := s.NewLayer(name)
+		if err != nil {
+			return errors.Wrapf(err, "could not open layer [name=%s]", name)
+		}
+		if err := fn(name, layer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgrade rewrites the files of the table with the file headers and the fixed size integers.
+func (t *table) upgrade(ctx context.Context, options *upgradeOptions) error {
+	meta, err := t.loadLegacyMeta(options.intByteSize)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return nil
+	}
+	t.meta = meta
+	if t.files, err = meta.storage(t.storage, nil); err != nil {
+		return errors.Wrap(err, "could not create files storage")
+	}
+
+	t.wal, err = meta.wal(t.storage, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not open wal")
+	}
+	if options.intByteSize != sys.Int64ByteSize {
+		// Both the log and the index of the compressed files are encoded with the integers of the host
+		walSize, err := t.wal.Size()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.Wrap(err, "could not read wal size")
+		}
+		if walSize > 0 {
+			return errors.Wrap(ErrUnsupported, "wal must be replayed by the host that wrote it")
+		}
+		if meta.Has(tblFeatureCompression) {
+			return errors.Wrap(ErrUnsupported, "compressed files cannot be upgraded")
+		}
+	} else if err := t.recover(); err != nil {
+		return errors.Wrap(err, "could not recover")
+	}
+
+	schemaPayload, err := t.files.ReadAll(meta.schemaFile())
+	if err != nil {
+		return errors.Wrap(t.annotate(err), "could not read schema")
+	}
+	if schemaPayload, err = upgradeLegacySchema(meta, schemaPayload, options.intByteSize); err != nil {
+		return errors.Wrap(err, "could not upgrade schema")
+	}
+	if t.history, err = meta.loadSchema(schemaPayload); err != nil {
+		return errors.Wrap(err, "could not load schema")
+	}
+
+	previous := *meta
+	next := *meta
+	next.features |= tblFeatureFileHeaders
+	next.upgradeRows(t.history.Latest())
+	next.generation++
+	next.schemaGeneration++
+	if err := t.copyData(ctx, &next); err != nil {
+		if removeErr := t.removeFile(next.dataFile()); removeErr != nil { // Otherwise it is removed on load
+			return errors.Wrapf(err, "could not copy data file, could not remove it (%s)", removeErr)
+		}
+		return errors.Wrap(t.annotate(err), "could not copy data file")
+	}
+	if err := t.swap(&next, t.history); err != nil {
+		return err
+	}
+	if err := t.files.Delete(previous.dataFile()); err != nil {
+		return errors.Wrap(err, "could not delete previous data file")
+	}
+	if err := t.files.Delete(previous.schemaFile()); err != nil {
+		return errors.Wrap(err, "could not delete previous schema file")
+	}
+	return nil
+}
+
+// loadLegacyMeta returns the meta of the table stored with integers of the size, it is nil if the table is in the
+// current format already.
+func (t *table) loadLegacyMeta(intByteSize int64) (*tableMeta, error) {
+	meta := &tableMeta{}
+	exists, err := t.storage.Exists(tblMetaFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not check meta file existence")
+	}
+	if !exists { // Tables created before the meta file was introduced have no features
+		return meta, nil
+	}
+
+	payload, err := t.storage.ReadAll(tblMetaFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read meta file")
+	}
+	err = meta.Load(payload)
+	if errors.Is(err, ErrUnsupported) {
+		return nil, err
+	}
+	if err == nil && meta.Has(tblFeatureFileHeaders) {
+		return nil, nil
+	}
+	if payload, err = upgradeLegacyPayload(payload, intByteSize, upgradeLegacyInt); err != nil {
+		return nil, errors.Wrap(err, "could not upgrade meta file")
+	}
+	if err := meta.Load(payload); err != nil {
+		return nil, errors.Wrap(err, "could not load meta file")
+	}
+	return meta, nil
+}
+
+// copyData copies the rows into the data file of the meta, behind its header. The rows are copied as they are if the
+// meta keeps the layout of the rows, otherwise they are migrated to its layout and keep their ids.
+func (t *table) copyData(ctx context.Context, meta *tableMeta) error {
+	filename := meta.dataFile()
+	if err := t.files.CreateOrOverride(filename, meta.header(tblFileData)); err != nil {
+		return errors.Wrap(err, "could not create data file")
+	}
+	if meta.slotSize(t.history.Latest()) != t.slotSize() || meta.headerSize() != t.meta.headerSize() {
+		if err := t.migrateRows(ctx, meta); err != nil {
+			return err
+		}
+		if err := t.files.Sync(filename); err != nil {
+			return errors.Wrap(err, "could not sync data file")
+		}
+		return nil
+	}
+	info, err := t.files.Info(t.meta.dataFile())
+	if err != nil {
+		return errors.Wrap(err, "could not read data file info")
+	}
+
+	for from := t.meta.dataOffset(); from < info.Size(); from += tblUpgradeChunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		chunk, err := t.files.ReadPartials(t.meta.dataFile(), []*storage.Partial{
+			{OffsetFrom: from, OffsetTo: min(from+tblUpgradeChunkSize, info.Size())},
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not read rows")
+		}
+		if err := t.files.Append(filename, chunk[0]); err != nil {
+			return errors.Wrap(err, "could not write rows")
+		}
+	}
+
+	if err := t.files.Sync(filename); err != nil {
+		return errors.Wrap(err, "could not sync data file")
+	}
+	return nil
+}
+
+// migrateRows writes every row in the layout of the meta into its data file in chunks, the deleted rows stay deleted.
+func (t *table) migrateRows(ctx context.Context, meta *tableMeta) error {
+	total, err := t.totalRows()
+	if err != nil {
+		return err
+	}
+	slotSize := meta.slotSize(t.history.Latest())
+	for first := int64(0); first < total; first += tblRowScanSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		last := min(first+tblRowScanSize, total)
+		chunk, err := t.files.ReadPartials(t.meta.dataFile(), []*storage.Partial{
+			{OffsetFrom: t.offset(first + 1), OffsetTo: t.offset(last + 1)},
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not read rows")
+		}
+
+		slots := make([]byte, 0, (last-first)*slotSize)
+		for i := int64(0); i < last-first; i++ {
+			slot := chunk[0][i*t.slotSize() : (i+1)*t.slotSize()]
+			if t.hasRowHeaders() && slot[0] != tblRowLive {
+				slots = append(slots, make([]byte, slotSize)...)
+				continue
+			}
+			r, err := t.row(slot)
+			if err != nil {
+				return errors.Wrapf(err, "could not migrate %s", t.rowErrorDescriptor(first+i+1))
+			}
+			slots = append(slots, meta.slot(0, r)...)
+		}
+		if err := t.files.Append(meta.dataFile(), slots); err != nil {
+			return errors.Wrap(err, "could not write rows")
+		}
+	}
+	return nil
+}
+
+// upgradeLegacySchema re-encodes the payload of the schema file of the meta with the fixed size integers.
+func upgradeLegacySchema(meta *tableMeta, payload []byte, intByteSize int64) ([]byte, error) {
+	if !meta.Has(tblFeatureRowVersions) {
+		return upgradeLegacyRowSchema(payload, intByteSize)
+	}
+	return upgradeLegacyPayload(payload, intByteSize, func(_ int, version []byte) ([]byte, error) {
+		return upgradeLegacyRowSchema(version, intByteSize)
+	})
+}
+
+// upgradeLegacyRowSchema re-encodes the payload of a row.Schema, it holds the row size followed by a payload for every
+// column holding the type, default, name, size and nullability of the column.
+func upgradeLegacyRowSchema(payload []byte, intByteSize int64) ([]byte, error) {
+	return upgradeLegacyPayload(payload, intByteSize, func(i int, section []byte) ([]byte, error) {
+		if i == 0 {
+			return upgradeLegacyInt(i, section)
+		}
+		return upgradeLegacyPayload(section, intByteSize, func(i int, section []byte) ([]byte, error) {
+			if i == 3 {
+				return upgradeLegacyInt(i, section)
+			}
+			return section, nil
+		})
+	})
+}
+
+// upgradeLegacyPayload re-encodes the sections of the payload encoded with integers of the size, the content of every
+// section is re-encoded by upgrade.
+func upgradeLegacyPayload(payload []byte, intByteSize int64, upgrade func(i int, section []byte) ([]byte, error)) ([]byte, error) {
+	sections, err := sys.LegacyReadAll(payload, intByteSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "deserialization failed")
+	}
+	for i, section := range sections {
+		upgraded, err := upgrade(i, section)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not upgrade section [position=%d]", i)
+		}
+		sections[i] = sys.New(upgraded)
+	}
+	return sys.ConcatSlices(sections...), nil
+}
+
+func upgradeLegacyInt(_ int, section []byte) ([]byte, error) {
+	i, err := sys.LegacyBytesAsInt64(section)
+	if err != nil {
+		return nil, err
+	}
+	return sys.Int64AsBytes(i), nil
+}
@@ -2,13 +2,19 @@ package sys
 
 import (
 	"encoding/binary"
-	"unsafe"
 
 	"github.com/pkg/errors"
 )
 
-// IntByteSize represents the size of a typical int in bytes depending on the system's architecture.
-const IntByteSize = int64(unsafe.Sizeof(0))
+// Int64ByteSize is the size of the encoded integers, it is the same on every architecture so that the encoded data
+// can be read on any host.
+const Int64ByteSize = int64(8)
+
+// IntByteSize is the size of the encoded integers.
+//
+// Deprecated: the integers used to be encoded with the size of an int of the host, they are encoded with
+// Int64ByteSize bytes on every architecture now. Use Int64ByteSize instead.
+const IntByteSize = Int64ByteSize
 
 func AddPadding(data []byte, desiredSize int64) ([]byte, error) {
 	if size := int64(len(data)); size > desiredSize {
@@ -29,25 +35,20 @@ func RemovePadding(data []byte) []byte {
 }
 
 func Int64AsBytes(i int64) []byte {
-	res := make([]byte, IntByteSize)
-	switch IntByteSize {
-	case 2:
-		binary.LittleEndian.PutUint16(res, uint16(i))
-	case 4:
-		binary.LittleEndian.PutUint32(res, uint32(i))
-	case 8:
-		binary.LittleEndian.PutUint64(res, uint64(i))
-	default:
-		panic("unknown system architecture")
-	}
-	return res
+	return binary.LittleEndian.AppendUint64(make([]byte, 0, Int64ByteSize), uint64(i))
 }
 
 func BytesAsInt64(bytes []byte) (int64, error) {
-	if int64(len(bytes)) != IntByteSize {
+	if int64(len(bytes)) != Int64ByteSize {
 		return 0, errors.New("unsupported int bytes size")
 	}
-	switch IntByteSize {
+	return int64(binary.LittleEndian.Uint64(bytes)), nil
+}
+
+// LegacyBytesAsInt64 reads the integers encoded before they had a fixed size, their size was the size of an int on
+// the host that encoded them.
+func LegacyBytesAsInt64(bytes []byte) (int64, error) {
+	switch len(bytes) {
 	case 2:
 		return int64(binary.LittleEndian.Uint16(bytes)), nil
 	case 4:
@@ -55,7 +56,7 @@ func BytesAsInt64(bytes []byte) (int64, error) {
 	case 8:
 		return int64(binary.LittleEndian.Uint64(bytes)), nil
 	default:
-		return 0, errors.New("unsupported system int bytes size")
+		return 0, errors.New("unsupported int bytes size")
 	}
 }
 
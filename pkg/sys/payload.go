@@ -5,29 +5,49 @@ import (
 )
 
 func Size(payload []byte) (int64, error) {
-	if int64(len(payload)) < IntByteSize {
+	return sizeOf(payload, Int64ByteSize)
+}
+
+func Read(payload []byte) ([]byte, int64, error) {
+	return read(payload, Int64ByteSize)
+}
+
+func ReadAll(payload []byte) ([][]byte, error) {
+	return readAll(payload, Int64ByteSize)
+}
+
+// LegacyReadAll reads the payloads encoded before the integers had a fixed size, their sizes are encoded with the
+// given number of bytes.
+func LegacyReadAll(payload []byte, intByteSize int64) ([][]byte, error) {
+	return readAll(payload, intByteSize)
+}
+
+func sizeOf(payload []byte, intByteSize int64) (int64, error) {
+	if int64(len(payload)) < intByteSize {
 		return 0, errors.New("payload has no size defined")
 	}
-
-	return BytesAsInt64(payload[:IntByteSize])
+	if intByteSize == Int64ByteSize {
+		return BytesAsInt64(payload[:intByteSize])
+	}
+	return LegacyBytesAsInt64(payload[:intByteSize])
 }
 
-func Read(payload []byte) ([]byte, int64, error) {
-	size, err := Size(payload)
+func read(payload []byte, intByteSize int64) ([]byte, int64, error) {
+	size, err := sizeOf(payload, intByteSize)
 	if err != nil {
 		return nil, 0, err
 	}
-	totalSize := IntByteSize + size
-	if int64(len(payload)) < totalSize {
+	if size < 0 || int64(len(payload))-intByteSize < size {
 		return nil, 0, errors.New("size of payload is larger than the payload itself")
 	}
-	return payload[IntByteSize:totalSize], totalSize, nil
+	totalSize := intByteSize + size
+	return payload[intByteSize:totalSize], totalSize, nil
 }
 
-func ReadAll(payload []byte) ([][]byte, error) {
+func readAll(payload []byte, intByteSize int64) ([][]byte, error) {
 	res := make([][]byte, 0)
 	for len(payload) != 0 {
-		bytes, consumed, err := Read(payload)
+		bytes, consumed, err := read(payload, intByteSize)
 		if err != nil {
 			return nil, err
 		}
@@ -40,8 +60,8 @@ func ReadAll(payload []byte) ([][]byte, error) {
 
 func New(bytes []byte) []byte {
 	size := int64(len(bytes))
-	res := make([]byte, IntByteSize+size)
+	res := make([]byte, Int64ByteSize+size)
 	copy(res, Int64AsBytes(size))
-	copy(res[IntByteSize:], bytes)
+	copy(res[Int64ByteSize:], bytes)
 	return res
 }
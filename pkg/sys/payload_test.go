@@ -11,15 +11,15 @@ import (
 func TestNew(t *testing.T) {
 	t.Run("with nil", func(t *testing.T) {
 		res := sys.New(nil)
-		assert.Equal(t, sys.IntByteSize, int64(len(res)))
+		assert.Equal(t, sys.Int64ByteSize, int64(len(res)))
 	})
 	t.Run("with 0 bytes", func(t *testing.T) {
 		res := sys.New(make([]byte, 0))
-		assert.Equal(t, sys.IntByteSize, int64(len(res)))
+		assert.Equal(t, sys.Int64ByteSize, int64(len(res)))
 	})
 	t.Run("with 4 bytes", func(t *testing.T) {
 		res := sys.New(make([]byte, 4))
-		assert.Equal(t, sys.IntByteSize+4, int64(len(res)))
+		assert.Equal(t, sys.Int64ByteSize+4, int64(len(res)))
 	})
 }
 
@@ -40,7 +40,7 @@ func TestSize(t *testing.T) {
 
 		assert.NoError(t, err)
 		assert.Equal(t, int64(len(expected)), res)
-		assert.Equal(t, expected, given[sys.IntByteSize:])
+		assert.Equal(t, expected, given[sys.Int64ByteSize:])
 	})
 
 	t.Run("fail - not enough", func(t *testing.T) {
@@ -54,7 +54,7 @@ func TestSize(t *testing.T) {
 
 func TestRead(t *testing.T) {
 	t.Run("success - no extra bytes", func(t *testing.T) {
-		expectedSize := sys.IntByteSize + 4
+		expectedSize := sys.Int64ByteSize + 4
 		expectedBytes := make([]byte, 4)
 		givenBytes := make([]byte, 10)
 		given := sys.ConcatSlices(sys.Int64AsBytes(4), givenBytes)
@@ -64,7 +64,7 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, expectedBytes, res)
 	})
 	t.Run("success - some extra bytes", func(t *testing.T) {
-		expectedSize := sys.IntByteSize + 4
+		expectedSize := sys.Int64ByteSize + 4
 		expectedBytes := make([]byte, 4)
 		givenBytes := make([]byte, 4)
 		given := sys.ConcatSlices(sys.Int64AsBytes(4), givenBytes)
@@ -74,3 +74,22 @@ func TestRead(t *testing.T) {
 		assert.Equal(t, expectedBytes, res)
 	})
 }
+
+func TestLegacyReadAll(t *testing.T) {
+	t.Run("success - 32 bit sizes", func(t *testing.T) {
+		given := []byte{2, 0, 0, 0, 'k', 't', 0, 0, 0, 0, 1, 0, 0, 0, 'v'}
+		res, err := sys.LegacyReadAll(given, 4)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("kt"), {}, []byte("v")}, res)
+	})
+	t.Run("success - 64 bit sizes", func(t *testing.T) {
+		given := sys.ConcatSlices(sys.New([]byte("kt")), sys.New([]byte("v")))
+		res, err := sys.LegacyReadAll(given, 8)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("kt"), []byte("v")}, res)
+	})
+	t.Run("fail - size larger than payload", func(t *testing.T) {
+		_, err := sys.LegacyReadAll([]byte{5, 0, 0, 0, 'k'}, 4)
+		assert.EqualError(t, err, "size of payload is larger than the payload itself")
+	})
+}